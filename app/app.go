@@ -1,9 +1,11 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -12,22 +14,50 @@ import (
 	"github.com/oizgagin/ing/app/server"
 	"github.com/oizgagin/ing/pkg/cache"
 	"github.com/oizgagin/ing/pkg/cache/redisring"
-	"github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/codec"
+	"github.com/oizgagin/ing/pkg/codec/avro"
+	dbpkg "github.com/oizgagin/ing/pkg/db"
 	"github.com/oizgagin/ing/pkg/db/postgres"
+	"github.com/oizgagin/ing/pkg/dlq"
+	dlqkafka "github.com/oizgagin/ing/pkg/dlq/kafka"
+	"github.com/oizgagin/ing/pkg/rsvps"
 	"github.com/oizgagin/ing/pkg/stream"
+	"github.com/oizgagin/ing/pkg/stream/file"
+	"github.com/oizgagin/ing/pkg/stream/httpstream"
 	"github.com/oizgagin/ing/pkg/stream/kafka"
+	"github.com/oizgagin/ing/pkg/stream/redisstream"
 )
 
 type AppConfig struct {
 	Output     string `toml:"output"`
 	LogLevel   string `toml:"log_level"`
 	MetricAddr string `toml:"metric_addr"`
+	Stream     string `toml:"stream"`
+	Source     string `toml:"source"`
+	Ingest     string `toml:"ingest"`
+}
+
+// SourceConfig configures a stream RSVPs are consumed from, every RSVP of the
+// stream is tagged with the source name.
+type SourceConfig struct {
+	Name        string             `toml:"name"`
+	Stream      string             `toml:"stream"`
+	Kafka       kafka.Config       `toml:"kafka"`
+	FileStream  file.Config        `toml:"file-stream"`
+	HTTPStream  httpstream.Config  `toml:"http-stream"`
+	RedisStream redisstream.Config `toml:"redis-stream"`
 }
 
 type Config struct {
 	App         AppConfig          `toml:"app"`
 	Kafka       kafka.Config       `toml:"kafka"`
+	FileStream  file.Config        `toml:"file-stream"`
+	HTTPStream  httpstream.Config  `toml:"http-stream"`
+	RedisStream redisstream.Config `toml:"redis-stream"`
+	Sources     []SourceConfig     `toml:"sources"`
+	DLQ         dlqkafka.Config    `toml:"dlq"`
 	Postgres    postgres.Config    `toml:"postgres"`
+	Partitions  PartitionsConfig   `toml:"partitions"`
 	RedisRing   redisring.Config   `toml:"redis-ring"`
 	RSVPHandler rsvphandler.Config `toml:"rsvp-handler"`
 	Server      server.Config      `toml:"server"`
@@ -36,9 +66,12 @@ type Config struct {
 type App struct {
 	l *zap.Logger
 
-	stream stream.Stream
-	db     db.DB
-	cache  cache.EventInfoCache
+	stream      stream.Stream
+	deadLetters dlq.Sink
+	db          dbpkg.DB
+	cache       cache.EventInfoCache
+	producer    *kafka.Producer
+	partitioner *partitioner
 
 	handler       *rsvphandler.Handler
 	server        *server.Server
@@ -52,21 +85,60 @@ func NewApp(cfg Config) (*App, error) {
 		return nil, fmt.Errorf("could not init logging: %w", err)
 	}
 
-	db, err := postgres.NewDB(cfg.Postgres)
+	db, err := postgres.NewDB(cfg.Postgres, l)
 	if err != nil {
 		return nil, fmt.Errorf("could not create db: %w", err)
 	}
 
+	var partitioner *partitioner
+	if cfg.Partitions.Interval.Duration > 0 {
+		partitioner, err = newPartitioner(cfg.Partitions, l, db)
+		if err != nil {
+			return nil, fmt.Errorf("could not create partitioner: %w", err)
+		}
+	}
+
 	cache, err := redisring.NewCache(cfg.RedisRing)
 	if err != nil {
 		return nil, fmt.Errorf("could not create cache: %w", err)
 	}
 
-	stream := kafka.NewStream(cfg.Kafka, l)
+	var deadLetters dlq.Sink
+	if cfg.DLQ.Topic != "" {
+		deadLetters = dlqkafka.NewSink(cfg.DLQ)
+	}
 
-	handler := rsvphandler.NewHandler(cfg.RSVPHandler, l, stream, db)
+	stream, err := newStream(cfg, l, deadLetters, db)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream: %w", err)
+	}
 
-	server, err := server.NewServer(cfg.Server, l, db, cache)
+	handler, err := rsvphandler.NewHandler(cfg.RSVPHandler, l, stream, db)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("could not create rsvp handler: %w", err)
+	}
+
+	var (
+		producer *kafka.Producer
+		ingester server.Ingester
+	)
+	switch cfg.App.Ingest {
+	case "", "db":
+		// pushed rsvps are passed through the same processors as the consumed ones
+		chain, err := rsvphandler.NewChain(cfg.RSVPHandler.Processors)
+		if err != nil {
+			return nil, fmt.Errorf("could not create rsvp processors: %w", err)
+		}
+		ingester = dbIngester(l, chain, db, deadLetters, sourceTopics(cfg))
+	case "kafka":
+		producer = kafka.NewProducer(cfg.Kafka)
+		ingester = server.IngesterFunc(producer.Produce)
+	default:
+		return nil, fmt.Errorf(`invalid ingest %q, must be in ("db" or "kafka")`, cfg.App.Ingest)
+	}
+
+	server, err := server.NewServer(cfg.Server, l, db, cache, ingester)
 	if err != nil {
 		return nil, fmt.Errorf("could not create server: %w", err)
 	}
@@ -76,8 +148,11 @@ func NewApp(cfg Config) (*App, error) {
 	app := App{
 		l:             l,
 		stream:        stream,
+		deadLetters:   deadLetters,
 		db:            db,
 		cache:         cache,
+		producer:      producer,
+		partitioner:   partitioner,
 		handler:       handler,
 		server:        server,
 		metricsServer: metricsServer,
@@ -86,6 +161,44 @@ func NewApp(cfg Config) (*App, error) {
 	return &app, nil
 }
 
+// dbIngester saves pushed rsvps which pass the processor chain, rsvps dropped by
+// it are acknowledged without saving, parked ones are handed over to the dead
+// letter sink (or dropped if there is none) with the topic their source is
+// consumed from, if any, so that they can be replayed.
+func dbIngester(l *zap.Logger, chain *rsvphandler.Chain, db dbpkg.DB, deadLetters dlq.Sink, topics map[string]string) server.Ingester {
+	l = l.With(zap.String("component", "ingester"))
+
+	return server.IngesterFunc(func(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error {
+		verdict, stage, err := chain.Process(ctx, &rsvp)
+		if err != nil {
+			return err
+		}
+
+		switch verdict {
+		case rsvphandler.Drop:
+			return nil
+		case rsvphandler.Park:
+			parkErr := fmt.Errorf("parked by processor %q", stage)
+			if deadLetters == nil {
+				l.Error("dropping pushed rsvp, no dead letter sink", zap.Int64("rsvp_id", rsvp.ID), zap.Error(parkErr))
+				return nil
+			}
+
+			return deadLetters.Park(ctx, dlq.Letter{
+				Key:      []byte(rsvp.Event.ID),
+				Value:    raw,
+				Err:      parkErr.Error(),
+				Stage:    dlq.StageSave,
+				Attempts: 1,
+				Topic:    topics[rsvp.Source],
+				Source:   rsvp.Source,
+			})
+		}
+
+		return db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Raw: raw, Origin: rsvps.Origin{ReceivedAt: time.Now()}})
+	})
+}
+
 func (app *App) Close() error {
 	app.l.Info("closing application")
 
@@ -94,8 +207,17 @@ func (app *App) Close() error {
 	var errs []error
 
 	errs = append(errs, app.server.Close())
+	if app.producer != nil {
+		errs = append(errs, app.producer.Close())
+	}
+	if app.partitioner != nil {
+		errs = append(errs, app.partitioner.Close())
+	}
 	errs = append(errs, app.db.Close())
 	errs = append(errs, app.stream.Close())
+	if app.deadLetters != nil {
+		errs = append(errs, app.deadLetters.Close())
+	}
 	errs = append(errs, app.cache.Close())
 	errs = append(errs, app.metricsServer.Close())
 
@@ -110,6 +232,178 @@ func (app *App) Close() error {
 	return nil
 }
 
+// sources returns the configured sources, if there are none the single source is
+// configured by the stream sections and named by app.source.
+func sources(cfg Config) []SourceConfig {
+	if len(cfg.Sources) > 0 {
+		return cfg.Sources
+	}
+
+	name := cfg.App.Source
+	if name == "" {
+		name = rsvps.DefaultSource
+	}
+
+	return []SourceConfig{{
+		Name:        name,
+		Stream:      cfg.App.Stream,
+		Kafka:       cfg.Kafka,
+		FileStream:  cfg.FileStream,
+		HTTPStream:  cfg.HTTPStream,
+		RedisStream: cfg.RedisStream,
+	}}
+}
+
+// sourceTopics returns the topics of the sources which are consumed from Kafka.
+func sourceTopics(cfg Config) map[string]string {
+	topics := make(map[string]string)
+	for _, source := range sources(cfg) {
+		if source.Stream == "" || source.Stream == "kafka" {
+			topics[source.Name] = source.Kafka.Topic
+		}
+	}
+	return topics
+}
+
+// newStream merges the streams of all sources.
+func newStream(cfg Config, l *zap.Logger, deadLetters dlq.Sink, db *postgres.DB) (stream.Stream, error) {
+	var (
+		streams []stream.Stream
+		names   = make(map[string]bool)
+	)
+
+	closeAll := func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}
+
+	for _, source := range sources(cfg) {
+		if err := rsvps.ValidateSource(source.Name); err != nil {
+			closeAll()
+			return nil, err
+		}
+		if names[source.Name] {
+			closeAll()
+			return nil, fmt.Errorf("duplicate source %q", source.Name)
+		}
+		names[source.Name] = true
+
+		s, err := newSourceStream(source, l.With(zap.String("source", source.Name)), deadLetters, db)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("could not create stream of source %q: %w", source.Name, err)
+		}
+
+		streams = append(streams, stream.Tag(s, source.Name))
+	}
+
+	return stream.Merge(streams...), nil
+}
+
+func newSourceStream(cfg SourceConfig, l *zap.Logger, deadLetters dlq.Sink, db *postgres.DB) (stream.Stream, error) {
+	switch cfg.Stream {
+	case "", "kafka":
+		return kafka.NewStream(cfg.Kafka, l, deadLetters, db)
+	case "file":
+		return file.NewStream(cfg.FileStream, l, deadLetters)
+	case "http":
+		return httpstream.NewStream(cfg.HTTPStream, l)
+	case "redis":
+		return redisstream.NewStream(cfg.RedisStream, l, deadLetters)
+	default:
+		return nil, fmt.Errorf(`invalid stream %q, must be in ("kafka", "file", "http" or "redis")`, cfg.Stream)
+	}
+}
+
+// ReplayDeadLetters pushes parked messages back to the topics they were read from.
+func ReplayDeadLetters(ctx context.Context, cfg Config) error {
+	l, err := buildLogger(cfg.App.LogLevel, cfg.App.Output)
+	if err != nil {
+		return fmt.Errorf("could not init logging: %w", err)
+	}
+
+	if cfg.DLQ.Topic == "" {
+		return fmt.Errorf("no dead letter topic configured")
+	}
+
+	replayed, err := dlqkafka.Replay(ctx, cfg.DLQ, l)
+
+	l.Info("replayed parked messages", zap.Int("replayed", replayed))
+
+	if err != nil {
+		return fmt.Errorf("could not replay parked messages: %w", err)
+	}
+	return nil
+}
+
+// reprocessBatchSize is how many stored payloads are reprocessed at once.
+const reprocessBatchSize = 1000
+
+// Reprocess re-derives stored rsvps and counters from their raw payloads, i.e.
+// after the decoder was changed. The service has to be stopped meanwhile.
+func Reprocess(ctx context.Context, cfg Config) error {
+	l, err := buildLogger(cfg.App.LogLevel, cfg.App.Output)
+	if err != nil {
+		return fmt.Errorf("could not init logging: %w", err)
+	}
+
+	db, err := postgres.NewDB(cfg.Postgres, l)
+	if err != nil {
+		return fmt.Errorf("could not create db: %w", err)
+	}
+	defer db.Close()
+
+	// rsvps are passed through the same processors as when they were consumed, so
+	// that their attrs are derived again
+	chain, err := rsvphandler.NewChain(cfg.RSVPHandler.Processors)
+	if err != nil {
+		return fmt.Errorf("could not create rsvp processors: %w", err)
+	}
+
+	result, err := db.Reprocess(ctx, reprocessBatchSize, payloadDecoder(cfg), func(ctx context.Context, rsvp *rsvps.RSVP) (bool, error) {
+		verdict, _, err := chain.Process(ctx, rsvp)
+		return verdict == rsvphandler.Pass, err
+	})
+	if err != nil {
+		return fmt.Errorf("could not reprocess rsvps: %w", err)
+	}
+
+	for reason, rejected := range result.Rejected {
+		l.Info("rejected stored payloads", zap.String("reason", reason), zap.Int("rejected", rejected))
+	}
+	l.Info("reprocessed stored payloads", zap.Int("reprocessed", result.Reprocessed), zap.Int("dropped", result.Dropped), zap.Int("expired", result.Expired))
+
+	return nil
+}
+
+// payloadDecoder decodes stored payloads with the codecs they were received with,
+// Avro schemas are fetched from the schema registry of the first source which
+// has one.
+func payloadDecoder(cfg Config) postgres.DecodeFunc {
+	var registry *avro.Registry
+	for _, source := range sources(cfg) {
+		if source.Kafka.SchemaRegistry.URL != "" {
+			registry = avro.NewRegistry(source.Kafka.SchemaRegistry)
+			break
+		}
+	}
+
+	codecs := make(map[string]*codec.Codec)
+
+	return func(ctx context.Context, name string, payload []byte) (rsvps.RSVP, error) {
+		c, ok := codecs[name]
+		if !ok {
+			var err error
+			if c, err = codec.New(name, registry); err != nil {
+				return rsvps.RSVP{}, err
+			}
+			codecs[name] = c
+		}
+		return c.Decode(ctx, payload)
+	}
+}
+
 func buildLogger(level, output string) (*zap.Logger, error) {
 	if level != "debug" && level != "info" && level != "error" {
 		return nil, fmt.Errorf(`invalid log-level %q, must be in ("debug", "info" or "error")`, level)
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/db/postgres"
+)
+
+// PartitionsConfig configures maintenance of the monthly partitions of rsvps and
+// event counters, which is disabled if the interval isn't set (partitions are
+// still created on demand then, but never removed).
+type PartitionsConfig struct {
+	Interval configtypes.Duration `toml:"interval"`
+
+	// MonthsAhead is how many months after the current one get partitions in advance.
+	MonthsAhead int `toml:"months_ahead"`
+
+	// RetentionMonths is how many months, the current one included, are kept, 0
+	// keeps all months. Partitions of older months are detached, so that they can be
+	// archived and dropped by hand, or dropped right away if DropExpired is set.
+	RetentionMonths int  `toml:"retention_months"`
+	DropExpired     bool `toml:"drop_expired"`
+}
+
+// partitioner maintains partitions every interval, starting right away.
+type partitioner struct {
+	l      *zap.Logger
+	db     *postgres.DB
+	policy postgres.PartitionPolicy
+
+	cancel func()
+	done   chan struct{}
+}
+
+func newPartitioner(cfg PartitionsConfig, l *zap.Logger, db *postgres.DB) (*partitioner, error) {
+	if cfg.MonthsAhead < 0 {
+		return nil, fmt.Errorf("invalid months ahead %v, must not be negative", cfg.MonthsAhead)
+	}
+	if cfg.RetentionMonths < 0 {
+		return nil, fmt.Errorf("invalid retention months %v, must not be negative", cfg.RetentionMonths)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &partitioner{
+		l:  l.With(zap.String("component", "partitioner")),
+		db: db,
+		policy: postgres.PartitionPolicy{
+			Ahead:     cfg.MonthsAhead,
+			Retention: cfg.RetentionMonths,
+			Drop:      cfg.DropExpired,
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go p.run(ctx, cfg.Interval.Duration)
+
+	return p, nil
+}
+
+func (p *partitioner) run(ctx context.Context, interval time.Duration) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.maintain(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *partitioner) maintain(ctx context.Context) {
+	stats, err := p.db.MaintainPartitions(ctx, time.Now(), p.policy)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.l.Error("could not maintain partitions", zap.Error(err))
+			pgPartitionMaintenanceErrors.Inc()
+		}
+		return
+	}
+
+	for _, stat := range stats {
+		pgPartitions(stat.Table).Set(uint64(stat.Partitions))
+		if !stat.Oldest.IsZero() {
+			pgPartitionsOldest(stat.Table).Set(uint64(stat.Oldest.Unix()))
+		}
+		pgPartitionsCreated(stat.Table).Add(stat.Created)
+		pgPartitionsRemoved(stat.Table).Add(stat.Removed)
+
+		if stat.Created > 0 || stat.Removed > 0 {
+			p.l.Info("maintained partitions",
+				zap.String("table", stat.Table),
+				zap.Int("created", stat.Created),
+				zap.Int("removed", stat.Removed),
+				zap.Int("partitions", stat.Partitions),
+				zap.Time("oldest", stat.Oldest),
+			)
+		}
+	}
+}
+
+func (p *partitioner) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+var pgPartitionMaintenanceErrors = metrics.NewCounter("pg_partition_maintenance_errors_total")
+
+// pgPartitions is used as a gauge of attached partitions of the table.
+func pgPartitions(table string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_partitions{table=%q}`, table))
+}
+
+// pgPartitionsOldest is used as a gauge of the first retained date of the table,
+// the first day of the month of its oldest partition.
+func pgPartitionsOldest(table string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_partitions_oldest_timestamp_seconds{table=%q}`, table))
+}
+
+func pgPartitionsCreated(table string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_partitions_created_total{table=%q}`, table))
+}
+
+// pgPartitionsRemoved counts partitions detached or dropped past the retention.
+func pgPartitionsRemoved(table string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_partitions_removed_total{table=%q}`, table))
+}
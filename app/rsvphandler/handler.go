@@ -2,20 +2,55 @@ package rsvphandler
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"go.uber.org/zap"
 
 	configtypes "github.com/oizgagin/ing/pkg/config/types"
 	"github.com/oizgagin/ing/pkg/db"
-	"github.com/oizgagin/ing/pkg/rsvps"
 	"github.com/oizgagin/ing/pkg/stream"
 )
 
+const (
+	// PartitionByEventID processes rsvps of an event serially, so that concurrent
+	// transactions don't contend for its counters.
+	PartitionByEventID = "event_id"
+
+	// PartitionByRSVPID processes versions of an rsvp serially.
+	PartitionByRSVPID = "rsvp_id"
+)
+
 type Config struct {
 	Workers     int                  `toml:"workers"`
 	SaveTimeout configtypes.Duration `toml:"save_timeout"`
+
+	// Messages are routed to workers by the PartitionBy key (within their source),
+	// so messages with the same key are processed serially in the order they were
+	// received. Every worker queues up to QueueSize messages.
+	PartitionBy string `toml:"partition_by"`
+	QueueSize   int    `toml:"queue_size"`
+
+	// If BatchSize is greater than 1, every worker buffers up to BatchSize rsvps, but
+	// no longer than BatchMaxLatency, and saves them in a single transaction.
+	BatchSize       int                  `toml:"batch_size"`
+	BatchMaxLatency configtypes.Duration `toml:"batch_max_latency"`
+
+	// Transient save errors are retried in place, so that the order of rsvps is
+	// kept. Rsvps which failed permanently or ran out of attempts are nacked with
+	// stream.ErrPark and get parked to the dead letter sink of their stream.
+	Retry RetryConfig `toml:"retry"`
+
+	Pause PauseConfig `toml:"pause"`
+
+	// Processors are the stages of the chain every rsvp passes through before it is
+	// saved, in order.
+	Processors []ProcessorConfig `toml:"processors"`
 }
 
 type Handler struct {
@@ -27,30 +62,86 @@ type Handler struct {
 	stream stream.Stream
 	db     db.DB
 
-	saveTimeout time.Duration
+	partitionBy string
+	queues      []chan stream.Message
+
+	saveTimeout     time.Duration
+	batchSize       int
+	batchMaxLatency time.Duration
+	retryPolicy     RetryConfig
+	pauser          *pauser
+	chain           *Chain
 }
 
-func NewHandler(cfg Config, l *zap.Logger, stream stream.Stream, db db.DB) *Handler {
+func NewHandler(cfg Config, l *zap.Logger, s stream.Stream, db db.DB) (*Handler, error) {
+	if cfg.Workers <= 0 {
+		return nil, fmt.Errorf("invalid workers %v, must be positive", cfg.Workers)
+	}
+
+	partitionBy := cfg.PartitionBy
+	switch partitionBy {
+	case "":
+		partitionBy = PartitionByEventID
+	case PartitionByEventID, PartitionByRSVPID:
+	default:
+		return nil, fmt.Errorf("invalid partition by %q, must be in (%q or %q)", cfg.PartitionBy, PartitionByEventID, PartitionByRSVPID)
+	}
+
+	if err := cfg.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Pause.validate(); err != nil {
+		return nil, err
+	}
+
+	chain, err := NewChain(cfg.Processors)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
 	wg := &sync.WaitGroup{}
 
 	handler := &Handler{
-		l:           l,
-		ctxCancel:   cancel,
-		wg:          wg,
-		stream:      stream,
-		db:          db,
-		saveTimeout: cfg.SaveTimeout.Duration,
+		l:               l,
+		ctxCancel:       cancel,
+		wg:              wg,
+		stream:          s,
+		db:              db,
+		partitionBy:     partitionBy,
+		queues:          make([]chan stream.Message, cfg.Workers),
+		saveTimeout:     cfg.SaveTimeout.Duration,
+		batchSize:       cfg.BatchSize,
+		batchMaxLatency: cfg.BatchMaxLatency.Duration,
+		retryPolicy:     cfg.Retry,
+		pauser:          newPauser(l, cfg.Pause.FailureThreshold, ctx.Done(), s),
+		chain:           chain,
+	}
+
+	loop := handler.loop
+	if cfg.BatchSize > 1 {
+		loop = handler.batchLoop
+	}
+
+	wg.Add(cfg.Workers + 1)
+	for i := range handler.queues {
+		handler.queues[i] = make(chan stream.Message, cfg.QueueSize)
+		go loop(ctx, handler.queues[i], rsvpHandlerQueueDepth(i))
 	}
+	go handler.dispatch(ctx)
 
-	wg.Add(cfg.Workers)
-	for i := 0; i < cfg.Workers; i++ {
-		go handler.loop(ctx)
+	if cfg.Pause.FailureThreshold > 0 {
+		checkTimeout := cfg.Pause.CheckTimeout.Duration
+		if checkTimeout <= 0 {
+			checkTimeout = cfg.Pause.CheckInterval.Duration
+		}
+
+		wg.Add(1)
+		go handler.checkHealth(ctx, cfg.Pause.CheckInterval.Duration, checkTimeout)
 	}
 
-	return handler
+	return handler, nil
 }
 
 func (h *Handler) Stop() {
@@ -58,14 +149,66 @@ func (h *Handler) Stop() {
 	h.wg.Wait()
 }
 
-func (h *Handler) loop(ctx context.Context) {
+// dispatch routes messages to the worker queues by their keys, it doesn't read
+// the stream while consumption is paused. Messages which are still queued when
+// the handler is stopped are neither acked nor nacked, so they are redelivered
+// by the stream later.
+func (h *Handler) dispatch(ctx context.Context) {
+	defer h.wg.Done()
+
+	for {
+		if !h.pauser.wait(ctx) {
+			return
+		}
+
+		select {
+		case msg, ok := <-h.stream.RSVPS():
+			if !ok {
+				return
+			}
+
+			worker := h.worker(msg)
+
+			depth := rsvpHandlerQueueDepth(worker)
+			depth.Inc()
+
+			select {
+			case h.queues[worker] <- msg:
+			case <-ctx.Done():
+				depth.Dec()
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Handler) worker(msg stream.Message) int {
+	key := msg.RSVP.Event.ID
+	if h.partitionBy == PartitionByRSVPID {
+		key = strconv.FormatInt(msg.RSVP.ID, 10)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(msg.RSVP.Source))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+
+	return int(hash.Sum32() % uint32(len(h.queues)))
+}
+
+func (h *Handler) loop(ctx context.Context, queue <-chan stream.Message, depth *metrics.Counter) {
 	defer h.wg.Done()
 
 	for {
 		select {
-		case rsvp := <-h.stream.RSVPS():
-			if err := h.saveRsvp(ctx, rsvp); err != nil {
-				h.l.Error("rsvp save error", zap.Int64("rsvp_id", rsvp.ID), zap.Error(err))
+		case msg := <-queue:
+			depth.Dec()
+
+			if h.process(ctx, &msg) {
+				h.handle(ctx, msg)
 			}
 
 		case <-ctx.Done():
@@ -74,9 +217,185 @@ func (h *Handler) loop(ctx context.Context) {
 	}
 }
 
-func (h *Handler) saveRsvp(ctx context.Context, rsvp rsvps.RSVP) error {
+// process passes the rsvp of the message through the processor chain, it returns
+// false if the chain short-circuited it, in which case the message is already
+// acked or nacked.
+func (h *Handler) process(ctx context.Context, msg *stream.Message) bool {
+	verdict, stage, err := h.chain.Process(ctx, &msg.RSVP)
+	if err != nil {
+		h.l.Error("rsvp processing error", zap.Int64("rsvp_id", msg.RSVP.ID), zap.Error(err))
+		msg.Nack(err)
+		return false
+	}
+
+	switch verdict {
+	case Drop:
+		msg.Ack()
+		return false
+	case Park:
+		rsvpHandlerParkedRSVPs("processor").Inc()
+		msg.Nack(fmt.Errorf("%w: by processor %q", stream.ErrPark, stage))
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) handle(ctx context.Context, msg stream.Message) {
+	attempts, err := h.retry(ctx, func(ctx context.Context) error {
+		return h.saveRsvp(ctx, record(msg))
+	})
+	if errors.Is(err, db.ErrStaleOffset) {
+		h.skip(msg, err)
+		return
+	}
+	if err != nil {
+		h.l.Error("rsvp save error", zap.Int64("rsvp_id", msg.RSVP.ID), zap.Int("attempts", attempts), zap.Error(err))
+		h.fail(ctx, []stream.Message{msg}, err)
+		return
+	}
+	msg.Ack()
+}
+
+// skip acks the message which was already saved by another consumer of the group,
+// i.e. the one its partition was reassigned to.
+func (h *Handler) skip(msg stream.Message, err error) {
+	rsvpHandlerStaleRSVPs.Inc()
+	h.l.Info("rsvp already saved by another consumer", zap.Int64("rsvp_id", msg.RSVP.ID), zap.Error(err))
+	msg.Ack()
+}
+
+func (h *Handler) saveRsvp(ctx context.Context, record db.Record) error {
 	saveCtx, saveCancel := context.WithTimeout(ctx, h.saveTimeout)
 	defer saveCancel()
 
-	return h.db.SaveRSVP(saveCtx, rsvp)
+	return h.db.SaveRSVP(saveCtx, record)
+}
+
+// fail nacks messages which couldn't be saved. Permanent failures and failures
+// which ran out of retries are parked, unless the handler is being stopped.
+func (h *Handler) fail(ctx context.Context, msgs []stream.Message, err error) {
+	reason := "permanent"
+	switch {
+	case errors.Is(err, db.ErrPermanent):
+	case h.retryPolicy.MaxAttempts > 0 && ctx.Err() == nil && !errors.Is(err, errStopped):
+		reason = "retries_exhausted"
+	default:
+		for _, msg := range msgs {
+			msg.Nack(err)
+		}
+		return
+	}
+
+	rsvpHandlerParkedRSVPs(reason).Add(len(msgs))
+
+	err = fmt.Errorf("%w: %w", stream.ErrPark, err)
+	for _, msg := range msgs {
+		msg.Nack(err)
+	}
+}
+
+func record(msg stream.Message) db.Record {
+	return db.Record{RSVP: msg.RSVP, Raw: msg.Raw, Codec: msg.Codec, Origin: msg.Origin}
+}
+
+func (h *Handler) batchLoop(ctx context.Context, queue <-chan stream.Message, depth *metrics.Counter) {
+	defer h.wg.Done()
+
+	var (
+		batch = make([]stream.Message, 0, h.batchSize)
+
+		timer   = time.NewTimer(h.batchMaxLatency)
+		timerCh <-chan time.Time
+	)
+	timer.Stop()
+
+	flush := func(ctx context.Context) {
+		timer.Stop()
+		timerCh = nil
+
+		h.saveBatch(ctx, batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case msg := <-queue:
+			depth.Dec()
+
+			if !h.process(ctx, &msg) {
+				continue
+			}
+
+			batch = append(batch, msg)
+
+			if len(batch) == 1 {
+				timer.Reset(h.batchMaxLatency)
+				timerCh = timer.C
+			}
+
+			if len(batch) >= h.batchSize {
+				flush(ctx)
+			}
+
+		case <-timerCh:
+			flush(ctx)
+
+		case <-ctx.Done():
+			// the stream is closed only after the handler is stopped, so buffered
+			// rsvps are still worth saving
+			if len(batch) > 0 {
+				flush(context.Background())
+			}
+			return
+		}
+	}
+}
+
+func (h *Handler) saveBatch(ctx context.Context, batch []stream.Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	records := make([]db.Record, 0, len(batch))
+	for _, msg := range batch {
+		records = append(records, record(msg))
+	}
+
+	start := time.Now()
+	attempts, err := h.retry(ctx, func(ctx context.Context) error {
+		saveCtx, saveCancel := context.WithTimeout(ctx, h.saveTimeout)
+		defer saveCancel()
+
+		return h.db.SaveRSVPs(saveCtx, records)
+	})
+
+	rsvpHandlerBatchSize.Update(float64(len(batch)))
+	rsvpHandlerFlushDuration.UpdateDuration(start)
+
+	if err != nil {
+		rsvpHandlerFlushErrors.Inc()
+		h.l.Error("rsvp batch save error", zap.Int("batch_size", len(batch)), zap.Int("attempts", attempts), zap.Error(err))
+
+		// a single bad or already saved rsvp fails the whole batch, so rsvps are
+		// saved one by one to park or skip only those
+		if (errors.Is(err, db.ErrPermanent) || errors.Is(err, db.ErrStaleOffset)) && len(batch) > 1 {
+			for _, msg := range batch {
+				h.handle(ctx, msg)
+			}
+			return
+		}
+
+		if errors.Is(err, db.ErrStaleOffset) {
+			h.skip(batch[0], err)
+			return
+		}
+
+		h.fail(ctx, batch, err)
+		return
+	}
+
+	for _, msg := range batch {
+		msg.Ack()
+	}
 }
@@ -0,0 +1,350 @@
+package rsvphandler_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/oizgagin/ing/app/rsvphandler"
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	"github.com/oizgagin/ing/pkg/stream"
+)
+
+type fakeStream struct{ ch chan stream.Message }
+
+func (s *fakeStream) RSVPS() <-chan stream.Message { return s.ch }
+func (s *fakeStream) Close() error                 { return nil }
+
+// pausableStream records whether it's paused.
+type pausableStream struct {
+	fakeStream
+	paused int32 // atomic
+}
+
+func (s *pausableStream) Pause()  { atomic.StoreInt32(&s.paused, 1) }
+func (s *pausableStream) Resume() { atomic.StoreInt32(&s.paused, 0) }
+
+// fakeDB records saved rsvp ids by event, saving takes longer for earlier rsvps so
+// that reordering would show up if messages of an event were processed concurrently.
+type fakeDB struct {
+	db.DB
+
+	mu    sync.Mutex
+	saved map[string][]int64
+}
+
+func (d *fakeDB) SaveRSVP(ctx context.Context, record db.Record) error {
+	time.Sleep(time.Duration(10-record.RSVP.ID%10) * time.Millisecond)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.saved[record.RSVP.Event.ID] = append(d.saved[record.RSVP.Event.ID], record.RSVP.ID)
+	return nil
+}
+
+func TestHandler_PartitionByEventID(t *testing.T) {
+	var (
+		s        = &fakeStream{ch: make(chan stream.Message)}
+		fakeDB   = &fakeDB{saved: make(map[string][]int64)}
+		acked    sync.WaitGroup
+		events   = 3
+		perEvent = 10
+	)
+
+	handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers:     4,
+		SaveTimeout: configtypes.Duration{Duration: time.Second},
+		QueueSize:   10,
+	}, zaptest.NewLogger(t), s, fakeDB)
+	require.NoError(t, err)
+	defer handler.Stop()
+
+	expected := make(map[string][]int64)
+
+	for i := 0; i < perEvent; i++ {
+		for e := 0; e < events; e++ {
+			rsvp := rsvps.RSVP{ID: int64(e*100 + i), Event: rsvps.Event{ID: fmt.Sprintf("event_id%d", e)}}
+			expected[rsvp.Event.ID] = append(expected[rsvp.Event.ID], rsvp.ID)
+
+			acked.Add(1)
+			s.ch <- stream.NewMessage(rsvp, nil, rsvps.Origin{}, acked.Done, func(error) { t.Error("unexpected nack") })
+		}
+	}
+
+	acked.Wait()
+
+	require.Equal(t, expected, fakeDB.saved)
+}
+
+func TestNewHandler_InvalidPartitionBy(t *testing.T) {
+	_, err := rsvphandler.NewHandler(rsvphandler.Config{Workers: 1, PartitionBy: "group_id"}, zaptest.NewLogger(t), &fakeStream{}, &fakeDB{})
+	require.Error(t, err)
+}
+
+// funcDB saves rsvps with the given funcs and counts save attempts.
+type funcDB struct {
+	db.DB
+
+	saveRSVP  func(record db.Record) error
+	saveRSVPs func(records []db.Record) error
+	ping      func() error
+
+	attempts int64 // atomic
+}
+
+func (d *funcDB) Ping(ctx context.Context) error {
+	return d.ping()
+}
+
+func (d *funcDB) SaveRSVP(ctx context.Context, record db.Record) error {
+	atomic.AddInt64(&d.attempts, 1)
+	return d.saveRSVP(record)
+}
+
+func (d *funcDB) SaveRSVPs(ctx context.Context, records []db.Record) error {
+	atomic.AddInt64(&d.attempts, 1)
+	return d.saveRSVPs(records)
+}
+
+type result struct {
+	id  int64
+	err error // nil if acked
+}
+
+func send(s *fakeStream, results chan<- result, ids ...int64) {
+	for _, id := range ids {
+		id := id
+		s.ch <- stream.NewMessage(
+			rsvps.RSVP{ID: id, Event: rsvps.Event{ID: "event_id"}}, nil, rsvps.Origin{},
+			func() { results <- result{id: id} },
+			func(err error) { results <- result{id: id, err: err} },
+		)
+	}
+}
+
+var retryPolicy = rsvphandler.RetryConfig{
+	MaxAttempts: 3,
+	MinBackoff:  configtypes.Duration{Duration: time.Millisecond},
+	MaxBackoff:  configtypes.Duration{Duration: 5 * time.Millisecond},
+	Jitter:      0.5,
+}
+
+func TestHandler_Retry(t *testing.T) {
+	var (
+		transientErr = errors.New("conn closed")
+		permanentErr = fmt.Errorf("%w: unique violation", db.ErrPermanent)
+		staleErr     = fmt.Errorf("%w: partition 1 of topic1 at 10", db.ErrStaleOffset)
+	)
+
+	testCases := []struct {
+		name     string
+		errs     []error
+		attempts int64
+		parked   bool
+		acked    bool
+	}{
+		{name: "transient then saved", errs: []error{transientErr, transientErr}, attempts: 3, acked: true},
+		{name: "retries exhausted", errs: []error{transientErr, transientErr, transientErr}, attempts: 3, parked: true},
+		{name: "permanent", errs: []error{permanentErr}, attempts: 1, parked: true},
+		{name: "stale offset", errs: []error{staleErr}, attempts: 1, acked: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				s       = &fakeStream{ch: make(chan stream.Message)}
+				results = make(chan result, 1)
+				errs    = tc.errs
+			)
+
+			funcDB := &funcDB{saveRSVP: func(db.Record) error {
+				if len(errs) == 0 {
+					return nil
+				}
+				err := errs[0]
+				errs = errs[1:]
+				return err
+			}}
+
+			handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+				Workers:     1,
+				SaveTimeout: configtypes.Duration{Duration: time.Second},
+				Retry:       retryPolicy,
+			}, zaptest.NewLogger(t), s, funcDB)
+			require.NoError(t, err)
+			defer handler.Stop()
+
+			send(s, results, 1)
+
+			res := <-results
+			require.Equal(t, tc.acked, res.err == nil)
+			require.Equal(t, tc.parked, errors.Is(res.err, stream.ErrPark))
+			require.Equal(t, tc.attempts, atomic.LoadInt64(&funcDB.attempts))
+		})
+	}
+}
+
+func TestHandler_RetryDisabled(t *testing.T) {
+	var (
+		s       = &fakeStream{ch: make(chan stream.Message)}
+		results = make(chan result, 1)
+		funcDB  = &funcDB{saveRSVP: func(db.Record) error { return errors.New("conn closed") }}
+	)
+
+	handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers:     1,
+		SaveTimeout: configtypes.Duration{Duration: time.Second},
+	}, zaptest.NewLogger(t), s, funcDB)
+	require.NoError(t, err)
+	defer handler.Stop()
+
+	send(s, results, 1)
+
+	// transient errors are left to the stream to redeliver
+	res := <-results
+	require.Error(t, res.err)
+	require.False(t, errors.Is(res.err, stream.ErrPark))
+	require.Equal(t, int64(1), atomic.LoadInt64(&funcDB.attempts))
+}
+
+func TestHandler_BatchPermanent(t *testing.T) {
+	var (
+		s       = &fakeStream{ch: make(chan stream.Message)}
+		results = make(chan result, 3)
+		badErr  = fmt.Errorf("%w: check violation", db.ErrPermanent)
+	)
+
+	funcDB := &funcDB{
+		saveRSVPs: func([]db.Record) error { return badErr },
+		saveRSVP: func(record db.Record) error {
+			if record.RSVP.ID == 2 {
+				return badErr
+			}
+			return nil
+		},
+	}
+
+	handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers:         1,
+		SaveTimeout:     configtypes.Duration{Duration: time.Second},
+		BatchSize:       3,
+		BatchMaxLatency: configtypes.Duration{Duration: time.Minute},
+		Retry:           retryPolicy,
+	}, zaptest.NewLogger(t), s, funcDB)
+	require.NoError(t, err)
+	defer handler.Stop()
+
+	send(s, results, 1, 2, 3)
+
+	// only the bad rsvp is parked after the batch is saved one by one
+	for i := 0; i < 3; i++ {
+		res := <-results
+		if res.id == 2 {
+			require.True(t, errors.Is(res.err, stream.ErrPark))
+		} else {
+			require.NoError(t, res.err)
+		}
+	}
+	require.Equal(t, int64(4), atomic.LoadInt64(&funcDB.attempts))
+}
+
+func TestNewHandler_InvalidRetry(t *testing.T) {
+	for _, retry := range []rsvphandler.RetryConfig{
+		{MaxAttempts: -1},
+		{MaxAttempts: 3, Jitter: 1.5},
+		{MaxAttempts: 3, MinBackoff: configtypes.Duration{Duration: time.Second}},
+	} {
+		_, err := rsvphandler.NewHandler(rsvphandler.Config{Workers: 1, Retry: retry}, zaptest.NewLogger(t), &fakeStream{}, &fakeDB{})
+		require.Error(t, err)
+	}
+}
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	cfg := rsvphandler.RetryConfig{
+		MinBackoff: configtypes.Duration{Duration: 100 * time.Millisecond},
+		MaxBackoff: configtypes.Duration{Duration: time.Second},
+	}
+
+	require.Equal(t, 100*time.Millisecond, cfg.Backoff(1))
+	require.Equal(t, 200*time.Millisecond, cfg.Backoff(2))
+	require.Equal(t, 800*time.Millisecond, cfg.Backoff(4))
+	require.Equal(t, time.Second, cfg.Backoff(5))
+	require.Equal(t, time.Second, cfg.Backoff(100))
+
+	cfg.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := cfg.Backoff(2)
+		require.True(t, d > 100*time.Millisecond && d <= 200*time.Millisecond, d)
+	}
+}
+
+func TestHandler_Pause(t *testing.T) {
+	var (
+		s       = &pausableStream{fakeStream: fakeStream{ch: make(chan stream.Message)}}
+		results = make(chan result, 3)
+		healthy int32 // atomic
+	)
+
+	funcDB := &funcDB{
+		saveRSVP: func(db.Record) error {
+			if atomic.LoadInt32(&healthy) == 0 {
+				return errors.New("conn refused")
+			}
+			return nil
+		},
+		ping: func() error {
+			if atomic.LoadInt32(&healthy) == 0 {
+				return errors.New("conn refused")
+			}
+			return nil
+		},
+	}
+
+	handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers:     1,
+		SaveTimeout: configtypes.Duration{Duration: time.Second},
+		Pause: rsvphandler.PauseConfig{
+			FailureThreshold: 2,
+			CheckInterval:    configtypes.Duration{Duration: 10 * time.Millisecond},
+		},
+	}, zaptest.NewLogger(t), s, funcDB)
+	require.NoError(t, err)
+	defer handler.Stop()
+
+	send(&s.fakeStream, results, 1, 2)
+	require.Error(t, (<-results).err)
+	require.Error(t, (<-results).err)
+
+	go send(&s.fakeStream, results, 3)
+
+	// nothing is saved while consumption is paused, and the stream is paused too
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int64(2), atomic.LoadInt64(&funcDB.attempts))
+	require.Equal(t, int32(1), atomic.LoadInt32(&s.paused))
+
+	atomic.StoreInt32(&healthy, 1)
+
+	res := <-results
+	require.Equal(t, int64(3), res.id)
+	require.NoError(t, res.err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&s.paused))
+}
+
+func TestNewHandler_InvalidPause(t *testing.T) {
+	_, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers: 1,
+		Pause:   rsvphandler.PauseConfig{FailureThreshold: 3},
+	}, zaptest.NewLogger(t), &fakeStream{}, &fakeDB{})
+	require.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package rsvphandler
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	rsvpHandlerBatchSize     = metrics.NewHistogram("rsvp_handler_batch_size")
+	rsvpHandlerFlushDuration = metrics.NewHistogram("rsvp_handler_flush_duration_seconds")
+	rsvpHandlerFlushErrors   = metrics.NewCounter("rsvp_handler_flush_errors_total")
+	rsvpHandlerRetries       = metrics.NewCounter("rsvp_handler_save_retries_total")
+	rsvpHandlerStaleRSVPs    = metrics.NewCounter("rsvp_handler_stale_rsvps_total")
+
+	// rsvpHandlerPaused is used as a gauge, it is 1 while consumption is paused.
+	rsvpHandlerPaused        = metrics.NewCounter("rsvp_handler_paused")
+	rsvpHandlerPausedSeconds = metrics.NewFloatCounter("rsvp_handler_paused_seconds_total")
+)
+
+// rsvpHandlerQueueDepth is used as a gauge of messages queued for the worker.
+func rsvpHandlerQueueDepth(worker int) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`rsvp_handler_queue_depth{worker="%d"}`, worker))
+}
+
+func rsvpHandlerParkedRSVPs(reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`rsvp_handler_parked_rsvps_total{reason="%s"}`, reason))
+}
+
+func rsvpProcessorRSVPs(stage string, verdict Verdict) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`rsvp_processor_rsvps_total{stage="%s",verdict="%s"}`, stage, verdict))
+}
+
+func rsvpProcessorErrors(stage string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`rsvp_processor_errors_total{stage="%s"}`, stage))
+}
+
+func rsvpProcessorDuration(stage string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`rsvp_processor_duration_seconds{stage="%s"}`, stage))
+}
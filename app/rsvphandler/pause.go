@@ -0,0 +1,182 @@
+package rsvphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/stream"
+)
+
+// PauseConfig configures backpressure: the handler stops reading the stream while
+// the database is unhealthy instead of pulling rsvps only to fail them. Streams
+// keep their sessions (i.e. kafka consumer group heartbeats) alive while paused,
+// but don't redeliver messages on their own (i.e. redis pending entries aren't
+// reclaimed).
+type PauseConfig struct {
+	// Consumption is paused after FailureThreshold consecutive transient save errors
+	// or failed health checks. If it is 0, consumption is never paused.
+	FailureThreshold int `toml:"failure_threshold"`
+
+	// The database is pinged every CheckInterval, consumption is resumed after the
+	// first successful ping (or save).
+	CheckInterval configtypes.Duration `toml:"check_interval"`
+	CheckTimeout  configtypes.Duration `toml:"check_timeout"`
+}
+
+func (cfg PauseConfig) validate() error {
+	if cfg.FailureThreshold < 0 {
+		return fmt.Errorf("invalid pause failure threshold %v, must not be negative", cfg.FailureThreshold)
+	}
+	if cfg.FailureThreshold > 0 && cfg.CheckInterval.Duration <= 0 {
+		return fmt.Errorf("invalid pause check interval %v, must be positive", cfg.CheckInterval)
+	}
+	return nil
+}
+
+// errStopped is returned by saves which were waiting for consumption to resume
+// when the handler was stopped.
+var errStopped = errors.New("rsvp handler is stopped")
+
+type pauser struct {
+	l         *zap.Logger
+	threshold int
+	stopped   <-chan struct{}
+	stream    stream.Stream
+
+	mu            sync.Mutex
+	saveFailures  int
+	checkFailures int
+	resumed       chan struct{} // not nil while paused
+	pausedAt      time.Time
+	accountedAt   time.Time
+}
+
+func newPauser(l *zap.Logger, threshold int, stopped <-chan struct{}, s stream.Stream) *pauser {
+	return &pauser{l: l, threshold: threshold, stopped: stopped, stream: s}
+}
+
+// wait blocks while consumption is paused, it returns false if the handler was
+// stopped or ctx is done in the meantime.
+func (p *pauser) wait(ctx context.Context) bool {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-p.stopped:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *pauser) saveResult(err error) {
+	p.result(&p.saveFailures, err)
+}
+
+func (p *pauser) checkResult(err error) {
+	p.result(&p.checkFailures, err)
+}
+
+func (p *pauser) result(failures *int, err error) {
+	if p.threshold == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		*failures = 0
+		if p.resumed != nil {
+			p.resume()
+		}
+		return
+	}
+
+	*failures++
+	if *failures >= p.threshold && p.resumed == nil {
+		p.pause(err)
+	}
+}
+
+func (p *pauser) pause(err error) {
+	p.resumed = make(chan struct{})
+	p.pausedAt = time.Now()
+	p.accountedAt = p.pausedAt
+
+	stream.Pause(p.stream)
+
+	rsvpHandlerPaused.Inc()
+	p.l.Warn("rsvp consumption paused", zap.Error(err))
+}
+
+func (p *pauser) resume() {
+	p.account()
+
+	close(p.resumed)
+	p.resumed = nil
+	p.saveFailures, p.checkFailures = 0, 0
+
+	stream.Resume(p.stream)
+
+	rsvpHandlerPaused.Dec()
+	p.l.Info("rsvp consumption resumed", zap.Duration("paused", time.Since(p.pausedAt)))
+}
+
+// account adds the time paused since it was accounted last to the metric, so that
+// it grows during long pauses too.
+func (p *pauser) account() {
+	if p.resumed == nil {
+		return
+	}
+
+	now := time.Now()
+	rsvpHandlerPausedSeconds.Add(now.Sub(p.accountedAt).Seconds())
+	p.accountedAt = now
+}
+
+// checkHealth pings the database every interval and reports the results.
+func (h *Handler) checkHealth(ctx context.Context, interval, timeout time.Duration) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pingCtx, pingCancel := context.WithTimeout(ctx, timeout)
+			err := h.db.Ping(pingCtx)
+			pingCancel()
+
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				h.l.Error("database health check failed", zap.Error(err))
+			}
+
+			h.pauser.checkResult(err)
+
+			h.pauser.mu.Lock()
+			h.pauser.account()
+			h.pauser.mu.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
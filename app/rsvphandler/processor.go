@@ -0,0 +1,142 @@
+package rsvphandler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// Verdict tells what is done with an RSVP after a processor stage.
+type Verdict int
+
+const (
+	// Pass hands the RSVP over to the next stage, or saves it after the last one.
+	Pass Verdict = iota
+
+	// Drop acks the RSVP without saving it.
+	Drop
+
+	// Park routes the RSVP to the dead letter sink of its stream.
+	Park
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Pass:
+		return "pass"
+	case Drop:
+		return "drop"
+	case Park:
+		return "park"
+	}
+	return fmt.Sprintf("verdict(%d)", int(v))
+}
+
+// Processor is a stage of the chain RSVPs pass through before they are saved. It
+// may modify the RSVP (i.e. normalize fields or set Attrs) and short-circuit the
+// chain with a verdict other than Pass. RSVPs are nacked on errors, so that the
+// stream redelivers them.
+type Processor interface {
+	Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, error)
+}
+
+// ProcessorConfig configures a stage of the chain, which settings are used depends
+// on the processor type.
+type ProcessorConfig struct {
+	// Type is the type of a built-in (see processors.go) or registered processor.
+	Type string `toml:"type"`
+
+	// Name identifies the stage in metrics and logs, it defaults to the type.
+	Name string `toml:"name"`
+
+	// Action is the verdict on matching RSVPs: "drop", "park" or (for tag_spam
+	// only) "tag", which passes them on tagged.
+	Action string `toml:"action"`
+
+	GroupUrlnames  []string          `toml:"group_urlnames"`  // drop_groups
+	CountryAliases map[string]string `toml:"country_aliases"` // normalize_country
+	SpamPatterns   []string          `toml:"spam_patterns"`   // tag_spam
+
+	// Params are settings of registered processors.
+	Params map[string]string `toml:"params"`
+}
+
+// ProcessorFactory builds a processor from its config.
+type ProcessorFactory func(cfg ProcessorConfig) (Processor, error)
+
+var processorFactories = map[string]ProcessorFactory{
+	"drop_groups":       newDropGroups,
+	"normalize_country": newNormalizeCountry,
+	"event_local_date":  newEventLocalDate,
+	"tag_spam":          newTagSpam,
+}
+
+// RegisterProcessor makes processors of the type available in configs, it has to
+// be called before handlers are created.
+func RegisterProcessor(typ string, factory ProcessorFactory) {
+	processorFactories[typ] = factory
+}
+
+type stage struct {
+	name      string
+	processor Processor
+}
+
+// Chain passes RSVPs through processor stages in the configured order.
+type Chain struct {
+	stages []stage
+}
+
+func NewChain(cfgs []ProcessorConfig) (*Chain, error) {
+	chain := &Chain{}
+	names := make(map[string]bool, len(cfgs))
+
+	for _, cfg := range cfgs {
+		factory, ok := processorFactories[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown processor type %q", cfg.Type)
+		}
+
+		name := cfg.Name
+		if name == "" {
+			name = cfg.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate processor %q, stages of the same type need distinct names", name)
+		}
+		names[name] = true
+
+		processor, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not create processor %q: %w", name, err)
+		}
+
+		chain.stages = append(chain.stages, stage{name: name, processor: processor})
+	}
+
+	return chain, nil
+}
+
+// Process passes the RSVP through the stages until one of them short-circuits the
+// chain, it returns the verdict and the name of the stage which gave it.
+func (c *Chain) Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, string, error) {
+	for _, stage := range c.stages {
+		start := time.Now()
+		verdict, err := stage.processor.Process(ctx, rsvp)
+		rsvpProcessorDuration(stage.name).UpdateDuration(start)
+
+		if err != nil {
+			rsvpProcessorErrors(stage.name).Inc()
+			return Pass, stage.name, fmt.Errorf("processor %q: %w", stage.name, err)
+		}
+
+		rsvpProcessorRSVPs(stage.name, verdict).Inc()
+
+		if verdict != Pass {
+			return verdict, stage.name, nil
+		}
+	}
+	return Pass, "", nil
+}
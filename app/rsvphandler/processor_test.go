@@ -0,0 +1,171 @@
+package rsvphandler_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/oizgagin/ing/app/rsvphandler"
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	"github.com/oizgagin/ing/pkg/stream"
+)
+
+func TestChain(t *testing.T) {
+	chain, err := rsvphandler.NewChain([]rsvphandler.ProcessorConfig{
+		{Type: "drop_groups", GroupUrlnames: []string{"Test-Group"}},
+		{Type: "normalize_country", CountryAliases: map[string]string{"UK": "gb"}},
+		{Type: "event_local_date"},
+		{Type: "tag_spam", SpamPatterns: []string{`free\s+crypto`}},
+		{Type: "tag_spam", Name: "park_spam", Action: "park", SpamPatterns: []string{"casino"}},
+	})
+	require.NoError(t, err)
+
+	eventTime := time.Date(2023, 4, 10, 22, 30, 0, 0, time.UTC).UnixMilli()
+
+	testCases := []struct {
+		name    string
+		rsvp    rsvps.RSVP
+		verdict rsvphandler.Verdict
+		stage   string
+		expect  rsvps.RSVP
+	}{
+		{
+			name:    "test group",
+			rsvp:    rsvps.RSVP{Group: rsvps.Group{Urlname: "test-group"}},
+			verdict: rsvphandler.Drop,
+			stage:   "drop_groups",
+			expect:  rsvps.RSVP{Group: rsvps.Group{Urlname: "test-group"}},
+		},
+		{
+			name: "venue east of utc",
+			rsvp: rsvps.RSVP{
+				Group: rsvps.Group{Country: " UK "},
+				Venue: rsvps.Venue{Lat: 55.75, Lon: 37.62},
+				Event: rsvps.Event{Time: eventTime},
+			},
+			expect: rsvps.RSVP{
+				Group: rsvps.Group{Country: "gb"},
+				Venue: rsvps.Venue{Lat: 55.75, Lon: 37.62},
+				Event: rsvps.Event{Time: eventTime},
+				Attrs: map[string]string{rsvphandler.AttrEventLocalDate: "2023-04-11"},
+			},
+		},
+		{
+			name: "no venue, group west of utc",
+			rsvp: rsvps.RSVP{
+				Group: rsvps.Group{Country: "us", Lon: -122.42},
+				Event: rsvps.Event{Time: eventTime, Name: "Free  Crypto meetup"},
+			},
+			expect: rsvps.RSVP{
+				Group: rsvps.Group{Country: "us", Lon: -122.42},
+				Event: rsvps.Event{Time: eventTime, Name: "Free  Crypto meetup"},
+				Attrs: map[string]string{rsvphandler.AttrEventLocalDate: "2023-04-10", rsvphandler.AttrSpam: "true"},
+			},
+		},
+		{
+			name:    "parked spam",
+			rsvp:    rsvps.RSVP{Group: rsvps.Group{Country: "us", Name: "Casino nights"}},
+			verdict: rsvphandler.Park,
+			stage:   "park_spam",
+			expect: rsvps.RSVP{
+				Group: rsvps.Group{Country: "us", Name: "Casino nights"},
+				Attrs: map[string]string{rsvphandler.AttrEventLocalDate: "1970-01-01"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			verdict, stage, err := chain.Process(context.Background(), &tc.rsvp)
+			require.NoError(t, err)
+			require.Equal(t, tc.verdict, verdict)
+			require.Equal(t, tc.stage, stage)
+			require.Equal(t, tc.expect, tc.rsvp)
+		})
+	}
+}
+
+func TestNewChain_Invalid(t *testing.T) {
+	for _, cfgs := range [][]rsvphandler.ProcessorConfig{
+		{{Type: "unknown"}},
+		{{Type: "drop_groups"}},
+		{{Type: "drop_groups", GroupUrlnames: []string{"test"}, Action: "tag"}},
+		{{Type: "tag_spam", SpamPatterns: []string{"("}}},
+		{{Type: "event_local_date"}, {Type: "event_local_date"}},
+	} {
+		_, err := rsvphandler.NewChain(cfgs)
+		require.Error(t, err)
+	}
+}
+
+type failingProcessor struct{}
+
+func (failingProcessor) Process(ctx context.Context, rsvp *rsvps.RSVP) (rsvphandler.Verdict, error) {
+	if rsvp.ID == 3 {
+		return rsvphandler.Pass, errors.New("lookup failed")
+	}
+	return rsvphandler.Pass, nil
+}
+
+func TestHandler_Processors(t *testing.T) {
+	rsvphandler.RegisterProcessor("failing", func(rsvphandler.ProcessorConfig) (rsvphandler.Processor, error) {
+		return failingProcessor{}, nil
+	})
+
+	var (
+		s       = &fakeStream{ch: make(chan stream.Message)}
+		results = make(chan result, 4)
+		saved   = make(chan db.Record, 4)
+	)
+
+	funcDB := &funcDB{saveRSVP: func(record db.Record) error {
+		saved <- record
+		return nil
+	}}
+
+	handler, err := rsvphandler.NewHandler(rsvphandler.Config{
+		Workers:     1,
+		SaveTimeout: configtypes.Duration{Duration: time.Second},
+		Processors: []rsvphandler.ProcessorConfig{
+			{Type: "failing"},
+			{Type: "drop_groups", GroupUrlnames: []string{"dropped"}},
+			{Type: "drop_groups", Name: "park_groups", GroupUrlnames: []string{"parked"}, Action: "park"},
+			{Type: "event_local_date"},
+		},
+	}, zaptest.NewLogger(t), s, funcDB)
+	require.NoError(t, err)
+	defer handler.Stop()
+
+	for id, urlname := range []string{"saved", "dropped", "parked", "failed"} {
+		id, urlname := int64(id), urlname
+		s.ch <- stream.NewMessage(
+			rsvps.RSVP{ID: id, Group: rsvps.Group{Urlname: urlname}}, nil, rsvps.Origin{},
+			func() { results <- result{id: id} },
+			func(err error) { results <- result{id: id, err: err} },
+		)
+	}
+
+	byID := make(map[int64]error)
+	for i := 0; i < 4; i++ {
+		res := <-results
+		byID[res.id] = res.err
+	}
+
+	require.NoError(t, byID[0])
+	require.NoError(t, byID[1])
+	require.True(t, errors.Is(byID[2], stream.ErrPark))
+	require.Error(t, byID[3])
+	require.False(t, errors.Is(byID[3], stream.ErrPark))
+
+	record := <-saved
+	require.Equal(t, int64(0), record.RSVP.ID)
+	require.Equal(t, "1970-01-01", record.RSVP.Attrs[rsvphandler.AttrEventLocalDate])
+	require.Len(t, saved, 0)
+}
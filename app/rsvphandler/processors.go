@@ -0,0 +1,164 @@
+package rsvphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+const (
+	// AttrEventLocalDate is the date of the event in its local time (YYYY-MM-DD).
+	AttrEventLocalDate = "event_local_date"
+
+	// AttrSpam is set to "true" for RSVPs tagged as spam.
+	AttrSpam = "spam"
+)
+
+func action(cfg ProcessorConfig, fallback Verdict) (Verdict, error) {
+	switch cfg.Action {
+	case "":
+		return fallback, nil
+	case "drop":
+		return Drop, nil
+	case "park":
+		return Park, nil
+	}
+	return Pass, fmt.Errorf("invalid action %q, must be in (\"drop\" or \"park\")", cfg.Action)
+}
+
+func setAttr(rsvp *rsvps.RSVP, key, value string) {
+	if rsvp.Attrs == nil {
+		rsvp.Attrs = make(map[string]string)
+	}
+	rsvp.Attrs[key] = value
+}
+
+// dropGroups short-circuits RSVPs of the listed groups (i.e. test ones), groups are
+// matched by urlname case-insensitively.
+type dropGroups struct {
+	urlnames map[string]bool
+	verdict  Verdict
+}
+
+func newDropGroups(cfg ProcessorConfig) (Processor, error) {
+	verdict, err := action(cfg, Drop)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.GroupUrlnames) == 0 {
+		return nil, errors.New("no group urlnames")
+	}
+
+	p := &dropGroups{urlnames: make(map[string]bool, len(cfg.GroupUrlnames)), verdict: verdict}
+	for _, urlname := range cfg.GroupUrlnames {
+		p.urlnames[strings.ToLower(urlname)] = true
+	}
+	return p, nil
+}
+
+func (p *dropGroups) Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, error) {
+	if p.urlnames[strings.ToLower(rsvp.Group.Urlname)] {
+		return p.verdict, nil
+	}
+	return Pass, nil
+}
+
+// normalizeCountry lowercases and trims group country codes (as the feed sends
+// them) and replaces aliases, i.e. "uk" with "gb".
+type normalizeCountry struct {
+	aliases map[string]string
+}
+
+func newNormalizeCountry(cfg ProcessorConfig) (Processor, error) {
+	p := &normalizeCountry{aliases: make(map[string]string, len(cfg.CountryAliases))}
+	for alias, country := range cfg.CountryAliases {
+		p.aliases[normalizeCode(alias)] = normalizeCode(country)
+	}
+	return p, nil
+}
+
+func (p *normalizeCountry) Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, error) {
+	country := normalizeCode(rsvp.Group.Country)
+	if alias, ok := p.aliases[country]; ok {
+		country = alias
+	}
+	rsvp.Group.Country = country
+	return Pass, nil
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// eventLocalDate derives the local date of the event. The feed carries no time
+// zones, so the offset is approximated by the longitude of the venue (or of the
+// group, if the venue is unknown) in whole hours, which is off by an hour or so
+// near time zone borders.
+type eventLocalDate struct{}
+
+func newEventLocalDate(cfg ProcessorConfig) (Processor, error) {
+	return &eventLocalDate{}, nil
+}
+
+func (p *eventLocalDate) Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, error) {
+	lon := rsvp.Venue.Lon
+	if rsvp.Venue.Lat == 0 && rsvp.Venue.Lon == 0 {
+		lon = rsvp.Group.Lon
+	}
+
+	offset := time.Duration(math.Round(lon/15)) * time.Hour
+	local := time.UnixMilli(rsvp.Event.Time).UTC().Add(offset)
+
+	setAttr(rsvp, AttrEventLocalDate, local.Format("2006-01-02"))
+	return Pass, nil
+}
+
+// tagSpam matches event, group and member names against the patterns, matching
+// RSVPs are tagged with AttrSpam (and passed on) by default.
+type tagSpam struct {
+	patterns []*regexp.Regexp
+	verdict  Verdict
+	tag      bool
+}
+
+func newTagSpam(cfg ProcessorConfig) (Processor, error) {
+	p := &tagSpam{tag: cfg.Action == "" || cfg.Action == "tag"}
+	if !p.tag {
+		var err error
+		if p.verdict, err = action(cfg, Pass); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.SpamPatterns) == 0 {
+		return nil, errors.New("no spam patterns")
+	}
+
+	for _, pattern := range cfg.SpamPatterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spam pattern %q: %w", pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+func (p *tagSpam) Process(ctx context.Context, rsvp *rsvps.RSVP) (Verdict, error) {
+	for _, re := range p.patterns {
+		if re.MatchString(rsvp.Event.Name) || re.MatchString(rsvp.Group.Name) || re.MatchString(rsvp.Member.Name) {
+			if p.tag {
+				setAttr(rsvp, AttrSpam, "true")
+				return Pass, nil
+			}
+			return p.verdict, nil
+		}
+	}
+	return Pass, nil
+}
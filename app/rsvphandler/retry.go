@@ -0,0 +1,84 @@
+package rsvphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/db"
+)
+
+// RetryConfig is the policy of retrying transient save errors in place. Permanent
+// errors (see db.ErrPermanent) are never retried.
+type RetryConfig struct {
+	// MaxAttempts is the number of save attempts, after that the rsvps are parked.
+	// If it is 0, saves aren't retried by the handler, and transient failures are
+	// left to the stream to redeliver.
+	MaxAttempts int `toml:"max_attempts"`
+
+	// The backoff doubles with every attempt from MinBackoff up to MaxBackoff and is
+	// then reduced by a random fraction of up to Jitter (from 0 to 1).
+	MinBackoff configtypes.Duration `toml:"min_backoff"`
+	MaxBackoff configtypes.Duration `toml:"max_backoff"`
+	Jitter     float64              `toml:"jitter"`
+}
+
+func (cfg RetryConfig) validate() error {
+	if cfg.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry max attempts %v, must not be negative", cfg.MaxAttempts)
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return fmt.Errorf("invalid retry jitter %v, must be in [0, 1]", cfg.Jitter)
+	}
+	if cfg.MaxBackoff.Duration < cfg.MinBackoff.Duration {
+		return fmt.Errorf("invalid retry max backoff %v, must not be less than min backoff %v", cfg.MaxBackoff, cfg.MinBackoff)
+	}
+	return nil
+}
+
+// Backoff returns the delay before the attempt following the given one.
+func (cfg RetryConfig) Backoff(attempt int) time.Duration {
+	d := cfg.MinBackoff.Duration
+	for i := 1; i < attempt && d < cfg.MaxBackoff.Duration; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxBackoff.Duration {
+		d = cfg.MaxBackoff.Duration
+	}
+	return d - time.Duration(cfg.Jitter*rand.Float64()*float64(d))
+}
+
+// retry calls save until it succeeds, fails permanently, runs out of attempts or
+// ctx is done. It returns the last error and the number of attempts made. Saves
+// aren't attempted while consumption is paused.
+func (h *Handler) retry(ctx context.Context, save func(ctx context.Context) error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		if !h.pauser.wait(ctx) {
+			return attempt - 1, errStopped
+		}
+
+		err := save(ctx)
+
+		switch {
+		case errors.Is(err, db.ErrPermanent), errors.Is(err, db.ErrStaleOffset):
+			h.pauser.saveResult(nil)
+		case ctx.Err() == nil:
+			h.pauser.saveResult(err)
+		}
+
+		if err == nil || errors.Is(err, db.ErrPermanent) || errors.Is(err, db.ErrStaleOffset) || attempt >= h.retryPolicy.MaxAttempts {
+			return attempt, err
+		}
+
+		rsvpHandlerRetries.Inc()
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(h.retryPolicy.Backoff(attempt)):
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+const (
+	ingestStatusOK      = "ok"
+	ingestStatusInvalid = "invalid"
+	ingestStatusFailed  = "failed"
+)
+
+// Ingester feeds RSVPs pushed over HTTP, along with the payloads they were decoded
+// from, into the pipeline.
+type Ingester interface {
+	Ingest(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error
+}
+
+type IngesterFunc func(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error
+
+func (f IngesterFunc) Ingest(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error {
+	return f(ctx, rsvp, raw)
+}
+
+type ingestResult struct {
+	Index  int    `json:"index"`
+	RSVPID int64  `json:"rsvp_id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ingestResponse struct {
+	Results []ingestResult `json:"results"`
+}
+
+func (s *Server) handleRsvpsIngest(w http.ResponseWriter, r *http.Request) {
+	l := s.l.With(zap.String("handler", "handleRsvpsIngest"))
+
+	source := rsvps.DefaultSource
+	if r.URL.Query().Has("source") {
+		source = r.URL.Query().Get("source")
+	}
+	if err := rsvps.ValidateSource(source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.ingestMaxBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		l = l.With(zap.String("idempotency_key", key))
+
+		// the same payloads pushed to different sources are different requests
+		key = source + "/" + key
+
+		resp, err := s.idempotency.begin(key, body)
+		switch {
+		case errors.Is(err, errIdempotencyKeyInFlight):
+			http.Error(w, "request with the same Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case errors.Is(err, errIdempotencyKeyReused):
+			http.Error(w, "Idempotency-Key was used with a different request", http.StatusUnprocessableEntity)
+			return
+		case resp != nil:
+			l.Debug("replaying response for idempotency key")
+			w.Header().Add("Idempotent-Replayed", "true")
+			writeIngestResponse(w, l, resp)
+			return
+		}
+	}
+
+	raws, err := splitRecords(body)
+	if err != nil {
+		if key != "" {
+			s.idempotency.abort(key)
+		}
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		resp   = &ingestResponse{Results: make([]ingestResult, 0, len(raws))}
+		failed bool
+	)
+	for i, raw := range raws {
+		result := s.ingest(r.Context(), l, i, source, raw)
+		failed = failed || result.Status == ingestStatusFailed
+		resp.Results = append(resp.Results, result)
+	}
+
+	if key != "" {
+		// failed records have to be retried, so such responses are not remembered
+		if failed {
+			s.idempotency.abort(key)
+		} else {
+			s.idempotency.finish(key, resp)
+		}
+	}
+
+	writeIngestResponse(w, l, resp)
+}
+
+func (s *Server) ingest(ctx context.Context, l *zap.Logger, index int, source string, raw []byte) ingestResult {
+	result := ingestResult{Index: index}
+
+	rsvp, err := rsvps.Decode(raw)
+	rsvp.Source = source
+	result.RSVPID = rsvp.ID
+
+	if err != nil {
+		result.Status, result.Error = ingestStatusInvalid, err.Error()
+		ingestRSVPs(result.Status).Inc()
+		ingestRejectedRSVPs(rsvps.RejectReason(err)).Inc()
+		return result
+	}
+
+	if err := s.ingester.Ingest(ctx, rsvp, raw); err != nil {
+		l.Error("could not ingest rsvp", zap.Int64("rsvp_id", rsvp.ID), zap.Error(err))
+		result.Status, result.Error = ingestStatusFailed, http.StatusText(http.StatusInternalServerError)
+		ingestRSVPs(result.Status).Inc()
+		return result
+	}
+
+	result.Status = ingestStatusOK
+	ingestRSVPs(result.Status).Inc()
+	return result
+}
+
+func writeIngestResponse(w http.ResponseWriter, l *zap.Logger, resp *ingestResponse) {
+	w.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		l.Error("could not write response", zap.Error(err))
+	}
+}
+
+// splitRecords splits a JSON array or NDJSON body into raw records.
+func splitRecords(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, err
+		}
+		return raws, nil
+	}
+
+	var raws []json.RawMessage
+
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(nil, len(trimmed)+1)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		raws = append(raws, append(json.RawMessage(nil), line...))
+	}
+
+	return raws, scanner.Err()
+}
+
+var (
+	errIdempotencyKeyInFlight = errors.New("idempotency key is in flight")
+	errIdempotencyKeyReused   = errors.New("idempotency key is reused with a different body")
+)
+
+// idempotencyCache remembers responses by Idempotency-Key, so that retried requests
+// get the same response without ingesting their RSVPs once again. It is bounded
+// by the number of keys, the least recently used keys are evicted first.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxKeys int
+	keys    map[string]*list.Element
+	lru     *list.List
+}
+
+type idempotencyEntry struct {
+	key       string
+	bodyHash  [sha256.Size]byte
+	resp      *ingestResponse // nil while the request is in flight
+	expiresAt time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, maxKeys int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		keys:    make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// begin returns the stored response for the key, if there is none the key is
+// marked as in flight till either finish or abort is called.
+func (c *idempotencyCache) begin(key string, body []byte) (*ingestResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bodyHash := sha256.Sum256(body)
+	now := time.Now()
+
+	if el, ok := c.keys[key]; ok {
+		entry := el.Value.(*idempotencyEntry)
+
+		if now.Before(entry.expiresAt) {
+			c.lru.MoveToFront(el)
+
+			switch {
+			case entry.bodyHash != bodyHash:
+				return nil, errIdempotencyKeyReused
+			case entry.resp == nil:
+				return nil, errIdempotencyKeyInFlight
+			default:
+				return entry.resp, nil
+			}
+		}
+
+		c.lru.Remove(el)
+		delete(c.keys, key)
+	}
+
+	c.keys[key] = c.lru.PushFront(&idempotencyEntry{key: key, bodyHash: bodyHash, expiresAt: now.Add(c.ttl)})
+
+	for c.lru.Len() > c.maxKeys {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.keys, oldest.Value.(*idempotencyEntry).key)
+	}
+
+	return nil, nil
+}
+
+func (c *idempotencyCache) finish(key string, resp *ingestResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.keys[key]; ok {
+		entry := el.Value.(*idempotencyEntry)
+		entry.resp, entry.expiresAt = resp, time.Now().Add(c.ttl)
+	}
+}
+
+func (c *idempotencyCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.keys[key]; ok {
+		c.lru.Remove(el)
+		delete(c.keys, key)
+	}
+}
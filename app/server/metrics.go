@@ -0,0 +1,15 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+func ingestRSVPs(status string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`http_ingest_rsvps_total{status=%q}`, status))
+}
+
+func ingestRejectedRSVPs(field, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`http_ingest_rejected_rsvps_total{field=%q,reason=%q}`, field, reason))
+}
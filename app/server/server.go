@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -15,6 +16,7 @@ import (
 	"github.com/oizgagin/ing/pkg/cache"
 	configtypes "github.com/oizgagin/ing/pkg/config/types"
 	"github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/rsvps"
 )
 
 type Config struct {
@@ -24,21 +26,55 @@ type Config struct {
 	ShutdownTimeout configtypes.Duration `toml:"shutdown_timeout"`
 	CacheTTL        configtypes.Duration `toml:"cache_ttl"`
 	CacheSetTimeout configtypes.Duration `toml:"cache_set_timeout"`
+
+	// IngestMaxBodySize, IdempotencyKeyTTL and IdempotencyMaxKeys default to the
+	// values below if they aren't set.
+	IngestMaxBodySize  int64                `toml:"ingest_max_body_size"`
+	IdempotencyKeyTTL  configtypes.Duration `toml:"idempotency_key_ttl"`
+	IdempotencyMaxKeys int                  `toml:"idempotency_max_keys"`
 }
 
+const (
+	defaultIngestMaxBodySize  = 10 << 20
+	defaultIdempotencyKeyTTL  = 24 * time.Hour
+	defaultIdempotencyMaxKeys = 100000
+)
+
 type Server struct {
 	l          *zap.Logger
 	db         db.DB
 	eventCache cache.EventInfoCache
+	ingester   Ingester
 
 	ln              net.Listener
 	srv             *http.Server
 	shutdownTimeout time.Duration
 	cacheTTL        time.Duration
 	cacheSetTimeout time.Duration
+
+	ingestMaxBodySize int64
+	idempotency       *idempotencyCache
 }
 
-func NewServer(cfg Config, l *zap.Logger, db db.DB, eventCache cache.EventInfoCache) (*Server, error) {
+func NewServer(cfg Config, l *zap.Logger, db db.DB, eventCache cache.EventInfoCache, ingester Ingester) (*Server, error) {
+	switch {
+	case cfg.IngestMaxBodySize < 0:
+		return nil, fmt.Errorf("invalid ingest max body size %v, must not be negative", cfg.IngestMaxBodySize)
+	case cfg.IdempotencyKeyTTL.Duration < 0:
+		return nil, fmt.Errorf("invalid idempotency key ttl %v, must not be negative", cfg.IdempotencyKeyTTL.Duration)
+	case cfg.IdempotencyMaxKeys < 0:
+		return nil, fmt.Errorf("invalid idempotency max keys %v, must not be negative", cfg.IdempotencyMaxKeys)
+	}
+	if cfg.IngestMaxBodySize == 0 {
+		cfg.IngestMaxBodySize = defaultIngestMaxBodySize
+	}
+	if cfg.IdempotencyKeyTTL.Duration == 0 {
+		cfg.IdempotencyKeyTTL.Duration = defaultIdempotencyKeyTTL
+	}
+	if cfg.IdempotencyMaxKeys == 0 {
+		cfg.IdempotencyMaxKeys = defaultIdempotencyMaxKeys
+	}
+
 	ln, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
 		return nil, fmt.Errorf("could not start listening on %v: %w", cfg.Addr, err)
@@ -50,13 +86,16 @@ func NewServer(cfg Config, l *zap.Logger, db db.DB, eventCache cache.EventInfoCa
 	}
 
 	server := Server{
-		l:               l,
-		db:              db,
-		eventCache:      eventCache,
-		srv:             srv,
-		shutdownTimeout: cfg.ShutdownTimeout.Duration,
-		cacheTTL:        cfg.CacheTTL.Duration,
-		cacheSetTimeout: cfg.CacheSetTimeout.Duration,
+		l:                 l,
+		db:                db,
+		eventCache:        eventCache,
+		ingester:          ingester,
+		srv:               srv,
+		shutdownTimeout:   cfg.ShutdownTimeout.Duration,
+		cacheTTL:          cfg.CacheTTL.Duration,
+		cacheSetTimeout:   cfg.CacheSetTimeout.Duration,
+		ingestMaxBodySize: cfg.IngestMaxBodySize,
+		idempotency:       newIdempotencyCache(cfg.IdempotencyKeyTTL.Duration, cfg.IdempotencyMaxKeys),
 	}
 
 	srv.Handler = &server
@@ -83,39 +122,78 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
-	}
+	var (
+		method  string
+		handler func(w http.ResponseWriter, r *http.Request)
+	)
 
 	switch r.URL.Path {
 	case "/api/v1/events/topk":
-		s.handleEventsTopk(w, r)
+		method, handler = http.MethodGet, s.handleEventsTopk
 	case "/api/v1/events/info":
-		s.handleEventsInfo(w, r)
+		method, handler = http.MethodGet, s.handleEventsInfo
+	case "/api/v1/events/conflicts":
+		method, handler = http.MethodGet, s.handleEventsConflicts
+	case "/api/v1/rsvps":
+		method, handler = http.MethodPost, s.handleRsvpsIngest
 	default:
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
 	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	handler(w, r)
 }
 
 func (s *Server) handleEventsTopk(w http.ResponseWriter, r *http.Request) {
 	l := s.l.With(zap.String("handler", "handleEventsTopk"))
 
-	date, err := time.Parse("2006-01-02", r.URL.Query()["date"][0])
+	from, to, err := topkRange(r)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loc, err := topkLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	k, err := strconv.ParseUint(r.URL.Query()["k"][0], 10, 64)
+	k, err := strconv.ParseUint(r.URL.Query().Get("k"), 10, 64)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	l = l.With(zap.Time("date", date), zap.Uint("k", uint(k)))
+	source, err := sourceFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	topk, err := s.db.TopkEvents(r.Context(), date, uint(k))
+	filters, groupBy, err := topkDimensions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rankBy := db.RankBy(r.URL.Query().Get("rank_by"))
+	if rankBy != "" {
+		if err := db.ValidateRankBy(rankBy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	l = l.With(zap.Time("from", from), zap.Time("to", to), zap.Stringer("tz", loc), zap.Uint("k", uint(k)), zap.String("source", source), zap.Any("filters", filters), zap.Any("group_by", groupBy), zap.String("rank_by", string(rankBy)))
+
+	topk, err := s.db.TopkEvents(r.Context(), db.TopkQuery{From: from, To: to, Location: loc, K: uint(k), Source: source, RankBy: rankBy, Filters: filters, GroupBy: groupBy})
 	if err != nil {
 		l.Error("could not get topk events", zap.Error(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -134,17 +212,25 @@ func (s *Server) handleEventsTopk(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleEventsInfo(w http.ResponseWriter, r *http.Request) {
 	eventID := r.URL.Query()["event_id"][0]
 
-	l := s.l.With(zap.String("handler", "handleEventsInfo"), zap.String("event_id", eventID))
+	source, err := sourceFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	l := s.l.With(zap.String("handler", "handleEventsInfo"), zap.String("event_id", eventID), zap.String("source", source))
 
-	info, err := s.eventCache.Get(r.Context(), eventID)
+	cacheKey := cache.EventKey(source, eventID)
+
+	info, err := s.eventCache.Get(r.Context(), cacheKey)
 	if err != nil && err != cache.ErrNoCachedEventInfo {
 		l.Error("could not get cached event info", zap.String("event_id", eventID), zap.Error(err))
 		return
 	}
 
 	if err == cache.ErrNoCachedEventInfo {
-		info, err = s.db.GetEventInfo(r.Context(), eventID)
-		if err != nil && err != db.ErrNoEvents {
+		info, err = s.db.GetEventInfo(r.Context(), source, eventID)
+		if err != nil && err != db.ErrNoEvents && err != db.ErrAmbiguousEvent {
 			l.Error("could not get event info from db", zap.String("event_id", eventID), zap.Error(err))
 			return
 		}
@@ -152,12 +238,16 @@ func (s *Server) handleEventsInfo(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
+		if err == db.ErrAmbiguousEvent {
+			http.Error(w, "event exists in several sources, specify source", http.StatusConflict)
+			return
+		}
 
 		// TODO: maybe set this in goroutine
 		setCtx, setCancel := context.WithTimeout(context.Background(), s.cacheSetTimeout)
 		defer setCancel()
 
-		if err := s.eventCache.Set(setCtx, eventID, info, s.cacheTTL); err != nil {
+		if err := s.eventCache.Set(setCtx, cacheKey, info, s.cacheTTL); err != nil {
 			l.Error("could not cache event info", zap.Error(err))
 		}
 	}
@@ -171,6 +261,202 @@ func (s *Server) handleEventsInfo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// defaultConflictsLimit is how many event conflicts are returned if no limit is
+// given.
+const defaultConflictsLimit = 100
+
+func (s *Server) handleEventsConflicts(w http.ResponseWriter, r *http.Request) {
+	l := s.l.With(zap.String("handler", "handleEventsConflicts"))
+
+	source, err := sourceFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := uint64(defaultConflictsLimit)
+	if r.URL.Query().Has("limit") {
+		limit, err = strconv.ParseUint(r.URL.Query().Get("limit"), 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	l = l.With(zap.String("source", source), zap.Uint("limit", uint(limit)))
+
+	conflicts, err := s.db.EventConflicts(r.Context(), source, uint(limit))
+	if err != nil {
+		l.Error("could not get event conflicts", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(conflicts); err != nil {
+		l.Error("could not write response", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+// sourceFilter returns the source requested events have to belong to, empty if
+// events of all sources are requested.
+func sourceFilter(r *http.Request) (string, error) {
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		return "", nil
+	}
+	return source, rsvps.ValidateSource(source)
+}
+
+// topkRange returns the dates (both inclusive) given by exactly one of the date,
+// from and to, week (ISO week, i.e. 2023-W09) or month (i.e. 2023-03) parameters.
+func topkRange(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+
+	var given []string
+	for _, param := range []string{"date", "from", "week", "month"} {
+		if query.Has(param) {
+			given = append(given, param)
+		}
+	}
+	if query.Has("to") && !query.Has("from") {
+		return time.Time{}, time.Time{}, fmt.Errorf("to requires from")
+	}
+	if len(given) != 1 {
+		return time.Time{}, time.Time{}, fmt.Errorf("exactly one of date, from and to, week or month is required")
+	}
+
+	switch given[0] {
+	case "date":
+		date, err := time.Parse("2006-01-02", query.Get("date"))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date: %w", err)
+		}
+		return date, date, nil
+
+	case "from":
+		from, err := time.Parse("2006-01-02", query.Get("from"))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+		}
+		to, err := time.Parse("2006-01-02", query.Get("to"))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+		if to.Before(from) {
+			return time.Time{}, time.Time{}, fmt.Errorf("to is before from")
+		}
+		return from, to, nil
+
+	case "week":
+		var year, week int
+		if _, err := fmt.Sscanf(query.Get("week"), "%4d-W%2d", &year, &week); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid week: %w", err)
+		}
+		from, err := isoWeekStart(year, week)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return from, from.AddDate(0, 0, 6), nil
+
+	default:
+		month, err := time.Parse("2006-01", query.Get("month"))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid month: %w", err)
+		}
+		return month, month.AddDate(0, 1, -1), nil
+	}
+}
+
+// topkLocation returns the time zone given by the IANA name in the tz parameter,
+// dates are in UTC if it's not given.
+func topkLocation(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	// "Local" is the time zone of the server, which clients know nothing about
+	if name == "Local" {
+		return nil, fmt.Errorf("invalid tz %q", name)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tz %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// topkDimensions returns the dimension filters, given by parameters named by the
+// dimensions, and the comma separated group_by dimensions.
+func topkDimensions(r *http.Request) (map[db.Dimension]string, []db.Dimension, error) {
+	query := r.URL.Query()
+
+	var filters map[db.Dimension]string
+	for _, dim := range db.Dimensions {
+		if !query.Has(string(dim)) {
+			continue
+		}
+
+		value := query.Get(string(dim))
+
+		// groups without a state are ranked under the empty one, so it can be filtered by
+		if value == "" && dim != db.DimensionState {
+			return nil, nil, fmt.Errorf("empty %v", dim)
+		}
+		if dim == db.DimensionGroupID {
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, nil, fmt.Errorf("invalid group_id: %w", err)
+			}
+		}
+
+		if filters == nil {
+			filters = make(map[db.Dimension]string)
+		}
+		filters[dim] = value
+	}
+
+	if !query.Has("group_by") {
+		return filters, nil, nil
+	}
+
+	var groupBy []db.Dimension
+	for _, name := range strings.Split(query.Get("group_by"), ",") {
+		dim := db.Dimension(name)
+		if err := db.ValidateDimension(dim); err != nil {
+			return nil, nil, err
+		}
+		for _, grouped := range groupBy {
+			if grouped == dim {
+				return nil, nil, fmt.Errorf("duplicate group by dimension %q", dim)
+			}
+		}
+		groupBy = append(groupBy, dim)
+	}
+
+	return filters, groupBy, nil
+}
+
+// isoWeekStart returns the monday of the ISO week, the first week of a year is the
+// one containing january 4th.
+func isoWeekStart(year, week int) (time.Time, error) {
+	if week < 1 {
+		return time.Time{}, fmt.Errorf("invalid week: %v", week)
+	}
+
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+	start := jan4.AddDate(0, 0, -(int(jan4.Weekday())+6)%7+(week-1)*7)
+
+	if y, w := start.ISOWeek(); y != year || w != week {
+		return time.Time{}, fmt.Errorf("invalid week: %v has no week %v", year, week)
+	}
+	return start, nil
+}
+
 func (s *Server) Addr() net.Addr {
 	return s.ln.Addr()
 }
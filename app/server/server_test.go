@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,9 +25,20 @@ import (
 
 var (
 	topkEvents = []dbpkg.TopkEvent{
-		{Event: rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 1001}, ConfirmedRSVPs: 10},
-		{Event: rsvps.Event{ID: "event_id2", Name: "event_name2", URL: "event_url1", Time: 2001}, ConfirmedRSVPs: 20},
-		{Event: rsvps.Event{ID: "event_id3", Name: "event_name3", URL: "event_url1", Time: 3001}, ConfirmedRSVPs: 30},
+		{Event: rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 1001}, ConfirmedRSVPs: 10, Headcount: 12},
+		{Event: rsvps.Event{ID: "event_id2", Name: "event_name2", URL: "event_url1", Time: 2001}, ConfirmedRSVPs: 20, Headcount: 20},
+		{Event: rsvps.Event{ID: "event_id3", Name: "event_name3", URL: "event_url1", Time: 3001}, ConfirmedRSVPs: 30, Headcount: 45},
+	}
+
+	rsvp1 = rsvps.RSVP{
+		Source:     rsvps.DefaultSource, // set by the server, it's not encoded
+		ID:         1,
+		Mtime:      time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC).UnixMilli(),
+		Visibility: "public",
+		Response:   "yes",
+		Member:     rsvps.Member{ID: 1004, Name: "member_name1"},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 1001},
+		Group:      rsvps.Group{ID: 1002, Name: "group_name1", Country: "US", Topics: []rsvps.GroupTopic{}},
 	}
 
 	eventInfo1 = rsvps.EventInfo{
@@ -37,11 +50,11 @@ var (
 func TestServer(t *testing.T) {
 
 	t.Run("eventsTopk", func(t *testing.T) {
-		dbMock, _, server, tearDown := setUp(t, time.Second)
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
 		defer tearDown(t)
 
 		dbMock.
-			On("TopkEvents", mock.Anything, time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC), uint(3)).
+			On("TopkEvents", mock.Anything, topkQuery("2023-03-05", "2023-03-05", "")).
 			Return(topkEvents, nil)
 
 		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3", nil)
@@ -59,24 +72,240 @@ func TestServer(t *testing.T) {
 
 	})
 
+	t.Run("eventsTopkSource", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		dbMock.
+			On("TopkEvents", mock.Anything, topkQuery("2023-03-05", "2023-03-05", "eu")).
+			Return(topkEvents, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&source=eu", nil)
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&source=EU", nil)
+		rec = httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 400, rec.Result().StatusCode)
+	})
+
+	t.Run("eventsTopkRanges", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		ranges := map[string]dbpkg.TopkQuery{
+			"from=2023-03-01&to=2023-03-31": topkQuery("2023-03-01", "2023-03-31", ""),
+			"week=2023-W09":                 topkQuery("2023-02-27", "2023-03-05", ""),
+			"week=2021-W01":                 topkQuery("2021-01-04", "2021-01-10", ""),
+			"week=2020-W53":                 topkQuery("2020-12-28", "2021-01-03", ""),
+			"month=2023-02":                 topkQuery("2023-02-01", "2023-02-28", ""),
+		}
+
+		for params, q := range ranges {
+			dbMock.On("TopkEvents", mock.Anything, q).Return(topkEvents, nil).Once()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?k=3&"+params, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 200, rec.Result().StatusCode, params)
+		}
+
+		invalid := []string{
+			"",
+			"date=2023-03-05&month=2023-03",
+			"from=2023-03-05",
+			"to=2023-03-05",
+			"from=2023-03-05&to=2023-03-04",
+			"week=2023-W53",
+			"week=2023-W00",
+			"month=2023-13",
+		}
+
+		for _, params := range invalid {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?k=3&"+params, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 400, rec.Result().StatusCode, params)
+		}
+	})
+
+	t.Run("eventsTopkRankBy", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		q := topkQuery("2023-03-05", "2023-03-05", "")
+		q.RankBy = dbpkg.RankByHeadcount
+
+		dbMock.On("TopkEvents", mock.Anything, q).Return(topkEvents, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&rank_by=headcount", nil)
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&rank_by=guests", nil)
+		rec = httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 400, rec.Result().StatusCode)
+	})
+
+	t.Run("eventsTopkTimeZone", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		newYork, err := time.LoadLocation("America/New_York")
+		require.NoError(t, err)
+
+		q := topkQuery("2023-03-05", "2023-03-05", "")
+		q.Location = newYork
+
+		dbMock.On("TopkEvents", mock.Anything, q).Return(topkEvents, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&tz=America/New_York", nil)
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+
+		for _, tz := range []string{"Mars/Olympus_Mons", "Local"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&tz="+tz, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 400, rec.Result().StatusCode, tz)
+		}
+	})
+
+	t.Run("eventsTopkDimensions", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		q := topkQuery("2023-03-05", "2023-03-05", "")
+		q.Filters = map[dbpkg.Dimension]string{dbpkg.DimensionCountry: "de", dbpkg.DimensionGroupID: "5001"}
+		q.GroupBy = []dbpkg.Dimension{dbpkg.DimensionTopic, dbpkg.DimensionCity}
+
+		grouped := []dbpkg.TopkEvent{topkEvents[0]}
+		grouped[0].Dimensions = map[dbpkg.Dimension]string{dbpkg.DimensionTopic: "hiking", dbpkg.DimensionCity: "berlin"}
+
+		dbMock.On("TopkEvents", mock.Anything, q).Return(grouped, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&country=de&group_id=5001&group_by=topic,city", nil)
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+
+		var resp []dbpkg.TopkEvent
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&resp))
+		require.Equal(t, grouped, resp)
+
+		q = topkQuery("2023-03-05", "2023-03-05", "")
+		q.Filters = map[dbpkg.Dimension]string{dbpkg.DimensionState: ""}
+
+		dbMock.On("TopkEvents", mock.Anything, q).Return(topkEvents, nil)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&state=", nil)
+		rec = httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode, "groups without a state")
+
+		invalid := []string{
+			"country=",
+			"group_id=abc",
+			"group_by=venue",
+			"group_by=city,city",
+			"group_by=",
+		}
+
+		for _, params := range invalid {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/topk?date=2023-03-05&k=3&"+params, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 400, rec.Result().StatusCode, params)
+		}
+	})
+
+	t.Run("eventsConflicts", func(t *testing.T) {
+		dbMock, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		conflicts := []dbpkg.EventConflict{
+			{
+				Source:        "eu",
+				Event:         rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 1001},
+				EventVersions: 1,
+				VenueVersions: 2,
+				GroupVersions: 1,
+				LastChanged:   time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC),
+			},
+		}
+
+		dbMock.On("EventConflicts", mock.Anything, "", uint(100)).Return(conflicts, nil)
+		dbMock.On("EventConflicts", mock.Anything, "eu", uint(10)).Return(conflicts, nil)
+
+		for _, params := range []string{"", "?source=eu&limit=10"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/conflicts"+params, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 200, rec.Result().StatusCode, params)
+			require.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"))
+
+			var resp []dbpkg.EventConflict
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&resp))
+			require.Equal(t, conflicts, resp)
+		}
+
+		for _, params := range []string{"?limit=-1", "?limit=", "?source=EU"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/conflicts"+params, nil)
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, 400, rec.Result().StatusCode, params)
+		}
+	})
+
 	t.Run("eventsInfo", func(t *testing.T) {
 		cacheTTL := time.Second
 
-		dbMock, cacheMock, server, tearDown := setUp(t, cacheTTL)
+		dbMock, cacheMock, _, server, tearDown := setUp(t, cacheTTL)
 		defer tearDown(t)
 
 		dbMock.
-			On("GetEventInfo", mock.Anything, "event_id1").
-			Return(func(ctx context.Context, eventID string) (rsvps.EventInfo, error) {
+			On("GetEventInfo", mock.Anything, "", "event_id1").
+			Return(func(ctx context.Context, source, eventID string) (rsvps.EventInfo, error) {
 				return eventInfo1, nil
 			})
 
 		cacheMock.
-			On("Get", mock.Anything, "event_id1").
+			On("Get", mock.Anything, "/event_id1").
 			Return(rsvps.EventInfo{}, cachepkg.ErrNoCachedEventInfo)
 
 		cacheMock.
-			On("Set", mock.Anything, "event_id1", eventInfo1, cacheTTL).
+			On("Set", mock.Anything, "/event_id1", eventInfo1, cacheTTL).
 			Return(nil)
 
 		req := httptest.NewRequest(http.MethodGet, "/api/v1/events/info?event_id=event_id1", nil)
@@ -93,13 +322,202 @@ func TestServer(t *testing.T) {
 		require.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"))
 	})
 
+	t.Run("rsvpsIngest", func(t *testing.T) {
+		_, _, ingester, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		invalidRsvp := rsvp1
+		invalidRsvp.Response = "maybe"
+
+		body := "[" + marshal(t, rsvp1) + "," + marshal(t, invalidRsvp) + `,{"rsvp_id":"1"}]`
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/rsvps", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+		require.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"))
+
+		results := decodeIngestResults(t, rec)
+		require.Len(t, results, 3)
+		require.Equal(t, "ok", results[0].Status)
+		require.Equal(t, "invalid", results[1].Status)
+		require.Equal(t, "invalid", results[2].Status)
+
+		require.Equal(t, []rsvps.RSVP{rsvp1}, ingester.rsvps)
+	})
+
+	t.Run("rsvpsIngestNDJSON", func(t *testing.T) {
+		_, _, ingester, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		rsvp2 := rsvp1
+		rsvp2.ID = 2
+
+		body := marshal(t, rsvp1) + "\n\n" + marshal(t, rsvp2) + "\n"
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/rsvps", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+		require.Len(t, decodeIngestResults(t, rec), 2)
+		require.Equal(t, []rsvps.RSVP{rsvp1, rsvp2}, ingester.rsvps)
+	})
+
+	t.Run("rsvpsIngestSource", func(t *testing.T) {
+		_, _, ingester, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/rsvps?source=eu", strings.NewReader(marshal(t, rsvp1)))
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 200, rec.Result().StatusCode)
+
+		rsvpEU := rsvp1
+		rsvpEU.Source = "eu"
+		require.Equal(t, []rsvps.RSVP{rsvpEU}, ingester.rsvps)
+
+		req = httptest.NewRequest(http.MethodPost, "/api/v1/rsvps?source=EU/1", strings.NewReader(marshal(t, rsvp1)))
+		rec = httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 400, rec.Result().StatusCode)
+	})
+
+	t.Run("rsvpsIngestIdempotencyKey", func(t *testing.T) {
+		_, _, ingester, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		post := func(key, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/rsvps", strings.NewReader(body))
+			req.Header.Set("Idempotency-Key", key)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			return rec
+		}
+
+		body := "[" + marshal(t, rsvp1) + "]"
+
+		rec1 := post("key1", body)
+		require.Equal(t, 200, rec1.Result().StatusCode)
+
+		rec2 := post("key1", body)
+		require.Equal(t, 200, rec2.Result().StatusCode)
+		require.Equal(t, "true", rec2.Result().Header.Get("Idempotent-Replayed"))
+		require.Equal(t, decodeIngestResults(t, rec1), decodeIngestResults(t, rec2))
+
+		require.Equal(t, []rsvps.RSVP{rsvp1}, ingester.rsvps)
+
+		rec3 := post("key1", "[]")
+		require.Equal(t, 422, rec3.Result().StatusCode)
+	})
+
+	t.Run("rsvpsIngestDefaults", func(t *testing.T) {
+		_, _, ingester, srv, tearDown := setUpWithConfig(t, time.Second, func(cfg *server.Config) {
+			cfg.IngestMaxBodySize, cfg.IdempotencyKeyTTL, cfg.IdempotencyMaxKeys = 0, configtypes.Duration{}, 0
+		})
+		defer tearDown(t)
+
+		body := "[" + marshal(t, rsvp1) + "]"
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/rsvps", strings.NewReader(body))
+			req.Header.Set("Idempotency-Key", "key1")
+			rec := httptest.NewRecorder()
+
+			srv.ServeHTTP(rec, req)
+
+			require.Equal(t, 200, rec.Result().StatusCode)
+		}
+
+		require.Equal(t, []rsvps.RSVP{rsvp1}, ingester.rsvps)
+
+		_, err := server.NewServer(server.Config{Addr: ":0", IdempotencyMaxKeys: -1}, zaptest.NewLogger(t), nil, nil, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("methodNotAllowed", func(t *testing.T) {
+		_, _, _, server, tearDown := setUp(t, time.Second)
+		defer tearDown(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/rsvps", nil)
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, req)
+
+		require.Equal(t, 405, rec.Result().StatusCode)
+	})
+
+}
+
+func topkQuery(from, to, source string) dbpkg.TopkQuery {
+	parse := func(date string) time.Time {
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	return dbpkg.TopkQuery{From: parse(from), To: parse(to), Location: time.UTC, K: 3, Source: source}
+}
+
+type ingestResult struct {
+	Index  int    `json:"index"`
+	RSVPID int64  `json:"rsvp_id"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+func decodeIngestResults(t *testing.T, rec *httptest.ResponseRecorder) []ingestResult {
+	t.Helper()
+
+	var resp struct {
+		Results []ingestResult `json:"results"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&resp))
+	return resp.Results
 }
 
-func setUp(t *testing.T, cacheTTL time.Duration) (*dbmocks.DB, *cachemocks.EventInfoCache, *server.Server, func(t *testing.T)) {
+func marshal(t *testing.T, rsvp rsvps.RSVP) string {
+	t.Helper()
+
+	b, err := rsvps.Encode(rsvp)
+	require.NoError(t, err)
+	return string(b)
+}
+
+type recordingIngester struct {
+	mu    sync.Mutex
+	rsvps []rsvps.RSVP
+}
+
+func (i *recordingIngester) Ingest(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.rsvps = append(i.rsvps, rsvp)
+	return nil
+}
+
+func setUp(t *testing.T, cacheTTL time.Duration) (*dbmocks.DB, *cachemocks.EventInfoCache, *recordingIngester, *server.Server, func(t *testing.T)) {
+	t.Helper()
+
+	return setUpWithConfig(t, cacheTTL, func(*server.Config) {})
+}
+
+func setUpWithConfig(t *testing.T, cacheTTL time.Duration, configure func(cfg *server.Config)) (*dbmocks.DB, *cachemocks.EventInfoCache, *recordingIngester, *server.Server, func(t *testing.T)) {
 	t.Helper()
 
 	db := dbmocks.NewDB(t)
 	eventCache := cachemocks.NewEventInfoCache(t)
+	ingester := &recordingIngester{}
 
 	logger := zaptest.NewLogger(t)
 
@@ -107,12 +525,17 @@ func setUp(t *testing.T, cacheTTL time.Duration) (*dbmocks.DB, *cachemocks.Event
 		Addr:            ":0",
 		CacheTTL:        configtypes.Duration{Duration: cacheTTL},
 		CacheSetTimeout: configtypes.Duration{Duration: time.Second},
+
+		IngestMaxBodySize:  1 << 20,
+		IdempotencyKeyTTL:  configtypes.Duration{Duration: time.Minute},
+		IdempotencyMaxKeys: 10,
 	}
+	configure(&cfg)
 
-	server, err := server.NewServer(cfg, logger, db, eventCache)
+	server, err := server.NewServer(cfg, logger, db, eventCache, ingester)
 	require.NoError(t, err)
 
-	return db, eventCache, server, func(t *testing.T) {
+	return db, eventCache, ingester, server, func(t *testing.T) {
 		require.NoError(t, server.Close())
 		require.NoError(t, logger.Sync())
 	}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	// the release image has no time zone database, which top k time zones need
+	_ "time/tzdata"
+
 	"github.com/oizgagin/ing/app"
 	"github.com/oizgagin/ing/pkg/config"
 )
@@ -15,15 +20,22 @@ var (
 	configFile = flag.String("config", "/usr/local/etc/ing/config.toml", "path to config file")
 )
 
-func main() {
-	flag.Parse()
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
 
-	sigCh := make(chan os.Signal, 1)
+Commands:
+  (none)       run the service
+  dlq replay   push parked messages back to the topics they were read from
+  reprocess    re-derive stored rsvps and counters from their raw payloads (stop the service first)
 
-	go func() {
-		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-		<-sigCh
-	}()
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
 
 	var cfg app.Config
 
@@ -32,6 +44,23 @@ func main() {
 		log.Fatalf("could not parse config %v: %v", *configFile, err)
 	}
 
+	switch {
+	case flag.NArg() == 0:
+		run(cfg)
+	case flag.NArg() == 2 && flag.Arg(0) == "dlq" && flag.Arg(1) == "replay":
+		replayDLQ(cfg)
+	case flag.NArg() == 1 && flag.Arg(0) == "reprocess":
+		reprocess(cfg)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func run(cfg app.Config) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+
 	app, err := app.NewApp(cfg)
 	if err != nil {
 		log.Fatalf("could not run app: %v", err)
@@ -43,3 +72,21 @@ func main() {
 		log.Fatalf("could not close app: %v", err)
 	}
 }
+
+func replayDLQ(cfg app.Config) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	if err := app.ReplayDeadLetters(ctx, cfg); err != nil {
+		log.Fatalf("could not replay dead letters: %v", err)
+	}
+}
+
+func reprocess(cfg app.Config) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	if err := app.Reprocess(ctx, cfg); err != nil {
+		log.Fatalf("could not reprocess rsvps: %v", err)
+	}
+}
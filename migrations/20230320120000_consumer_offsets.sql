@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS consumer_offsets (
+    consumer_group TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    partition_id INT NOT NULL,
+    last_offset BIGINT NOT NULL,
+
+    PRIMARY KEY (consumer_group, topic, partition_id)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS rsvp_payloads (
+    rsvp_id BIGINT NOT NULL,
+    mtime TIMESTAMP NOT NULL,
+    payload JSONB NOT NULL,
+    topic TEXT NOT NULL,
+    partition_id INT NOT NULL,
+    message_offset BIGINT NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (rsvp_id, mtime)
+);
+
+CREATE INDEX rsvp_payloads_received_at_idx ON rsvp_payloads (received_at, rsvp_id, mtime);
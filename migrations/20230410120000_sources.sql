@@ -0,0 +1,44 @@
+-- every rsvp is tagged with the source it was consumed from, and ids are only
+-- unique within a source, so that feeds with overlapping ids can't collide
+
+ALTER TABLE events DROP CONSTRAINT fk_venue_id, DROP CONSTRAINT fk_group_id, DROP CONSTRAINT fk_member_id;
+ALTER TABLE rsvps DROP CONSTRAINT fk_event_id;
+ALTER TABLE event_counters DROP CONSTRAINT fk_event_id;
+
+ALTER TABLE venues ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE venues DROP CONSTRAINT venues_pkey, ADD PRIMARY KEY (source, id);
+
+ALTER TABLE groups ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE groups DROP CONSTRAINT groups_pkey, ADD PRIMARY KEY (source, id);
+
+ALTER TABLE members ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE members DROP CONSTRAINT members_pkey, ADD PRIMARY KEY (source, id);
+
+ALTER TABLE events ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE events
+    DROP CONSTRAINT events_pkey,
+    ADD PRIMARY KEY (source, id),
+    ADD CONSTRAINT fk_venue_id FOREIGN KEY (source, venue_id) REFERENCES venues(source, id),
+    ADD CONSTRAINT fk_group_id FOREIGN KEY (source, group_id) REFERENCES groups(source, id),
+    ADD CONSTRAINT fk_member_id FOREIGN KEY (source, member_id) REFERENCES members(source, id);
+
+ALTER TABLE rsvps ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE rsvps
+    DROP CONSTRAINT rsvps_pkey,
+    ADD PRIMARY KEY (source, id),
+    ADD CONSTRAINT fk_event_id FOREIGN KEY (source, event_id) REFERENCES events(source, id);
+
+ALTER TABLE event_counters ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE event_counters
+    DROP CONSTRAINT event_counters_pkey,
+    ADD PRIMARY KEY (rsvp_date, source, event_id),
+    ADD CONSTRAINT fk_event_id FOREIGN KEY (source, event_id) REFERENCES events(source, id);
+
+DROP INDEX event_counters_event_id_idx;
+CREATE INDEX event_counters_event_id_idx ON event_counters (source, event_id);
+
+ALTER TABLE rsvp_payloads ADD COLUMN source VARCHAR(50) NOT NULL DEFAULT 'default';
+ALTER TABLE rsvp_payloads DROP CONSTRAINT rsvp_payloads_pkey, ADD PRIMARY KEY (source, rsvp_id, mtime);
+
+DROP INDEX rsvp_payloads_received_at_idx;
+CREATE INDEX rsvp_payloads_received_at_idx ON rsvp_payloads (received_at, source, rsvp_id, mtime);
@@ -0,0 +1,4 @@
+-- attributes derived by rsvp processors, i.e. the local date of the event or the
+-- spam tag
+
+ALTER TABLE rsvps ADD COLUMN attrs JSONB NOT NULL DEFAULT '{}';
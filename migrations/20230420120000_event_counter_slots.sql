@@ -0,0 +1,5 @@
+-- counters of an event may be spread over several slots, so that concurrent saves
+-- don't serialize on a single row; readers sum over the slots
+
+ALTER TABLE event_counters ADD COLUMN slot SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE event_counters DROP CONSTRAINT event_counters_pkey, ADD PRIMARY KEY (rsvp_date, source, event_id, slot);
@@ -0,0 +1,62 @@
+-- weekly (ISO weeks, starting on monday) and monthly rollups of event_counters,
+-- kept up to date by the service from the log of changed counter dates; rollups
+-- are derived data, so they don't reference events
+
+CREATE TABLE IF NOT EXISTS event_counter_changes (
+    rsvp_date DATE NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION log_event_counter_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO event_counter_changes (rsvp_date) VALUES (OLD.rsvp_date);
+    ELSE
+        INSERT INTO event_counter_changes (rsvp_date) VALUES (NEW.rsvp_date);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER event_counters_log_changes
+    AFTER INSERT OR UPDATE OR DELETE ON event_counters
+    FOR EACH ROW EXECUTE FUNCTION log_event_counter_change();
+
+CREATE TABLE IF NOT EXISTS event_counters_weekly (
+    week DATE NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    confirmed_rsvps INTEGER NOT NULL,
+
+    PRIMARY KEY (week, source, event_id)
+);
+
+CREATE TABLE IF NOT EXISTS event_counters_monthly (
+    month DATE NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    confirmed_rsvps INTEGER NOT NULL,
+
+    PRIMARY KEY (month, source, event_id)
+);
+
+INSERT INTO
+    event_counters_weekly (week, source, event_id, confirmed_rsvps)
+SELECT
+    date_trunc('week', rsvp_date)::date, source, event_id, SUM(confirmed_rsvps)
+FROM
+    event_counters
+GROUP BY
+    1, 2, 3
+HAVING
+    SUM(confirmed_rsvps) <> 0;
+
+INSERT INTO
+    event_counters_monthly (month, source, event_id, confirmed_rsvps)
+SELECT
+    date_trunc('month', rsvp_date)::date, source, event_id, SUM(confirmed_rsvps)
+FROM
+    event_counters
+GROUP BY
+    1, 2, 3
+HAVING
+    SUM(confirmed_rsvps) <> 0;
@@ -0,0 +1,8 @@
+-- top k is filtered by dimensions of event groups: groups are looked up by their
+-- location or topics, and events by their group
+
+CREATE INDEX IF NOT EXISTS groups_location_idx ON groups (lower(country), state, city);
+CREATE INDEX IF NOT EXISTS groups_city_idx ON groups (city);
+CREATE INDEX IF NOT EXISTS groups_topics_idx ON groups USING GIN (topics jsonb_path_ops);
+
+CREATE INDEX IF NOT EXISTS events_group_id_idx ON events (source, group_id);
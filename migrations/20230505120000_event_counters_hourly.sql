@@ -0,0 +1,23 @@
+-- counters are also kept by UTC hours, so that top k can be asked for calendar
+-- days of any time zone; slots are the same as of event_counters
+
+CREATE TABLE IF NOT EXISTS event_counters_hourly (
+    rsvp_hour TIMESTAMP NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    slot SMALLINT NOT NULL DEFAULT 0,
+    confirmed_rsvps INTEGER NOT NULL,
+
+    PRIMARY KEY (rsvp_hour, source, event_id, slot)
+);
+
+INSERT INTO
+    event_counters_hourly (rsvp_hour, source, event_id, slot, confirmed_rsvps)
+SELECT
+    date_trunc('hour', mtime), source, event_id, 0, COUNT(*)
+FROM
+    rsvps
+WHERE
+    response
+GROUP BY
+    1, 2, 3;
@@ -0,0 +1,34 @@
+-- expected headcount (1 + guests of every confirmed rsvp) is counted next to
+-- confirmed rsvps; it's backfilled from rsvps into slot 0, and rollups of the
+-- backfilled dates are refreshed by the service as logged by the trigger
+
+ALTER TABLE event_counters ADD COLUMN headcount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE event_counters_hourly ADD COLUMN headcount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE event_counters_weekly ADD COLUMN headcount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE event_counters_monthly ADD COLUMN headcount INTEGER NOT NULL DEFAULT 0;
+
+INSERT INTO
+    event_counters (rsvp_date, source, event_id, slot, confirmed_rsvps, headcount)
+SELECT
+    mtime::date, source, event_id, 0, 0, SUM(1 + guests)
+FROM
+    rsvps
+WHERE
+    response
+GROUP BY
+    1, 2, 3
+ON CONFLICT (rsvp_date, source, event_id, slot) DO UPDATE
+    SET headcount = EXCLUDED.headcount;
+
+INSERT INTO
+    event_counters_hourly (rsvp_hour, source, event_id, slot, confirmed_rsvps, headcount)
+SELECT
+    date_trunc('hour', mtime), source, event_id, 0, 0, SUM(1 + guests)
+FROM
+    rsvps
+WHERE
+    response
+GROUP BY
+    1, 2, 3
+ON CONFLICT (rsvp_hour, source, event_id, slot) DO UPDATE
+    SET headcount = EXCLUDED.headcount;
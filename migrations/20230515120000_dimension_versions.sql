@@ -0,0 +1,102 @@
+-- venues, groups and events hold the latest version of their info (by mtime of the
+-- rsvps carrying it), every version is kept in dimension_versions from valid_from
+-- until valid_to (NULL for the current one); versions counts how many times the
+-- info changed, so events whose info disagreed across rsvps are found by it. The
+-- member who created an event isn't part of its info, as rsvps to the event come
+-- from other members as well.
+-- Rows stored before versioning are valid from the epoch.
+
+ALTER TABLE venues
+    ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT 'epoch',
+    ADD COLUMN versions INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN changed_at TIMESTAMP NOT NULL DEFAULT 'epoch';
+
+ALTER TABLE groups
+    ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT 'epoch',
+    ADD COLUMN versions INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN changed_at TIMESTAMP NOT NULL DEFAULT 'epoch';
+
+ALTER TABLE events
+    ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT 'epoch',
+    ADD COLUMN versions INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN changed_at TIMESTAMP NOT NULL DEFAULT 'epoch';
+
+CREATE TABLE IF NOT EXISTS dimension_versions (
+    dimension VARCHAR(20) NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    id VARCHAR(100) NOT NULL,
+    info JSONB NOT NULL,
+    valid_from TIMESTAMP NOT NULL,
+    valid_to TIMESTAMP NULL,
+
+    PRIMARY KEY (dimension, source, id, valid_from)
+);
+
+INSERT INTO dimension_versions (dimension, source, id, info, valid_from)
+SELECT 'venues', source, id::text, to_jsonb(venues) - 'source' - 'id' - 'mtime' - 'versions' - 'changed_at', mtime FROM venues;
+
+INSERT INTO dimension_versions (dimension, source, id, info, valid_from)
+SELECT 'groups', source, id::text, to_jsonb(groups) - 'source' - 'id' - 'mtime' - 'versions' - 'changed_at', mtime FROM groups;
+
+INSERT INTO dimension_versions (dimension, source, id, info, valid_from)
+SELECT 'events', source, id, to_jsonb(events) - 'source' - 'id' - 'member_id' - 'mtime' - 'versions' - 'changed_at', mtime FROM events;
+
+-- version_dimension counts a new version when a row is inserted or its info is
+-- changed, updates which only move mtime forward keep the current version. It has
+-- no side effects, as BEFORE INSERT triggers fire for upserts ending in a conflict.
+
+CREATE OR REPLACE FUNCTION version_dimension() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF to_jsonb(NEW) - 'source' - 'id' - 'member_id' - 'mtime' - 'versions' - 'changed_at' = to_jsonb(OLD) - 'source' - 'id' - 'member_id' - 'mtime' - 'versions' - 'changed_at' THEN
+            RETURN NEW;
+        END IF;
+
+        NEW.versions := OLD.versions + 1;
+    END IF;
+
+    NEW.changed_at := NEW.mtime;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- record_dimension_version closes the current version and records the new one
+-- after a new version was counted by version_dimension
+
+CREATE OR REPLACE FUNCTION record_dimension_version() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND NEW.changed_at = OLD.changed_at THEN
+        RETURN NULL;
+    END IF;
+
+    UPDATE
+        dimension_versions
+    SET
+        valid_to = NEW.mtime
+    WHERE
+        dimension = TG_TABLE_NAME AND source = NEW.source AND id = NEW.id::text AND valid_to IS NULL;
+
+    INSERT INTO
+        dimension_versions (dimension, source, id, info, valid_from)
+    VALUES
+        (TG_TABLE_NAME, NEW.source, NEW.id::text, to_jsonb(NEW) - 'source' - 'id' - 'member_id' - 'mtime' - 'versions' - 'changed_at', NEW.mtime)
+    ON CONFLICT (dimension, source, id, valid_from) DO UPDATE
+        SET info = EXCLUDED.info, valid_to = NULL;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER venues_version BEFORE INSERT OR UPDATE ON venues FOR EACH ROW EXECUTE FUNCTION version_dimension();
+CREATE TRIGGER groups_version BEFORE INSERT OR UPDATE ON groups FOR EACH ROW EXECUTE FUNCTION version_dimension();
+CREATE TRIGGER events_version BEFORE INSERT OR UPDATE ON events FOR EACH ROW EXECUTE FUNCTION version_dimension();
+
+CREATE TRIGGER venues_record_version AFTER INSERT OR UPDATE ON venues FOR EACH ROW EXECUTE FUNCTION record_dimension_version();
+CREATE TRIGGER groups_record_version AFTER INSERT OR UPDATE ON groups FOR EACH ROW EXECUTE FUNCTION record_dimension_version();
+CREATE TRIGGER events_record_version AFTER INSERT OR UPDATE ON events FOR EACH ROW EXECUTE FUNCTION record_dimension_version();
+
+CREATE INDEX IF NOT EXISTS venues_versions_idx ON venues (source, id) WHERE versions > 1;
+CREATE INDEX IF NOT EXISTS groups_versions_idx ON groups (source, id) WHERE versions > 1;
+CREATE INDEX IF NOT EXISTS events_versions_idx ON events (source, id) WHERE versions > 1;
+CREATE INDEX IF NOT EXISTS events_venue_id_idx ON events (source, venue_id);
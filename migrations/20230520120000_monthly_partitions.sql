@@ -0,0 +1,92 @@
+-- rsvps and event counters are range-partitioned by month of mtime, rsvp_date and
+-- rsvp_hour, so that months past the retention are detached or dropped whole by
+-- the service instead of being deleted row by row. Partitions are named
+-- <table>_yYYYYmMM, the service creates them ahead of time and on demand; this
+-- migration creates them for the months of the stored rows and at least three
+-- months ahead.
+--
+-- The primary key of a partitioned table has to include the partition key, so rsvp
+-- ids are no longer unique by a constraint, saves of an rsvp are serialized by an
+-- advisory lock of its source and id instead.
+
+-- create_month_partitions creates missing partitions of the parent for the months
+-- from the first to the last one (both inclusive) and returns how many were created;
+-- tables of detached partitions are left alone, so their months aren't reattached
+
+CREATE OR REPLACE FUNCTION create_month_partitions(parent TEXT, first_month DATE, last_month DATE) RETURNS INTEGER AS $$
+DECLARE
+    m DATE := date_trunc('month', first_month);
+    partition_name TEXT;
+    created INTEGER := 0;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('create_month_partitions'));
+
+    WHILE m <= last_month LOOP
+        partition_name := parent || to_char(m, '"_y"YYYY"m"MM');
+
+        IF to_regclass(quote_ident(partition_name)) IS NULL THEN
+            EXECUTE format(
+                'CREATE TABLE %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                partition_name, parent, m, (m + interval '1 month')::date
+            );
+            created := created + 1;
+        END IF;
+
+        m := (m + interval '1 month')::date;
+    END LOOP;
+
+    RETURN created;
+END;
+$$ LANGUAGE plpgsql;
+
+-- rsvps
+
+ALTER TABLE rsvps RENAME TO rsvps_unpartitioned;
+ALTER TABLE rsvps_unpartitioned DROP CONSTRAINT rsvps_pkey;
+
+CREATE TABLE rsvps (LIKE rsvps_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (mtime);
+ALTER TABLE rsvps
+    ADD PRIMARY KEY (source, id, mtime),
+    ADD CONSTRAINT fk_event_id FOREIGN KEY (source, event_id) REFERENCES events(source, id);
+
+SELECT create_month_partitions('rsvps', COALESCE((SELECT MIN(mtime) FROM rsvps_unpartitioned), now())::date, GREATEST((SELECT MAX(mtime) FROM rsvps_unpartitioned), now() + interval '3 months')::date);
+
+INSERT INTO rsvps SELECT * FROM rsvps_unpartitioned;
+DROP TABLE rsvps_unpartitioned;
+
+-- daily counters, changes are logged for rollups only after they are copied
+
+ALTER TABLE event_counters RENAME TO event_counters_unpartitioned;
+ALTER TABLE event_counters_unpartitioned DROP CONSTRAINT event_counters_pkey;
+DROP INDEX event_counters_event_id_idx;
+DROP INDEX event_counters_confirmed_rsvps_idx;
+
+CREATE TABLE event_counters (LIKE event_counters_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (rsvp_date);
+ALTER TABLE event_counters
+    ADD PRIMARY KEY (rsvp_date, source, event_id, slot),
+    ADD CONSTRAINT fk_event_id FOREIGN KEY (source, event_id) REFERENCES events(source, id);
+
+CREATE INDEX event_counters_event_id_idx ON event_counters (source, event_id);
+CREATE INDEX event_counters_confirmed_rsvps_idx ON event_counters (confirmed_rsvps DESC);
+
+SELECT create_month_partitions('event_counters', COALESCE((SELECT MIN(rsvp_date) FROM event_counters_unpartitioned), now())::date, GREATEST((SELECT MAX(rsvp_date) FROM event_counters_unpartitioned), now() + interval '3 months')::date);
+
+INSERT INTO event_counters SELECT * FROM event_counters_unpartitioned;
+DROP TABLE event_counters_unpartitioned;
+
+CREATE TRIGGER event_counters_log_changes
+    AFTER INSERT OR UPDATE OR DELETE ON event_counters
+    FOR EACH ROW EXECUTE FUNCTION log_event_counter_change();
+
+-- hourly counters
+
+ALTER TABLE event_counters_hourly RENAME TO event_counters_hourly_unpartitioned;
+ALTER TABLE event_counters_hourly_unpartitioned DROP CONSTRAINT event_counters_hourly_pkey;
+
+CREATE TABLE event_counters_hourly (LIKE event_counters_hourly_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (rsvp_hour);
+ALTER TABLE event_counters_hourly ADD PRIMARY KEY (rsvp_hour, source, event_id, slot);
+
+SELECT create_month_partitions('event_counters_hourly', COALESCE((SELECT MIN(rsvp_hour) FROM event_counters_hourly_unpartitioned), now())::date, GREATEST((SELECT MAX(rsvp_hour) FROM event_counters_hourly_unpartitioned), now() + interval '3 months')::date);
+
+INSERT INTO event_counters_hourly SELECT * FROM event_counters_hourly_unpartitioned;
+DROP TABLE event_counters_hourly_unpartitioned;
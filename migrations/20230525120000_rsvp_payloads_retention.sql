@@ -0,0 +1,4 @@
+-- payloads of months past the partition retention are deleted by the service
+-- together with the partitions of the months
+
+CREATE INDEX IF NOT EXISTS rsvp_payloads_mtime_idx ON rsvp_payloads (mtime);
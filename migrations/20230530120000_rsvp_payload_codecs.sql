@@ -0,0 +1,6 @@
+-- payloads are stored as they were received, with the codec they are decoded by;
+-- payloads stored so far are JSON (Avro and Protobuf ones were stored as RSVPs
+-- encoded as JSON)
+
+ALTER TABLE rsvp_payloads ADD COLUMN codec VARCHAR(20) NOT NULL DEFAULT 'json';
+ALTER TABLE rsvp_payloads ALTER COLUMN payload TYPE BYTEA USING convert_to(payload::text, 'UTF8');
@@ -0,0 +1,4 @@
+-- top k of time zones with offsets in fractions of hours counts the partial hours
+-- the range starts and ends with from rsvps by mtime
+
+CREATE INDEX rsvps_mtime_idx ON rsvps (mtime) WHERE response;
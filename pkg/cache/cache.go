@@ -10,9 +10,16 @@ import (
 
 //go:generate mockery --name EventInfoCache
 type EventInfoCache interface {
-	Get(ctx context.Context, eventID string) (rsvps.EventInfo, error)
-	Set(ctx context.Context, eventID string, info rsvps.EventInfo, ttl time.Duration) error
+	Get(ctx context.Context, key string) (rsvps.EventInfo, error)
+	Set(ctx context.Context, key string, info rsvps.EventInfo, ttl time.Duration) error
 	Close() error
 }
 
+// EventKey returns the key event info is cached under, event ids are only unique
+// within a source. An empty source stands for the event with the id among all
+// sources.
+func EventKey(source, eventID string) string {
+	return source + "/" + eventID
+}
+
 var ErrNoCachedEventInfo = errors.New("no cached event info")
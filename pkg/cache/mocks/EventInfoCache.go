@@ -30,23 +30,23 @@ func (_m *EventInfoCache) Close() error {
 	return r0
 }
 
-// Get provides a mock function with given fields: ctx, eventID
-func (_m *EventInfoCache) Get(ctx context.Context, eventID string) (rsvps.EventInfo, error) {
-	ret := _m.Called(ctx, eventID)
+// Get provides a mock function with given fields: ctx, key
+func (_m *EventInfoCache) Get(ctx context.Context, key string) (rsvps.EventInfo, error) {
+	ret := _m.Called(ctx, key)
 
 	var r0 rsvps.EventInfo
 	var r1 error
 	if rf, ok := ret.Get(0).(func(context.Context, string) (rsvps.EventInfo, error)); ok {
-		return rf(ctx, eventID)
+		return rf(ctx, key)
 	}
 	if rf, ok := ret.Get(0).(func(context.Context, string) rsvps.EventInfo); ok {
-		r0 = rf(ctx, eventID)
+		r0 = rf(ctx, key)
 	} else {
 		r0 = ret.Get(0).(rsvps.EventInfo)
 	}
 
 	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
-		r1 = rf(ctx, eventID)
+		r1 = rf(ctx, key)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -54,13 +54,13 @@ func (_m *EventInfoCache) Get(ctx context.Context, eventID string) (rsvps.EventI
 	return r0, r1
 }
 
-// Set provides a mock function with given fields: ctx, eventID, info, ttl
-func (_m *EventInfoCache) Set(ctx context.Context, eventID string, info rsvps.EventInfo, ttl time.Duration) error {
-	ret := _m.Called(ctx, eventID, info, ttl)
+// Set provides a mock function with given fields: ctx, key, info, ttl
+func (_m *EventInfoCache) Set(ctx context.Context, key string, info rsvps.EventInfo, ttl time.Duration) error {
+	ret := _m.Called(ctx, key, info, ttl)
 
 	var r0 error
 	if rf, ok := ret.Get(0).(func(context.Context, string, rsvps.EventInfo, time.Duration) error); ok {
-		r0 = rf(ctx, eventID, info, ttl)
+		r0 = rf(ctx, key, info, ttl)
 	} else {
 		r0 = ret.Error(0)
 	}
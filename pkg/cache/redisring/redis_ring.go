@@ -55,8 +55,8 @@ func NewCache(cfg Config) (*Cache, error) {
 	return cache, nil
 }
 
-func (c *Cache) Get(ctx context.Context, eventID string) (rsvps.EventInfo, error) {
-	j, err := c.ring.Get(ctx, eventID).Bytes()
+func (c *Cache) Get(ctx context.Context, key string) (rsvps.EventInfo, error) {
+	j, err := c.ring.Get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return rsvps.EventInfo{}, cache.ErrNoCachedEventInfo
@@ -72,13 +72,13 @@ func (c *Cache) Get(ctx context.Context, eventID string) (rsvps.EventInfo, error
 	return info, nil
 }
 
-func (c *Cache) Set(ctx context.Context, eventID string, info rsvps.EventInfo, ttl time.Duration) error {
+func (c *Cache) Set(ctx context.Context, key string, info rsvps.EventInfo, ttl time.Duration) error {
 	b, err := json.Marshal(info)
 	if err != nil {
-		return fmt.Errorf("could not marshal event %v: %w", eventID, err)
+		return fmt.Errorf("could not marshal event %v: %w", key, err)
 	}
-	if err := c.ring.Set(ctx, eventID, string(b), ttl).Err(); err != nil {
-		return fmt.Errorf("could not cache event %v: %w", eventID, err)
+	if err := c.ring.Set(ctx, key, string(b), ttl).Err(); err != nil {
+		return fmt.Errorf("could not cache event %v: %w", key, err)
 	}
 	return nil
 }
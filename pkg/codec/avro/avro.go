@@ -0,0 +1,169 @@
+package avro
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/hamba/avro/v2"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// magicByte starts every payload in the Confluent wire format, it's followed by
+// the big endian schema id and the Avro encoded record.
+const magicByte = 0
+
+const headerLen = 5
+
+// Decoder decodes Avro RSVPs in the Confluent wire format, resolving writer
+// schemas with the registry. The fields are matched by name with the ones of the
+// JSON format, see rsvp.avsc.
+type Decoder struct {
+	registry *Registry
+}
+
+func NewDecoder(registry *Registry) *Decoder {
+	return &Decoder{registry: registry}
+}
+
+func (d *Decoder) Decode(ctx context.Context, data []byte) (rsvps.RSVP, error) {
+	if len(data) < headerLen || data[0] != magicByte {
+		return rsvps.RSVP{}, &rsvps.DecodeError{
+			Reason: rsvps.ReasonMalformed,
+			Err:    errors.New("no confluent wire format header"),
+		}
+	}
+
+	id := int(binary.BigEndian.Uint32(data[1:headerLen]))
+
+	schema, err := d.registry.Schema(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrSchemaUnavailable) {
+			return rsvps.RSVP{}, err
+		}
+		return rsvps.RSVP{}, &rsvps.DecodeError{Reason: rsvps.ReasonUnknownSchema, Err: err}
+	}
+
+	// avro.Unmarshal ignores unexpected EOFs, so truncated payloads are detected
+	// with a reader
+	var v record
+	r := avro.NewReader(nil, 0).Reset(data[headerLen:])
+	if r.ReadVal(schema, &v); r.Error != nil {
+		return rsvps.RSVP{}, &rsvps.DecodeError{
+			Reason: rsvps.ReasonMalformed,
+			Err:    fmt.Errorf("schema %d: %w", id, r.Error),
+		}
+	}
+
+	if v.Guests < 0 {
+		return rsvps.RSVP{}, &rsvps.DecodeError{
+			Field:  "guests",
+			Reason: rsvps.ReasonTypeMismatch,
+			Err:    fmt.Errorf("negative guests %d", v.Guests),
+		}
+	}
+
+	rsvp := v.rsvp()
+	return rsvp, rsvp.Validate()
+}
+
+type record struct {
+	ID         int64  `avro:"rsvp_id"`
+	Mtime      int64  `avro:"mtime"`
+	Guests     int    `avro:"guests"`
+	Visibility string `avro:"visibility"`
+	Response   string `avro:"response"`
+
+	Venue  *venue `avro:"venue"`
+	Member member `avro:"member"`
+	Event  event  `avro:"event"`
+	Group  group  `avro:"group"`
+}
+
+type venue struct {
+	ID   int64   `avro:"venue_id"`
+	Name string  `avro:"venue_name"`
+	Lat  float64 `avro:"lat"`
+	Lon  float64 `avro:"lon"`
+}
+
+type member struct {
+	ID    int64   `avro:"member_id"`
+	Name  string  `avro:"member_name"`
+	Photo *string `avro:"photo"`
+}
+
+type event struct {
+	ID   string `avro:"event_id"`
+	Name string `avro:"event_name"`
+	URL  string `avro:"event_url"`
+	Time *int64 `avro:"time"`
+}
+
+type group struct {
+	ID      int64        `avro:"group_id"`
+	Name    string       `avro:"group_name"`
+	Country string       `avro:"group_country"`
+	State   *string      `avro:"group_state"`
+	City    string       `avro:"group_city"`
+	Lat     float64      `avro:"group_lat"`
+	Lon     float64      `avro:"group_lon"`
+	Urlname string       `avro:"group_urlname"`
+	Topics  []groupTopic `avro:"group_topics"`
+}
+
+type groupTopic struct {
+	Urlkey    string `avro:"urlkey"`
+	TopicName string `avro:"topic_name"`
+}
+
+func (r record) rsvp() rsvps.RSVP {
+	rsvp := rsvps.RSVP{
+		ID:         r.ID,
+		Mtime:      r.Mtime,
+		Guests:     uint(r.Guests),
+		Visibility: r.Visibility,
+		Response:   r.Response,
+		Member: rsvps.Member{
+			ID:    r.Member.ID,
+			Name:  r.Member.Name,
+			Photo: deref(r.Member.Photo),
+		},
+		Event: rsvps.Event{
+			ID:   r.Event.ID,
+			Name: r.Event.Name,
+			URL:  r.Event.URL,
+			Time: deref(r.Event.Time),
+		},
+		Group: rsvps.Group{
+			ID:      r.Group.ID,
+			Name:    r.Group.Name,
+			Country: r.Group.Country,
+			State:   deref(r.Group.State),
+			City:    r.Group.City,
+			Lat:     r.Group.Lat,
+			Lon:     r.Group.Lon,
+			Urlname: r.Group.Urlname,
+		},
+	}
+
+	if r.Venue != nil {
+		rsvp.Venue = rsvps.Venue(*r.Venue)
+	}
+
+	for _, topic := range r.Group.Topics {
+		rsvp.Group.Topics = append(rsvp.Group.Topics, rsvps.GroupTopic(topic))
+	}
+
+	return rsvp
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
@@ -0,0 +1,193 @@
+package avro_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	hambaavro "github.com/hamba/avro/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oizgagin/ing/pkg/codec/avro"
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+type venue struct {
+	ID   int64   `avro:"venue_id"`
+	Name string  `avro:"venue_name"`
+	Lat  float64 `avro:"lat"`
+	Lon  float64 `avro:"lon"`
+}
+
+type member struct {
+	ID    int64   `avro:"member_id"`
+	Name  string  `avro:"member_name"`
+	Photo *string `avro:"photo"`
+}
+
+type event struct {
+	ID   string `avro:"event_id"`
+	Name string `avro:"event_name"`
+	URL  string `avro:"event_url"`
+	Time *int64 `avro:"time"`
+}
+
+type groupTopic struct {
+	Urlkey    string `avro:"urlkey"`
+	TopicName string `avro:"topic_name"`
+}
+
+type group struct {
+	ID      int64        `avro:"group_id"`
+	Name    string       `avro:"group_name"`
+	Country string       `avro:"group_country"`
+	State   *string      `avro:"group_state"`
+	City    string       `avro:"group_city"`
+	Lat     float64      `avro:"group_lat"`
+	Lon     float64      `avro:"group_lon"`
+	Urlname string       `avro:"group_urlname"`
+	Topics  []groupTopic `avro:"group_topics"`
+}
+
+type record struct {
+	ID         int64  `avro:"rsvp_id"`
+	Mtime      int64  `avro:"mtime"`
+	Guests     int    `avro:"guests"`
+	Visibility string `avro:"visibility"`
+	Response   string `avro:"response"`
+	Venue      *venue `avro:"venue"`
+	Member     member `avro:"member"`
+	Event      event  `avro:"event"`
+	Group      group  `avro:"group"`
+}
+
+func validRecord() record {
+	eventTime, state := int64(1491613200000), "TP"
+
+	return record{
+		ID:         1658733801,
+		Mtime:      1489925470960,
+		Guests:     1,
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      &venue{ID: 19712922, Name: "Cafe Vitus", Lat: 25.052959, Lon: 121.54731},
+		Member:     member{ID: 120119272, Name: "Allen Wang"},
+		Event:      event{ID: "jkpwmlywgbmb", Name: "Play Intermediate Volleyball", URL: "https://www.meetup.com/e/1", Time: &eventTime},
+		Group: group{
+			ID:      16585312,
+			Name:    "Taipei Sports and Social Club",
+			Country: "tw",
+			State:   &state,
+			City:    "Taipei",
+			Lat:     25.02,
+			Lon:     121.45,
+			Urlname: "Taipei-Sports-and-Social-Club",
+			Topics:  []groupTopic{{Urlkey: "fitness", TopicName: "Fitness"}},
+		},
+	}
+}
+
+func TestDecoder_Decode(t *testing.T) {
+	schema, err := os.ReadFile("rsvp.avsc")
+	require.NoError(t, err)
+
+	// the fake registry knows schema 1, doesn't know schema 2 and fails for schema 3
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]string{"schema": string(schema)}))
+		case "/schemas/ids/3":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	dec := avro.NewDecoder(avro.NewRegistry(avro.RegistryConfig{
+		URL:     registry.URL,
+		Timeout: configtypes.Duration{Duration: time.Second},
+	}))
+
+	encode := func(t *testing.T, id uint32, v record) []byte {
+		data, err := hambaavro.Marshal(hambaavro.MustParse(string(schema)), v)
+		require.NoError(t, err)
+
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header[1:], id)
+		return append(header, data...)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		rsvp, err := dec.Decode(context.Background(), encode(t, 1, validRecord()))
+		require.NoError(t, err)
+
+		require.Equal(t, rsvps.RSVP{
+			ID:         1658733801,
+			Mtime:      1489925470960,
+			Guests:     1,
+			Visibility: "public",
+			Response:   "yes",
+			Venue:      rsvps.Venue{ID: 19712922, Name: "Cafe Vitus", Lat: 25.052959, Lon: 121.54731},
+			Member:     rsvps.Member{ID: 120119272, Name: "Allen Wang"},
+			Event:      rsvps.Event{ID: "jkpwmlywgbmb", Name: "Play Intermediate Volleyball", URL: "https://www.meetup.com/e/1", Time: 1491613200000},
+			Group: rsvps.Group{
+				ID:      16585312,
+				Name:    "Taipei Sports and Social Club",
+				Country: "tw",
+				State:   "TP",
+				City:    "Taipei",
+				Lat:     25.02,
+				Lon:     121.45,
+				Urlname: "Taipei-Sports-and-Social-Club",
+				Topics:  []rsvps.GroupTopic{{Urlkey: "fitness", TopicName: "Fitness"}},
+			},
+		}, rsvp)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		v := validRecord()
+		v.Response = "maybe"
+
+		_, err := dec.Decode(context.Background(), encode(t, 1, v))
+
+		field, reason := rsvps.RejectReason(err)
+		require.Equal(t, "response", field)
+		require.Equal(t, rsvps.ReasonNotInEnum, reason)
+	})
+
+	t.Run("no header", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), []byte(`{"rsvp_id": 1}`))
+
+		_, reason := rsvps.RejectReason(err)
+		require.Equal(t, rsvps.ReasonMalformed, reason)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data := encode(t, 1, validRecord())
+
+		_, err := dec.Decode(context.Background(), data[:len(data)/2])
+
+		_, reason := rsvps.RejectReason(err)
+		require.Equal(t, rsvps.ReasonMalformed, reason)
+	})
+
+	t.Run("unknown schema", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), encode(t, 2, validRecord()))
+
+		_, reason := rsvps.RejectReason(err)
+		require.Equal(t, rsvps.ReasonUnknownSchema, reason)
+	})
+
+	t.Run("registry unavailable", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), encode(t, 3, validRecord()))
+		require.True(t, errors.Is(err, avro.ErrSchemaUnavailable))
+	})
+}
@@ -0,0 +1,114 @@
+package avro
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro/v2"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+)
+
+// ErrSchemaUnavailable is returned when a schema could not be fetched from the
+// registry for a reason that may go away, i.e. the registry is down.
+var ErrSchemaUnavailable = errors.New("schema registry unavailable")
+
+// errUnknownSchema is returned when the registry doesn't know the schema id.
+var errUnknownSchema = errors.New("unknown schema")
+
+type RegistryConfig struct {
+	URL string `toml:"url"`
+
+	// Timeout of schema requests, defaultRegistryTimeout if it isn't set.
+	Timeout configtypes.Duration `toml:"timeout"`
+}
+
+const defaultRegistryTimeout = 10 * time.Second
+
+// Registry fetches writer schemas by id from a Confluent compatible schema
+// registry. Schemas are immutable, so they are cached forever once fetched.
+type Registry struct {
+	url    string
+	client *http.Client
+
+	mu      sync.RWMutex
+	schemas map[int]avro.Schema
+}
+
+func NewRegistry(cfg RegistryConfig) *Registry {
+	timeout := cfg.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultRegistryTimeout
+	}
+
+	return &Registry{
+		url:     strings.TrimSuffix(cfg.URL, "/"),
+		client:  &http.Client{Timeout: timeout},
+		schemas: make(map[int]avro.Schema),
+	}
+}
+
+func (r *Registry) Schema(ctx context.Context, id int) (avro.Schema, error) {
+	r.mu.RLock()
+	schema, ok := r.schemas[id]
+	r.mu.RUnlock()
+
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := r.fetch(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.schemas[id] = schema
+	r.mu.Unlock()
+
+	return schema, nil
+}
+
+func (r *Registry) fetch(ctx context.Context, id int) (avro.Schema, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v/schemas/ids/%d", r.url, id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not fetch schema %d: %v", ErrSchemaUnavailable, id, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w %d", errUnknownSchema, id)
+	case resp.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%w: could not fetch schema %d: status %d: %s", ErrSchemaUnavailable, id, resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("%w: could not decode schema %d response: %v", ErrSchemaUnavailable, id, err)
+	}
+
+	// each schema gets its own cache, so that different versions of the same named
+	// record don't clash
+	schema, err := avro.ParseWithCache(payload.Schema, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, fmt.Errorf("%w %d: could not parse schema: %v", errUnknownSchema, id, err)
+	}
+
+	return schema, nil
+}
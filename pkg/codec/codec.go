@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oizgagin/ing/pkg/codec/avro"
+	"github.com/oizgagin/ing/pkg/codec/protobuf"
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+const (
+	JSON     = "json"
+	Avro     = "avro"
+	Protobuf = "protobuf"
+)
+
+// Decoder decodes and validates an RSVP from a payload. Errors are the ones of
+// rsvps.Decode, except for temporary ones (see Temporary) and the context errors.
+type Decoder interface {
+	Decode(ctx context.Context, data []byte) (rsvps.RSVP, error)
+}
+
+// Codec decodes payloads of one format and counts decode errors by reason.
+type Codec struct {
+	name string
+	dec  Decoder
+}
+
+// New creates a codec by name, the registry is only used by the Avro codec.
+func New(name string, registry *avro.Registry) (*Codec, error) {
+	var dec Decoder
+
+	switch name {
+	case "", JSON:
+		name, dec = JSON, jsonDecoder{}
+	case Avro:
+		if registry == nil {
+			return nil, fmt.Errorf("no schema registry for %q codec", name)
+		}
+		dec = avro.NewDecoder(registry)
+	case Protobuf:
+		dec = protobuf.NewDecoder()
+	default:
+		return nil, fmt.Errorf("invalid codec %q, must be in (%q, %q or %q)", name, JSON, Avro, Protobuf)
+	}
+
+	return &Codec{name: name, dec: dec}, nil
+}
+
+func (c *Codec) Name() string {
+	return c.name
+}
+
+// Decode decodes the RSVP. The payload itself is stored along with the RSVP, so
+// that it can be reprocessed with the codec of the same name.
+func (c *Codec) Decode(ctx context.Context, data []byte) (rsvps.RSVP, error) {
+	rsvp, err := c.dec.Decode(ctx, data)
+
+	var decodeErr *rsvps.DecodeError
+	switch {
+	case Temporary(err):
+		codecDecodeErrors(c.name, "schema_unavailable").Inc()
+	case errors.As(err, &decodeErr):
+		codecDecodeErrors(c.name, decodeErr.Reason).Inc()
+	}
+
+	return rsvp, err
+}
+
+// Temporary tells if decoding failed for a reason which may go away, so that
+// the payload should be decoded again later instead of being rejected.
+func Temporary(err error) bool {
+	return errors.Is(err, avro.ErrSchemaUnavailable)
+}
+
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(_ context.Context, data []byte) (rsvps.RSVP, error) {
+	return rsvps.Decode(data)
+}
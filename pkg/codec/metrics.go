@@ -0,0 +1,11 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+func codecDecodeErrors(codec, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`codec_decode_errors_total{codec=%q,reason=%q}`, codec, reason))
+}
@@ -0,0 +1,241 @@
+package protobuf
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// Decoder decodes Protobuf RSVPs described by rsvp.proto. Messages are small
+// and flat, so they are parsed straight from the wire format without generated
+// code; unknown fields are skipped as usual for Protobuf.
+type Decoder struct{}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+func (d *Decoder) Decode(_ context.Context, data []byte) (rsvps.RSVP, error) {
+	var rsvp rsvps.RSVP
+	if err := decodeRSVP(data, &rsvp); err != nil {
+		return rsvps.RSVP{}, err
+	}
+	return rsvp, rsvp.Validate()
+}
+
+func decodeRSVP(b []byte, rsvp *rsvps.RSVP) error {
+	return decodeMessage("", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			rsvp.ID, n, err = int64Field("rsvp_id", typ, b)
+		case 2:
+			rsvp.Mtime, n, err = int64Field("mtime", typ, b)
+		case 3:
+			var guests uint32
+			guests, n, err = uint32Field("guests", typ, b)
+			rsvp.Guests = uint(guests)
+		case 4:
+			rsvp.Visibility, n, err = stringField("visibility", typ, b)
+		case 5:
+			rsvp.Response, n, err = stringField("response", typ, b)
+		case 6:
+			n, err = messageField("venue", typ, b, func(b []byte) error { return decodeVenue(b, &rsvp.Venue) })
+		case 7:
+			n, err = messageField("member", typ, b, func(b []byte) error { return decodeMember(b, &rsvp.Member) })
+		case 8:
+			n, err = messageField("event", typ, b, func(b []byte) error { return decodeEvent(b, &rsvp.Event) })
+		case 9:
+			n, err = messageField("group", typ, b, func(b []byte) error { return decodeGroup(b, &rsvp.Group) })
+		}
+		return n, err
+	})
+}
+
+func decodeVenue(b []byte, venue *rsvps.Venue) error {
+	return decodeMessage("venue", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			venue.ID, n, err = int64Field("venue.venue_id", typ, b)
+		case 2:
+			venue.Name, n, err = stringField("venue.venue_name", typ, b)
+		case 3:
+			venue.Lat, n, err = doubleField("venue.lat", typ, b)
+		case 4:
+			venue.Lon, n, err = doubleField("venue.lon", typ, b)
+		}
+		return n, err
+	})
+}
+
+func decodeMember(b []byte, member *rsvps.Member) error {
+	return decodeMessage("member", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			member.ID, n, err = int64Field("member.member_id", typ, b)
+		case 2:
+			member.Name, n, err = stringField("member.member_name", typ, b)
+		case 3:
+			member.Photo, n, err = stringField("member.photo", typ, b)
+		}
+		return n, err
+	})
+}
+
+func decodeEvent(b []byte, event *rsvps.Event) error {
+	return decodeMessage("event", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			event.ID, n, err = stringField("event.event_id", typ, b)
+		case 2:
+			event.Name, n, err = stringField("event.event_name", typ, b)
+		case 3:
+			event.URL, n, err = stringField("event.event_url", typ, b)
+		case 4:
+			event.Time, n, err = int64Field("event.time", typ, b)
+		}
+		return n, err
+	})
+}
+
+func decodeGroup(b []byte, group *rsvps.Group) error {
+	return decodeMessage("group", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			group.ID, n, err = int64Field("group.group_id", typ, b)
+		case 2:
+			group.Name, n, err = stringField("group.group_name", typ, b)
+		case 3:
+			group.Country, n, err = stringField("group.group_country", typ, b)
+		case 4:
+			group.State, n, err = stringField("group.group_state", typ, b)
+		case 5:
+			group.City, n, err = stringField("group.group_city", typ, b)
+		case 6:
+			group.Lat, n, err = doubleField("group.group_lat", typ, b)
+		case 7:
+			group.Lon, n, err = doubleField("group.group_lon", typ, b)
+		case 8:
+			group.Urlname, n, err = stringField("group.group_urlname", typ, b)
+		case 9:
+			var topic rsvps.GroupTopic
+			n, err = messageField("group.group_topics", typ, b, func(b []byte) error { return decodeGroupTopic(b, &topic) })
+			group.Topics = append(group.Topics, topic)
+		}
+		return n, err
+	})
+}
+
+func decodeGroupTopic(b []byte, topic *rsvps.GroupTopic) error {
+	return decodeMessage("group.group_topics", b, func(num protowire.Number, typ protowire.Type, b []byte) (n int, err error) {
+		switch num {
+		case 1:
+			topic.Urlkey, n, err = stringField("group.group_topics.urlkey", typ, b)
+		case 2:
+			topic.TopicName, n, err = stringField("group.group_topics.topic_name", typ, b)
+		}
+		return n, err
+	})
+}
+
+// fieldFunc decodes the value of a known field and returns the number of bytes
+// consumed, it returns 0 for unknown fields.
+type fieldFunc func(num protowire.Number, typ protowire.Type, b []byte) (int, error)
+
+func decodeMessage(name string, b []byte, field fieldFunc) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return malformed(name, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return malformed(name, protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func int64Field(name string, typ protowire.Type, b []byte) (int64, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, typeMismatch(name, typ)
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, 0, malformed(name, protowire.ParseError(n))
+	}
+	return int64(v), n, nil
+}
+
+func uint32Field(name string, typ protowire.Type, b []byte) (uint32, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, typeMismatch(name, typ)
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, 0, malformed(name, protowire.ParseError(n))
+	}
+	return uint32(v), n, nil
+}
+
+func doubleField(name string, typ protowire.Type, b []byte) (float64, int, error) {
+	if typ != protowire.Fixed64Type {
+		return 0, 0, typeMismatch(name, typ)
+	}
+	v, n := protowire.ConsumeFixed64(b)
+	if n < 0 {
+		return 0, 0, malformed(name, protowire.ParseError(n))
+	}
+	return math.Float64frombits(v), n, nil
+}
+
+func stringField(name string, typ protowire.Type, b []byte) (string, int, error) {
+	v, n, err := bytesField(name, typ, b)
+	return string(v), n, err
+}
+
+func messageField(name string, typ protowire.Type, b []byte, decode func([]byte) error) (int, error) {
+	v, n, err := bytesField(name, typ, b)
+	if err != nil {
+		return 0, err
+	}
+	return n, decode(v)
+}
+
+func bytesField(name string, typ protowire.Type, b []byte) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, typeMismatch(name, typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, 0, malformed(name, protowire.ParseError(n))
+	}
+	return v, n, nil
+}
+
+func typeMismatch(name string, typ protowire.Type) error {
+	return &rsvps.DecodeError{
+		Field:  name,
+		Reason: rsvps.ReasonTypeMismatch,
+		Err:    fmt.Errorf("unexpected wire type %d of field %v", typ, name),
+	}
+}
+
+func malformed(name string, err error) error {
+	if name != "" {
+		err = fmt.Errorf("field %v: %w", name, err)
+	}
+	return &rsvps.DecodeError{Reason: rsvps.ReasonMalformed, Err: err}
+}
@@ -0,0 +1,118 @@
+package protobuf_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/oizgagin/ing/pkg/codec/protobuf"
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+type message []byte
+
+func (m message) varint(num protowire.Number, v int64) message {
+	m = protowire.AppendTag(m, num, protowire.VarintType)
+	return protowire.AppendVarint(m, uint64(v))
+}
+
+func (m message) double(num protowire.Number, v float64) message {
+	m = protowire.AppendTag(m, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(m, math.Float64bits(v))
+}
+
+func (m message) string(num protowire.Number, v string) message {
+	m = protowire.AppendTag(m, num, protowire.BytesType)
+	return protowire.AppendString(m, v)
+}
+
+func (m message) message(num protowire.Number, v message) message {
+	m = protowire.AppendTag(m, num, protowire.BytesType)
+	return protowire.AppendBytes(m, v)
+}
+
+func validMessage(response string) message {
+	return message(nil).
+		varint(1, 1658733801).
+		varint(2, 1489925470960).
+		varint(3, 1).
+		string(4, "public").
+		string(5, response).
+		message(6, message(nil).varint(1, 19712922).string(2, "Cafe Vitus").double(3, 25.052959).double(4, 121.54731)).
+		message(7, message(nil).varint(1, 120119272).string(2, "Allen Wang")).
+		message(8, message(nil).string(1, "jkpwmlywgbmb").string(2, "Play Intermediate Volleyball").varint(4, 1491613200000)).
+		message(9, message(nil).
+			varint(1, 16585312).
+			string(2, "Taipei Sports and Social Club").
+			string(3, "tw").
+			string(5, "Taipei").
+			double(6, 25.02).
+			double(7, 121.45).
+			message(9, message(nil).string(1, "fitness").string(2, "Fitness")).
+			message(9, message(nil).string(1, "sports").string(2, "Sports")))
+}
+
+func TestDecoder_Decode(t *testing.T) {
+	dec := protobuf.NewDecoder()
+
+	t.Run("valid", func(t *testing.T) {
+		rsvp, err := dec.Decode(context.Background(), validMessage("yes"))
+		require.NoError(t, err)
+
+		require.Equal(t, rsvps.RSVP{
+			ID:         1658733801,
+			Mtime:      1489925470960,
+			Guests:     1,
+			Visibility: "public",
+			Response:   "yes",
+			Venue:      rsvps.Venue{ID: 19712922, Name: "Cafe Vitus", Lat: 25.052959, Lon: 121.54731},
+			Member:     rsvps.Member{ID: 120119272, Name: "Allen Wang"},
+			Event:      rsvps.Event{ID: "jkpwmlywgbmb", Name: "Play Intermediate Volleyball", Time: 1491613200000},
+			Group: rsvps.Group{
+				ID:      16585312,
+				Name:    "Taipei Sports and Social Club",
+				Country: "tw",
+				City:    "Taipei",
+				Lat:     25.02,
+				Lon:     121.45,
+				Topics: []rsvps.GroupTopic{
+					{Urlkey: "fitness", TopicName: "Fitness"},
+					{Urlkey: "sports", TopicName: "Sports"},
+				},
+			},
+		}, rsvp)
+	})
+
+	t.Run("unknown fields are skipped", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), validMessage("yes").string(100, "new field").varint(101, 1))
+		require.NoError(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), validMessage("maybe"))
+
+		field, reason := rsvps.RejectReason(err)
+		require.Equal(t, "response", field)
+		require.Equal(t, rsvps.ReasonNotInEnum, reason)
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		_, err := dec.Decode(context.Background(), validMessage("yes").message(9, message(nil).string(1, "16585312")))
+
+		field, reason := rsvps.RejectReason(err)
+		require.Equal(t, "group.group_id", field)
+		require.Equal(t, rsvps.ReasonTypeMismatch, reason)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data := validMessage("yes")
+
+		_, err := dec.Decode(context.Background(), data[:len(data)-3])
+
+		_, reason := rsvps.RejectReason(err)
+		require.Equal(t, rsvps.ReasonMalformed, reason)
+	})
+}
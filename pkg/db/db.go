@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/oizgagin/ing/pkg/rsvps"
@@ -10,15 +11,135 @@ import (
 
 //go:generate mockery --name DB
 type DB interface {
-	SaveRSVP(ctx context.Context, rsvp rsvps.RSVP) error
-	TopkEvents(ctx context.Context, date time.Time, k uint) ([]TopkEvent, error)
-	GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo, error)
+	SaveRSVP(ctx context.Context, record Record) error
+	SaveRSVPs(ctx context.Context, records []Record) error
+
+	TopkEvents(ctx context.Context, q TopkQuery) ([]TopkEvent, error)
+
+	// EventConflicts returns at most limit events of the source (of all sources if
+	// it's empty) whose info, or info of their venue or group, changed across
+	// rsvps, the most recently changed first.
+	EventConflicts(ctx context.Context, source string, limit uint) ([]EventConflict, error)
+
+	// GetEventInfo returns info of the event of the source; if the source is
+	// empty, the event id has to be unique among all sources.
+	GetEventInfo(ctx context.Context, source, eventID string) (rsvps.EventInfo, error)
+
+	// Ping checks that the database is reachable.
+	Ping(ctx context.Context) error
+
 	Close() error
 }
 
+// Record is an RSVP together with the payload it was decoded from and the stream
+// position it was read at. The payload is stored as is, if it is not empty.
+type Record struct {
+	RSVP   rsvps.RSVP
+	Raw    []byte
+	Codec  string // the codec of Raw, JSON if it's empty
+	Origin rsvps.Origin
+}
+
+// TopkQuery selects the K events with the most confirmed rsvps given from From to
+// To (calendar dates of Location, UTC if it's nil, both inclusive) among events of
+// the source, or of all sources if the source is empty.
+type TopkQuery struct {
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+	K        uint
+	Source   string
+
+	// Filters keeps only events whose group has the given dimension values
+	// (countries are compared case-insensitively, topics by urlkey).
+	Filters map[Dimension]string
+
+	// RankBy is the counter events are ranked by, confirmed rsvps if it's empty.
+	RankBy RankBy
+
+	// GroupBy ranks events separately for every combination of values of the
+	// dimensions, K events each. An event is ranked under each of its group topics.
+	GroupBy []Dimension
+}
+
+// Dimension is an attribute of the group of an event which top k can be filtered
+// and broken down by.
+type Dimension string
+
+const (
+	DimensionCountry Dimension = "country"
+	DimensionState   Dimension = "state"
+	DimensionCity    Dimension = "city"
+	DimensionGroupID Dimension = "group_id"
+	DimensionTopic   Dimension = "topic"
+)
+
+var Dimensions = []Dimension{DimensionCountry, DimensionState, DimensionCity, DimensionGroupID, DimensionTopic}
+
+func ValidateDimension(dim Dimension) error {
+	for _, valid := range Dimensions {
+		if dim == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid dimension %q", dim)
+}
+
+// RankBy is a counter of events top k is ranked by.
+type RankBy string
+
+const (
+	// RankByRSVPs ranks by confirmed rsvps.
+	RankByRSVPs RankBy = "rsvps"
+
+	// RankByHeadcount ranks by expected headcount, confirmed rsvps together with
+	// their guests.
+	RankByHeadcount RankBy = "headcount"
+)
+
+func ValidateRankBy(rankBy RankBy) error {
+	if rankBy != RankByRSVPs && rankBy != RankByHeadcount {
+		return fmt.Errorf("invalid rank by %q, must be in (%q or %q)", rankBy, RankByRSVPs, RankByHeadcount)
+	}
+	return nil
+}
+
 type TopkEvent struct {
+	Source         string
 	Event          rsvps.Event
 	ConfirmedRSVPs int
+	Headcount      int
+
+	// Dimensions holds values of the GroupBy dimensions of the query the event is
+	// ranked under.
+	Dimensions map[Dimension]string `json:",omitempty"`
+}
+
+// EventConflict is an event whose details disagreed across rsvps; versions count
+// how many different infos of the event, its venue and its group were seen, the
+// latest one of each is current.
+type EventConflict struct {
+	Source        string
+	Event         rsvps.Event
+	EventVersions int
+	VenueVersions int
+	GroupVersions int
+
+	// LastChanged is the mtime of the rsvp which carried the latest change.
+	LastChanged time.Time
 }
 
-var ErrNoEvents = errors.New("no events in result set")
+var (
+	ErrNoEvents       = errors.New("no events in result set")
+	ErrAmbiguousEvent = errors.New("event id is not unique among sources")
+
+	// ErrPermanent is wrapped by save errors which won't go away if the save is
+	// retried, i.e. constraint violations or invalid data. Other save errors (lost
+	// connections, serialization failures, deadlocks, timeouts) are transient.
+	ErrPermanent = errors.New("permanent error")
+
+	// ErrStaleOffset is returned by saves of messages which offsets were already
+	// stored by another consumer of the group, i.e. after a rebalance. Nothing is
+	// saved then.
+	ErrStaleOffset = errors.New("stale consumer offset")
+)
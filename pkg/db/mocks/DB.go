@@ -9,8 +9,6 @@ import (
 	mock "github.com/stretchr/testify/mock"
 
 	rsvps "github.com/oizgagin/ing/pkg/rsvps"
-
-	time "time"
 )
 
 // DB is an autogenerated mock type for the DB type
@@ -32,23 +30,49 @@ func (_m *DB) Close() error {
 	return r0
 }
 
-// GetEventInfo provides a mock function with given fields: ctx, eventID
-func (_m *DB) GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo, error) {
-	ret := _m.Called(ctx, eventID)
+// EventConflicts provides a mock function with given fields: ctx, source, limit
+func (_m *DB) EventConflicts(ctx context.Context, source string, limit uint) ([]db.EventConflict, error) {
+	ret := _m.Called(ctx, source, limit)
+
+	var r0 []db.EventConflict
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint) ([]db.EventConflict, error)); ok {
+		return rf(ctx, source, limit)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint) []db.EventConflict); ok {
+		r0 = rf(ctx, source, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]db.EventConflict)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint) error); ok {
+		r1 = rf(ctx, source, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetEventInfo provides a mock function with given fields: ctx, source, eventID
+func (_m *DB) GetEventInfo(ctx context.Context, source string, eventID string) (rsvps.EventInfo, error) {
+	ret := _m.Called(ctx, source, eventID)
 
 	var r0 rsvps.EventInfo
 	var r1 error
-	if rf, ok := ret.Get(0).(func(context.Context, string) (rsvps.EventInfo, error)); ok {
-		return rf(ctx, eventID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) (rsvps.EventInfo, error)); ok {
+		return rf(ctx, source, eventID)
 	}
-	if rf, ok := ret.Get(0).(func(context.Context, string) rsvps.EventInfo); ok {
-		r0 = rf(ctx, eventID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) rsvps.EventInfo); ok {
+		r0 = rf(ctx, source, eventID)
 	} else {
 		r0 = ret.Get(0).(rsvps.EventInfo)
 	}
 
-	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
-		r1 = rf(ctx, eventID)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, source, eventID)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -56,13 +80,41 @@ func (_m *DB) GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo
 	return r0, r1
 }
 
-// SaveRSVP provides a mock function with given fields: ctx, rsvp
-func (_m *DB) SaveRSVP(ctx context.Context, rsvp rsvps.RSVP) error {
-	ret := _m.Called(ctx, rsvp)
+// Ping provides a mock function with given fields: ctx
+func (_m *DB) Ping(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveRSVP provides a mock function with given fields: ctx, record
+func (_m *DB) SaveRSVP(ctx context.Context, record db.Record) error {
+	ret := _m.Called(ctx, record)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, db.Record) error); ok {
+		r0 = rf(ctx, record)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveRSVPs provides a mock function with given fields: ctx, records
+func (_m *DB) SaveRSVPs(ctx context.Context, records []db.Record) error {
+	ret := _m.Called(ctx, records)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, rsvps.RSVP) error); ok {
-		r0 = rf(ctx, rsvp)
+	if rf, ok := ret.Get(0).(func(context.Context, []db.Record) error); ok {
+		r0 = rf(ctx, records)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -70,25 +122,25 @@ func (_m *DB) SaveRSVP(ctx context.Context, rsvp rsvps.RSVP) error {
 	return r0
 }
 
-// TopkEvents provides a mock function with given fields: ctx, date, k
-func (_m *DB) TopkEvents(ctx context.Context, date time.Time, k uint) ([]db.TopkEvent, error) {
-	ret := _m.Called(ctx, date, k)
+// TopkEvents provides a mock function with given fields: ctx, q
+func (_m *DB) TopkEvents(ctx context.Context, q db.TopkQuery) ([]db.TopkEvent, error) {
+	ret := _m.Called(ctx, q)
 
 	var r0 []db.TopkEvent
 	var r1 error
-	if rf, ok := ret.Get(0).(func(context.Context, time.Time, uint) ([]db.TopkEvent, error)); ok {
-		return rf(ctx, date, k)
+	if rf, ok := ret.Get(0).(func(context.Context, db.TopkQuery) ([]db.TopkEvent, error)); ok {
+		return rf(ctx, q)
 	}
-	if rf, ok := ret.Get(0).(func(context.Context, time.Time, uint) []db.TopkEvent); ok {
-		r0 = rf(ctx, date, k)
+	if rf, ok := ret.Get(0).(func(context.Context, db.TopkQuery) []db.TopkEvent); ok {
+		r0 = rf(ctx, q)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]db.TopkEvent)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(context.Context, time.Time, uint) error); ok {
-		r1 = rf(ctx, date, k)
+	if rf, ok := ret.Get(1).(func(context.Context, db.TopkQuery) error); ok {
+		r1 = rf(ctx, q)
 	} else {
 		r1 = ret.Error(1)
 	}
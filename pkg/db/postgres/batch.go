@@ -0,0 +1,497 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype/zeronull"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+var stagingColumns = []string{
+	"seq", "source",
+	"venue_id", "venue_name", "venue_lat", "venue_lon",
+	"group_id", "group_country", "group_state", "group_city", "group_name", "group_lat", "group_lon", "group_urlname", "group_topics",
+	"member_id", "member_name", "member_photo",
+	"event_id", "event_name", "event_time", "event_url",
+	"rsvp_id", "rsvp_mtime", "rsvp_guests", "rsvp_response", "rsvp_visibility", "rsvp_attrs",
+	"payload", "payload_codec", "topic", "partition_id", "message_offset", "received_at",
+}
+
+// SaveRSVPs saves the whole batch in a single transaction: records are copied into
+// a session-local staging table and then upserted with set-based statements. The
+// result is the same as saving records one by one with SaveRSVP.
+func (db *DB) SaveRSVPs(ctx context.Context, records []dbpkg.Record) error {
+	return classify(db.saveRecords(ctx, records))
+}
+
+func (db *DB) saveRecords(ctx context.Context, records []dbpkg.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := db.ensurePartitions(ctx, db.pool, recordMtimes(records)...); err != nil {
+		return err
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := stage(ctx, tx, records); err != nil {
+		return err
+	}
+
+	if err := upsertStaged(ctx, tx, db.slots); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO
+			rsvp_payloads (source, rsvp_id, mtime, payload, codec, topic, partition_id, message_offset, received_at)
+		SELECT DISTINCT ON (source, rsvp_id, rsvp_mtime)
+			source, rsvp_id, rsvp_mtime, payload, payload_codec, topic, partition_id, message_offset, received_at
+		FROM
+			rsvps_staging
+		WHERE
+			payload IS NOT NULL
+		ORDER BY
+			source, rsvp_id, rsvp_mtime, seq
+		ON CONFLICT (source, rsvp_id, mtime) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("could not save rsvp payloads: %w", err)
+	}
+
+	var (
+		offsets = partitionOffsets(records)
+		stmts   = make([]statement, 0, len(offsets))
+		saved   = make([]int, len(offsets))
+	)
+	for i, offset := range offsets {
+		stmts = append(stmts, consumerOffsetStatement(offset.last, offset.first, &saved[i]))
+	}
+	if err := sendBatch(ctx, tx, stmts); err != nil {
+		return err
+	}
+
+	// a part of the batch was already saved by another consumer
+	for i, offset := range offsets {
+		if saved[i] == 0 {
+			return staleOffset(offset.last)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit rsvps: %w", err)
+	}
+
+	return nil
+}
+
+// stage replaces the contents of the session-local staging table with records.
+func stage(ctx context.Context, tx pgx.Tx, records []dbpkg.Record) error {
+	_, err := tx.Exec(ctx, `
+		CREATE TEMPORARY TABLE IF NOT EXISTS rsvps_staging (
+			seq INT NOT NULL,
+			source VARCHAR(50) NOT NULL,
+
+			venue_id BIGINT NOT NULL,
+			venue_name TEXT NOT NULL,
+			venue_lat REAL NOT NULL,
+			venue_lon REAL NOT NULL,
+
+			group_id BIGINT NOT NULL,
+			group_country VARCHAR(2) NOT NULL,
+			group_state VARCHAR(2) NULL,
+			group_city VARCHAR(100) NOT NULL,
+			group_name TEXT NOT NULL,
+			group_lat REAL NOT NULL,
+			group_lon REAL NOT NULL,
+			group_urlname TEXT NOT NULL,
+			group_topics JSONB NOT NULL,
+
+			member_id BIGINT NOT NULL,
+			member_name TEXT NOT NULL,
+			member_photo TEXT NOT NULL,
+
+			event_id VARCHAR(100) NOT NULL,
+			event_name TEXT NOT NULL,
+			event_time TIMESTAMP NOT NULL,
+			event_url TEXT NOT NULL,
+
+			rsvp_id BIGINT NOT NULL,
+			rsvp_mtime TIMESTAMP NOT NULL,
+			rsvp_guests INT NOT NULL,
+			rsvp_response BOOLEAN NOT NULL,
+			rsvp_visibility TEXT NOT NULL,
+			rsvp_attrs JSONB NOT NULL,
+
+			payload BYTEA NULL,
+			payload_codec TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			partition_id INT NOT NULL,
+			message_offset BIGINT NOT NULL,
+			received_at TIMESTAMP NOT NULL
+		) ON COMMIT DELETE ROWS
+	`)
+	if err != nil {
+		return fmt.Errorf("could not create staging table: %w", err)
+	}
+
+	// a transaction may stage several batches
+	if _, err := tx.Exec(ctx, `TRUNCATE rsvps_staging`); err != nil {
+		return fmt.Errorf("could not truncate staging table: %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"rsvps_staging"}, stagingColumns, pgx.CopyFromSlice(len(records), func(i int) ([]any, error) {
+		var (
+			rsvp    = records[i].RSVP
+			origin  = records[i].Origin
+			payload []byte
+		)
+		if len(records[i].Raw) > 0 {
+			payload = records[i].Raw
+		}
+
+		return []any{
+			i, recordSource(rsvp),
+			rsvp.Venue.ID, rsvp.Venue.Name, rsvp.Venue.Lat, rsvp.Venue.Lon,
+			rsvp.Group.ID, rsvp.Group.Country, zeronull.Text(rsvp.Group.State), rsvp.Group.City, rsvp.Group.Name, rsvp.Group.Lat, rsvp.Group.Lon, rsvp.Group.Urlname, rsvp.Group.Topics,
+			rsvp.Member.ID, rsvp.Member.Name, rsvp.Member.Photo,
+			rsvp.Event.ID, rsvp.Event.Name, time.UnixMilli(rsvp.Event.Time).UTC(), rsvp.Event.URL,
+			rsvp.ID, time.UnixMilli(rsvp.Mtime).UTC(), rsvp.Guests, rsvp.Response == "yes", rsvp.Visibility, rsvpAttrs(rsvp),
+			payload, recordCodec(records[i]), origin.Topic, origin.Partition, origin.Offset, receivedAt(origin),
+		}, nil
+	}))
+	if err != nil {
+		return fmt.Errorf("could not copy rsvps: %w", err)
+	}
+
+	return nil
+}
+
+// upsertStaged saves staged rsvps with the same result as if they were saved one by
+// one with SaveRSVP.
+func upsertStaged(ctx context.Context, tx pgx.Tx, slots counterSlots) error {
+	// venues, groups and events get the info of the latest rsvp of the batch if it's
+	// newer than the stored one, as with SaveRSVP (info of earlier rsvps of the batch
+	// isn't versioned); the first seen member info wins, as well as the member who
+	// created the event. Rows are inserted in key
+	// order to avoid deadlocks between concurrent batches
+
+	for _, versioned := range []struct {
+		name, table, id string
+		columns         []string
+		staged          []string
+	}{
+		{
+			name: "venue", table: "venues", id: "venue_id",
+			columns: []string{"name", "lat", "lon"},
+			staged:  []string{"venue_name", "venue_lat", "venue_lon"},
+		},
+		{
+			name: "group", table: "groups", id: "group_id",
+			columns: []string{"country", "state", "city", "name", "lat", "lon", "urlname", "topics"},
+			staged:  []string{"group_country", "group_state", "group_city", "group_name", "group_lat", "group_lon", "group_urlname", "group_topics"},
+		},
+	} {
+		if err := upsertStagedVersioned(ctx, tx, versioned.name, versioned.table, versioned.id, versioned.columns, versioned.staged, nil); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(ctx, `
+		INSERT INTO
+			members (source, id, name, photo)
+		SELECT DISTINCT ON (source, member_id)
+			source, member_id, member_name, member_photo
+		FROM
+			rsvps_staging
+		ORDER BY
+			source, member_id, seq
+		ON CONFLICT (source, id) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("could not insert members: %w", err)
+	}
+
+	err = upsertStagedVersioned(ctx, tx, "event", "events", "event_id",
+		[]string{"name", "time", "url", "venue_id", "group_id"},
+		[]string{"event_name", "event_time", "event_url", "venue_id", "group_id"},
+		[]string{"member_id"},
+	)
+	if err != nil {
+		return err
+	}
+
+	// only the latest version of each rsvp in the batch matters, earlier ones would be
+	// overwritten anyway; rsvps are locked in key order as by SaveRSVP, new rsvps are
+	// inserted first, and then the stored ones are updated, both statements adjusting
+	// daily and hourly counters by the aggregated deltas
+
+	_, err = tx.Exec(ctx, `
+		SELECT
+			`+rsvpLockSQL("source", "rsvp_id")+`
+		FROM (
+			SELECT DISTINCT
+				source, rsvp_id
+			FROM
+				rsvps_staging
+			ORDER BY
+				source, rsvp_id
+		) AS staged
+	`)
+	if err != nil {
+		return fmt.Errorf("could not lock rsvps: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		WITH latest AS (
+			SELECT DISTINCT ON (source, rsvp_id)
+				source, rsvp_id, rsvp_mtime, rsvp_guests, rsvp_response, rsvp_visibility, rsvp_attrs, event_id
+			FROM
+				rsvps_staging
+			ORDER BY
+				source, rsvp_id, rsvp_mtime DESC, seq DESC
+		), inserted AS (
+			INSERT INTO
+				rsvps (source, id, mtime, guests, response, visibility, event_id, attrs)
+			SELECT
+				source, rsvp_id, rsvp_mtime, rsvp_guests, rsvp_response, rsvp_visibility::rsvp_visibility, event_id, rsvp_attrs
+			FROM
+				latest
+			WHERE
+				NOT EXISTS (SELECT FROM rsvps WHERE rsvps.source = latest.source AND rsvps.id = latest.rsvp_id)
+			ORDER BY
+				source, rsvp_id
+			RETURNING
+				source, id, mtime, guests, response, event_id
+		), hourly AS (
+			INSERT INTO
+				event_counters_hourly (rsvp_hour, source, event_id, slot, confirmed_rsvps, headcount)
+			SELECT
+				date_trunc('hour', mtime), source, event_id, `+slotSQL("id", 1, 2)+`, COUNT(*), SUM(1 + guests)
+			FROM
+				inserted
+			WHERE
+				response
+			GROUP BY
+				1, 2, 3, 4
+			ORDER BY
+				1, 2, 3, 4
+			ON CONFLICT (rsvp_hour, source, event_id, slot) DO UPDATE
+				SET
+					confirmed_rsvps = event_counters_hourly.confirmed_rsvps + EXCLUDED.confirmed_rsvps,
+					headcount = event_counters_hourly.headcount + EXCLUDED.headcount
+		)
+		INSERT INTO
+			event_counters (rsvp_date, source, event_id, slot, confirmed_rsvps, headcount)
+		SELECT
+			mtime::date, source, event_id, `+slotSQL("id", 1, 2)+`, COUNT(*), SUM(1 + guests)
+		FROM
+			inserted
+		WHERE
+			response
+		GROUP BY
+			1, 2, 3, 4
+		ORDER BY
+			1, 2, 3, 4
+		ON CONFLICT (rsvp_date, source, event_id, slot) DO UPDATE
+			SET
+				confirmed_rsvps = event_counters.confirmed_rsvps + EXCLUDED.confirmed_rsvps,
+				headcount = event_counters.headcount + EXCLUDED.headcount
+	`, slots.n, slots.byRSVPID)
+	if err != nil {
+		return fmt.Errorf("could not insert rsvps: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		WITH latest AS (
+			SELECT DISTINCT ON (source, rsvp_id)
+				source, rsvp_id, rsvp_mtime, rsvp_guests, rsvp_response, rsvp_visibility, rsvp_attrs, event_id
+			FROM
+				rsvps_staging
+			ORDER BY
+				source, rsvp_id, rsvp_mtime DESC, seq DESC
+		), prev AS (
+			SELECT
+				rsvps.source, rsvps.id, rsvps.mtime, rsvps.guests, rsvps.response, rsvps.event_id
+			FROM
+				rsvps INNER JOIN latest ON rsvps.source = latest.source AND rsvps.id = latest.rsvp_id
+			WHERE
+				rsvps.mtime < latest.rsvp_mtime
+			ORDER BY
+				rsvps.source, rsvps.id
+			FOR UPDATE OF rsvps
+		), updated AS (
+			UPDATE
+				rsvps
+			SET
+				mtime = latest.rsvp_mtime,
+				guests = latest.rsvp_guests,
+				response = latest.rsvp_response,
+				visibility = latest.rsvp_visibility::rsvp_visibility,
+				event_id = latest.event_id,
+				attrs = latest.rsvp_attrs
+			FROM
+				latest, prev
+			WHERE
+				rsvps.source = latest.source AND rsvps.id = latest.rsvp_id AND rsvps.source = prev.source AND rsvps.id = prev.id
+			RETURNING
+				prev.mtime AS prev_mtime, prev.guests AS prev_guests, prev.response AS prev_response, prev.event_id AS prev_event_id,
+				rsvps.source, rsvps.id, rsvps.mtime, rsvps.guests, rsvps.response, rsvps.event_id
+		), deltas AS (
+			SELECT date_trunc('hour', prev_mtime) AS rsvp_hour, source, prev_event_id AS event_id, `+slotSQL("id", 1, 2)+` AS slot, -1 AS delta, -(1 + prev_guests) AS headcount FROM updated WHERE prev_response
+			UNION ALL
+			SELECT date_trunc('hour', mtime) AS rsvp_hour, source, event_id, `+slotSQL("id", 1, 2)+` AS slot, 1 AS delta, 1 + guests AS headcount FROM updated WHERE response
+		), hourly AS (
+			INSERT INTO
+				event_counters_hourly (rsvp_hour, source, event_id, slot, confirmed_rsvps, headcount)
+			SELECT
+				rsvp_hour, source, event_id, slot, SUM(delta), SUM(headcount)
+			FROM
+				deltas
+			GROUP BY
+				rsvp_hour, source, event_id, slot
+			HAVING
+				SUM(delta) <> 0 OR SUM(headcount) <> 0
+			ORDER BY
+				rsvp_hour, source, event_id, slot
+			ON CONFLICT (rsvp_hour, source, event_id, slot) DO UPDATE
+				SET
+					confirmed_rsvps = event_counters_hourly.confirmed_rsvps + EXCLUDED.confirmed_rsvps,
+					headcount = event_counters_hourly.headcount + EXCLUDED.headcount
+		)
+		INSERT INTO
+			event_counters (rsvp_date, source, event_id, slot, confirmed_rsvps, headcount)
+		SELECT
+			rsvp_hour::date, source, event_id, slot, SUM(delta), SUM(headcount)
+		FROM
+			deltas
+		GROUP BY
+			rsvp_hour::date, source, event_id, slot
+		HAVING
+			SUM(delta) <> 0 OR SUM(headcount) <> 0
+		ORDER BY
+			rsvp_hour::date, source, event_id, slot
+		ON CONFLICT (rsvp_date, source, event_id, slot) DO UPDATE
+			SET
+				confirmed_rsvps = event_counters.confirmed_rsvps + EXCLUDED.confirmed_rsvps,
+				headcount = event_counters.headcount + EXCLUDED.headcount
+	`, slots.n, slots.byRSVPID)
+	if err != nil {
+		return fmt.Errorf("could not update rsvps: %w", err)
+	}
+
+	return nil
+}
+
+// upsertStagedVersioned upserts the staged rows of the dimension like
+// versionedUpsert, staged columns are the counterparts of the columns, fixed columns
+// are staged under the same names.
+func upsertStagedVersioned(ctx context.Context, tx pgx.Tx, name, table, id string, columns, staged, fixed []string) error {
+	var (
+		inserted = append(append([]string{}, columns...), fixed...)
+		selected = append(append([]string{}, staged...), fixed...)
+		updates  []string
+		excluded []string
+	)
+	for _, column := range columns {
+		updates = append(updates, column+" = EXCLUDED."+column)
+		excluded = append(excluded, "EXCLUDED."+column)
+	}
+	updates = append(updates, "mtime = EXCLUDED.mtime")
+
+	var changed int
+
+	err := tx.QueryRow(ctx, `
+		WITH upserted AS (
+			INSERT INTO
+				`+table+` (source, id, `+strings.Join(inserted, ", ")+`, mtime)
+			SELECT DISTINCT ON (source, `+id+`)
+				source, `+id+`, `+strings.Join(selected, ", ")+`, rsvp_mtime
+			FROM
+				rsvps_staging
+			ORDER BY
+				source, `+id+`, rsvp_mtime DESC, seq DESC
+			ON CONFLICT (source, id) DO UPDATE
+				SET `+strings.Join(updates, ", ")+`
+				WHERE `+table+`.mtime < EXCLUDED.mtime
+					AND (`+strings.Join(columns, ", ")+`) IS DISTINCT FROM (`+strings.Join(excluded, ", ")+`)
+			RETURNING
+				versions > 1 AND changed_at = mtime AS changed
+		)
+		SELECT COUNT(*) FILTER (WHERE changed) FROM upserted
+	`).Scan(&changed)
+	if err != nil {
+		return fmt.Errorf("could not upsert %v: %w", table, err)
+	}
+
+	if changed > 0 {
+		pgDimensionConflicts(name).Add(changed)
+	}
+	return nil
+}
+
+func recordMtimes(records []dbpkg.Record) []time.Time {
+	mtimes := make([]time.Time, 0, len(records))
+	for _, record := range records {
+		mtimes = append(mtimes, time.UnixMilli(record.RSVP.Mtime))
+	}
+	return mtimes
+}
+
+// offsetRange is the range of offsets of a partition the batch was read from.
+type offsetRange struct {
+	first int64
+	last  rsvps.Origin
+}
+
+// partitionOffsets returns the offset range of every partition which offsets are
+// stored in the db.
+func partitionOffsets(records []dbpkg.Record) []offsetRange {
+	type partition struct {
+		group, topic string
+		partition    int
+	}
+
+	var (
+		order  = []partition{}
+		ranges = make(map[partition]offsetRange)
+	)
+	for _, record := range records {
+		origin := record.Origin
+		if origin.ConsumerGroup == "" {
+			continue
+		}
+
+		p := partition{group: origin.ConsumerGroup, topic: origin.Topic, partition: origin.Partition}
+
+		r, ok := ranges[p]
+		if !ok {
+			order = append(order, p)
+			r = offsetRange{first: origin.Offset, last: origin}
+		}
+		if origin.Offset < r.first {
+			r.first = origin.Offset
+		}
+		if origin.Offset > r.last.Offset {
+			r.last = origin
+		}
+		ranges[p] = r
+	}
+
+	offsets := make([]offsetRange, 0, len(order))
+	for _, p := range order {
+		offsets = append(offsets, ranges[p])
+	}
+	return offsets
+}
@@ -0,0 +1,159 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	// CounterSlotRandom spreads counter updates over slots randomly.
+	CounterSlotRandom = "random"
+
+	// CounterSlotByRSVPID updates every rsvp in the same slot, so that slots never go
+	// negative until they are compacted.
+	CounterSlotByRSVPID = "rsvp_id"
+)
+
+// counterSlots picks the event_counters slot an update goes to.
+type counterSlots struct {
+	n        int
+	byRSVPID bool
+}
+
+func newCounterSlots(cfg Config) (counterSlots, error) {
+	if cfg.CounterSlots < 0 {
+		return counterSlots{}, fmt.Errorf("invalid counter slots %v, must not be negative", cfg.CounterSlots)
+	}
+
+	slots := counterSlots{n: cfg.CounterSlots}
+	if slots.n == 0 {
+		slots.n = 1
+	}
+
+	switch cfg.CounterSlotBy {
+	case "", CounterSlotRandom:
+	case CounterSlotByRSVPID:
+		slots.byRSVPID = true
+	default:
+		return counterSlots{}, fmt.Errorf("invalid counter slot by %q, must be in (%q or %q)", cfg.CounterSlotBy, CounterSlotRandom, CounterSlotByRSVPID)
+	}
+
+	return slots, nil
+}
+
+func (s counterSlots) slot(rsvpID int64) int {
+	switch {
+	case s.n <= 1:
+		return 0
+	case s.byRSVPID:
+		if rsvpID < 0 {
+			rsvpID = -rsvpID
+		}
+		return int(rsvpID % int64(s.n))
+	}
+	return rand.Intn(s.n)
+}
+
+// slotSQL is the SQL counterpart of slot for the rsvp id column, its parameters
+// are the number of slots and whether slots are picked by rsvp id.
+func slotSQL(column string, nParam, byRSVPIDParam int) string {
+	return fmt.Sprintf(
+		"(CASE WHEN $%[3]d THEN abs(%[1]s) %% $%[2]d::int ELSE floor(random() * $%[2]d::int) END)::smallint",
+		column, nParam, byRSVPIDParam,
+	)
+}
+
+// compactCounters periodically folds counter slots of past days into slot 0, so that
+// readers sum over fewer rows. Counters of the current day are left alone, since
+// they are the ones being updated.
+func (db *DB) compactCounters(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			folded, err := db.CompactCounters(ctx, rsvpDate(time.Now()))
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				db.l.Error("could not compact counters", zap.Error(err))
+				pgCounterCompactionErrors.Inc()
+				continue
+			}
+			pgCounterCompactedSlots.Add(folded)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CompactCounters folds daily and hourly counter slots of days before the date into
+// slot 0 and returns how many slot rows were folded.
+func (db *DB) CompactCounters(ctx context.Context, before time.Time) (int, error) {
+	var folded int
+
+	before = before.UTC().Truncate(24 * time.Hour)
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		for _, counters := range []struct{ table, column string }{
+			{table: "event_counters", column: "rsvp_date"},
+			{table: "event_counters_hourly", column: "rsvp_hour"},
+		} {
+			n, err := compactSlots(ctx, tx, counters.table, counters.column, before)
+			if err != nil {
+				return err
+			}
+			folded += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not compact counters: %w", err)
+	}
+
+	return folded, nil
+}
+
+func compactSlots(ctx context.Context, tx pgx.Tx, table, column string, before time.Time) (int, error) {
+	var folded int
+
+	err := tx.QueryRow(ctx, `
+		WITH folded AS (
+			DELETE FROM
+				`+table+`
+			WHERE
+				`+column+` < $1 AND slot <> 0
+			RETURNING
+				`+column+`, source, event_id, confirmed_rsvps, headcount
+		), inserted AS (
+			INSERT INTO
+				`+table+` (`+column+`, source, event_id, slot, confirmed_rsvps, headcount)
+			SELECT
+				`+column+`, source, event_id, 0, SUM(confirmed_rsvps), SUM(headcount)
+			FROM
+				folded
+			GROUP BY
+				`+column+`, source, event_id
+			ORDER BY
+				`+column+`, source, event_id
+			ON CONFLICT (`+column+`, source, event_id, slot) DO UPDATE
+				SET
+					confirmed_rsvps = `+table+`.confirmed_rsvps + EXCLUDED.confirmed_rsvps,
+					headcount = `+table+`.headcount + EXCLUDED.headcount
+		)
+		SELECT COUNT(*) FROM folded
+	`, before).Scan(&folded)
+	if err != nil {
+		return 0, fmt.Errorf("could not compact %v: %w", table, err)
+	}
+
+	return folded, nil
+}
@@ -0,0 +1,44 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterSlots(t *testing.T) {
+	slots, err := newCounterSlots(Config{})
+	require.NoError(t, err)
+	for id := int64(0); id < 10; id++ {
+		require.Zero(t, slots.slot(id), "not sharded")
+	}
+
+	slots, err = newCounterSlots(Config{CounterSlots: 4, CounterSlotBy: CounterSlotByRSVPID})
+	require.NoError(t, err)
+	require.Equal(t, 3, slots.slot(7))
+	require.Equal(t, 3, slots.slot(-7))
+	require.Equal(t, slots.slot(1001), slots.slot(1001))
+
+	slots, err = newCounterSlots(Config{CounterSlots: 4})
+	require.NoError(t, err)
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		slot := slots.slot(1001)
+		require.True(t, slot >= 0 && slot < 4, slot)
+		seen[slot] = true
+	}
+	require.Len(t, seen, 4)
+
+	_, err = newCounterSlots(Config{CounterSlots: -1})
+	require.Error(t, err)
+
+	_, err = newCounterSlots(Config{CounterSlots: 4, CounterSlotBy: "event_id"})
+	require.Error(t, err)
+}
+
+func TestSlotSQL(t *testing.T) {
+	require.Equal(t,
+		"(CASE WHEN $2 THEN abs(id) % $1::int ELSE floor(random() * $1::int) END)::smallint",
+		slotSQL("id", 1, 2),
+	)
+}
@@ -0,0 +1,191 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype/zeronull"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// statement is a query with its arguments, so that it can be either executed on
+// its own or queued into a batch.
+type statement struct {
+	name string
+	sql  string
+	args []any
+
+	// dest receives the single row returned by the statement, if it's set
+	dest []any
+}
+
+// dimension is the upsert of a dimension row of an rsvp, identified by its key and
+// the hash of its contents in the seen set.
+type dimension struct {
+	statement
+
+	key  string
+	hash uint64
+
+	// current is how many rows hold the info of the rsvp after a versioned upsert,
+	// it's 0 if the stored row comes from a newer rsvp with other info, and changed
+	// is how many rows had their info changed
+	current *int
+	changed *int
+}
+
+func newDimension(name, table, source string, id any, sql string, args ...any) dimension {
+	return dimension{
+		statement: statement{name: name, sql: sql, args: args},
+		key:       dimensionKey(table, source, id),
+		hash:      contentHash(args...),
+	}
+}
+
+// newVersionedDimension is a dimension which keeps the info of the latest rsvp, see
+// versionedUpsert. The mtime of the rsvp isn't hashed, so that the same info
+// carried by newer rsvps is still skipped; fixed columns aren't hashed either, as
+// they are never updated.
+func newVersionedDimension(name, table, source string, id any, mtime time.Time, columns, fixed []string, args ...any) dimension {
+	dim := newDimension(name, table, source, id, versionedUpsert(table, columns, fixed), args[:len(args)-len(fixed)]...)
+	dim.args = append(append([]any{}, args...), mtime)
+	dim.current, dim.changed = new(int), new(int)
+	dim.dest = []any{dim.current, dim.changed}
+	return dim
+}
+
+// versionedUpsert inserts the row with its source, id, columns and fixed columns, or
+// replaces the columns of the stored one if the row comes from a newer rsvp which
+// carries other info, given by the last argument (previous versions are kept in
+// dimension_versions by triggers). The same info carried by newer rsvps leaves the
+// stored row alone, so its mtime is the one of the rsvp which brought the info.
+// Fixed columns keep the first inserted values. It returns how many rows hold the
+// info after the upsert and how many of them had their info changed.
+func versionedUpsert(table string, columns, fixed []string) string {
+	var (
+		inserted     = append(append([]string{}, columns...), fixed...)
+		placeholders = []string{"$1", "$2"}
+		updates      []string
+		excluded     []string
+	)
+	for i := range inserted {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+3))
+	}
+	for _, column := range columns {
+		updates = append(updates, column+" = EXCLUDED."+column)
+		excluded = append(excluded, "EXCLUDED."+column)
+	}
+	placeholders = append(placeholders, fmt.Sprintf("$%d", len(inserted)+3))
+	updates = append(updates, "mtime = EXCLUDED.mtime")
+
+	// the stored row is read as it was before the upsert
+	return `
+		WITH upserted AS (
+			INSERT INTO
+				` + table + ` (source, id, ` + strings.Join(inserted, ", ") + `, mtime)
+			VALUES
+				(` + strings.Join(placeholders, ", ") + `)
+			ON CONFLICT (source, id) DO UPDATE
+				SET ` + strings.Join(updates, ", ") + `
+				WHERE ` + table + `.mtime < EXCLUDED.mtime
+					AND (` + strings.Join(columns, ", ") + `) IS DISTINCT FROM (` + strings.Join(excluded, ", ") + `)
+			RETURNING
+				versions > 1 AND changed_at = mtime AS changed
+		)
+		SELECT
+			(SELECT COUNT(*) FROM upserted) + (
+				SELECT COUNT(*) FROM ` + table + `
+				WHERE source = $1 AND id = $2 AND (` + strings.Join(columns, ", ") + `) IS NOT DISTINCT FROM (` + strings.Join(placeholders[2:2+len(columns)], ", ") + `)
+			),
+			(SELECT COUNT(*) FILTER (WHERE changed) FROM upserted)
+	`
+}
+
+// dimensions returns upserts of the venue, group, member and event of the rsvp, in
+// the order they reference each other. Venues, groups and events are versioned,
+// the first seen member info is kept, as well as the member who created the event
+// (rsvps to it come from other members as well).
+func dimensions(source string, rsvp rsvps.RSVP) []dimension {
+	mtime := time.UnixMilli(rsvp.Mtime).UTC()
+
+	return []dimension{
+		newVersionedDimension("venue", "venues", source, rsvp.Venue.ID, mtime,
+			[]string{"name", "lat", "lon"}, nil,
+			source, rsvp.Venue.ID, rsvp.Venue.Name, rsvp.Venue.Lat, rsvp.Venue.Lon,
+		),
+
+		newVersionedDimension("group", "groups", source, rsvp.Group.ID, mtime,
+			[]string{"country", "state", "city", "name", "lat", "lon", "urlname", "topics"}, nil,
+			source,
+			rsvp.Group.ID,
+			rsvp.Group.Country,
+			zeronull.Text(rsvp.Group.State),
+			rsvp.Group.City,
+			rsvp.Group.Name,
+			rsvp.Group.Lat,
+			rsvp.Group.Lon,
+			rsvp.Group.Urlname,
+			rsvp.Group.Topics,
+		),
+
+		newDimension("member", "members", source, rsvp.Member.ID, `
+			INSERT INTO
+				members (source, id, name, photo)
+			VALUES
+				($1, $2, $3, $4)
+			ON CONFLICT (source, id) DO NOTHING
+		`, source, rsvp.Member.ID, rsvp.Member.Name, rsvp.Member.Photo),
+
+		newVersionedDimension("event", "events", source, rsvp.Event.ID, mtime,
+			[]string{"name", "time", "url", "venue_id", "group_id"}, []string{"member_id"},
+			source,
+			rsvp.Event.ID,
+			rsvp.Event.Name,
+			time.UnixMilli(rsvp.Event.Time).UTC(),
+			rsvp.Event.URL,
+			rsvp.Venue.ID,
+			rsvp.Group.ID,
+			rsvp.Member.ID,
+		),
+	}
+}
+
+// sendBatch executes the statements in a single round trip.
+func sendBatch(ctx context.Context, tx pgx.Tx, stmts []statement) error {
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, stmt := range stmts {
+		batch.Queue(stmt.sql, stmt.args...)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	for _, stmt := range stmts {
+		var err error
+		if stmt.dest != nil {
+			err = results.QueryRow().Scan(stmt.dest...)
+		} else {
+			_, err = results.Exec()
+		}
+		if err != nil {
+			return fmt.Errorf("%v statement failed: %w", stmt.name, err)
+		}
+	}
+
+	return results.Close()
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+// classify wraps save errors reported by the server which can't be fixed by a
+// retry with ErrPermanent. Errors without an SQLSTATE (lost connections, timeouts)
+// are left as transient.
+func classify(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || transientCode(pgErr.Code) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", dbpkg.ErrPermanent, err)
+}
+
+func transientCode(code string) bool {
+	switch code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03", // lock_not_available
+		"57014", // query_canceled, i.e. statement_timeout
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return true
+	}
+
+	switch code[:2] {
+	case "08", // connection_exception
+		"53", // insufficient_resources, i.e. too_many_connections
+		"58": // system_error, i.e. io_error
+		return true
+	}
+
+	return false
+}
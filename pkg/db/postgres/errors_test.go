@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+func TestClassify(t *testing.T) {
+	pgError := func(code string) error {
+		return fmt.Errorf("could not insert rsvp: %w", &pgconn.PgError{Code: code})
+	}
+
+	testCases := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "nil", err: nil},
+		{name: "connection loss", err: fmt.Errorf("could not begin transaction: %w", io.ErrUnexpectedEOF)},
+		{name: "timeout", err: context.DeadlineExceeded},
+		{name: "canceled", err: context.Canceled},
+		{name: "serialization failure", err: pgError("40001")},
+		{name: "deadlock", err: pgError("40P01")},
+		{name: "connection exception", err: pgError("08006")},
+		{name: "too many connections", err: pgError("53300")},
+		{name: "admin shutdown", err: pgError("57P01")},
+		{name: "unique violation", err: pgError("23505"), permanent: true},
+		{name: "foreign key violation", err: pgError("23503"), permanent: true},
+		{name: "invalid text representation", err: pgError("22P02"), permanent: true},
+		{name: "undefined column", err: pgError("42703"), permanent: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := classify(tc.err)
+			require.True(t, errors.Is(err, tc.err))
+			require.Equal(t, tc.permanent, errors.Is(err, dbpkg.ErrPermanent))
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package postgres
 
-import "github.com/VictoriaMetrics/metrics"
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
 
 var (
 	pgpoolAcquireCount            = metrics.NewCounter("pg_pool_acquire_total")
@@ -15,3 +19,29 @@ var (
 	pgpoolMaxLifetimeDestroyCount = metrics.NewCounter("pg_pool_max_lifetime_destroy_total")
 	pgpoolMaxIdleDestroyCount     = metrics.NewCounter("pg_pool_max_idle_destroy_total")
 )
+
+// pgSaveRSVPRoundTrips is how many round trips of statements SaveRSVP takes, besides
+// beginning and committing the transaction.
+var pgSaveRSVPRoundTrips = metrics.NewHistogram("pg_save_rsvp_round_trips")
+
+// pgDimensionUpserts counts dimension upserts of SaveRSVP which were sent or
+// skipped because the seen set had the same row.
+func pgDimensionUpserts(dimension, result string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_dimension_upserts_total{dimension="%s",result="%s"}`, dimension, result))
+}
+
+// pgDimensionConflicts counts venues, groups and events whose stored info was
+// replaced by different info of a newer rsvp.
+func pgDimensionConflicts(dimension string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`pg_dimension_conflicts_total{dimension="%s"}`, dimension))
+}
+
+var (
+	pgCounterCompactedSlots   = metrics.NewCounter("pg_counter_compacted_slots_total")
+	pgCounterCompactionErrors = metrics.NewCounter("pg_counter_compaction_errors_total")
+)
+
+var (
+	pgRollupRefreshedPeriods = metrics.NewCounter("pg_rollup_refreshed_periods_total")
+	pgRollupRefreshErrors    = metrics.NewCounter("pg_rollup_refresh_errors_total")
+)
@@ -0,0 +1,261 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+// partitionedTables are partitioned by month of the rsvp time, partitions are
+// created by the create_month_partitions function and named after the table and
+// the month, i.e. rsvps_y2023m05.
+var partitionedTables = []string{"rsvps", "event_counters", "event_counters_hourly"}
+
+func partitionName(table string, month time.Time) string {
+	return table + month.Format("_y2006m01")
+}
+
+// partitionMonth returns the month of the partition of the table, false if the name
+// isn't one of a monthly partition.
+func partitionMonth(table, name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, table+"_y")
+	if !ok {
+		return time.Time{}, false
+	}
+	month, err := time.Parse("2006m01", suffix)
+	return month, err == nil
+}
+
+// rsvpLockSQL locks the rsvp of the source and id given by the SQL expressions until
+// the end of the transaction. The primary key of rsvps includes mtime, so that it
+// can be partitioned by it, and saves of an rsvp are serialized by the lock instead.
+func rsvpLockSQL(source, id string) string {
+	return fmt.Sprintf("pg_advisory_xact_lock(hashtextextended(%s || '/' || %s::text, 0))", source, id)
+}
+
+// partitionMonths remembers months this process created (or found) partitions of
+// all tables for, so that saves don't ask for them again, and the first month which
+// is retained, partitions of earlier months aren't created on demand.
+type partitionMonths struct {
+	mu       sync.Mutex
+	months   map[time.Time]bool
+	retained time.Time
+}
+
+func newPartitionMonths() *partitionMonths {
+	return &partitionMonths{months: make(map[time.Time]bool)}
+}
+
+// missing returns the months of the mtimes which aren't known to have partitions,
+// it fails if some of them is before the retained one.
+func (p *partitionMonths) missing(mtimes []time.Time) ([]time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		missing []time.Time
+		seen    = make(map[time.Time]bool)
+	)
+	for _, mtime := range mtimes {
+		month := monthStart(mtime.UTC())
+		if p.months[month] || seen[month] {
+			continue
+		}
+		if month.Before(p.retained) {
+			return nil, fmt.Errorf("%w: rsvp of %v is older than the retained partitions", dbpkg.ErrPermanent, mtime)
+		}
+		seen[month] = true
+		missing = append(missing, month)
+	}
+
+	return missing, nil
+}
+
+func (p *partitionMonths) add(months []time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, month := range months {
+		p.months[month] = true
+	}
+}
+
+// retain forgets months before the retained one.
+func (p *partitionMonths) retain(retained time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.retained = retained
+	for month := range p.months {
+		if month.Before(retained) {
+			delete(p.months, month)
+		}
+	}
+}
+
+// forget forgets all months, i.e. after partitions created by a transaction which
+// was rolled back.
+func (p *partitionMonths) forget() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.months = make(map[time.Time]bool)
+}
+
+// ensurePartitions creates partitions of the months of the mtimes which this
+// process hasn't seen yet, before rows of the months are written by conn.
+func (db *DB) ensurePartitions(ctx context.Context, conn execer, mtimes ...time.Time) error {
+	months, err := db.partitions.missing(mtimes)
+	if err != nil {
+		return err
+	}
+
+	for _, month := range months {
+		_, err := conn.Exec(ctx, `
+			SELECT create_month_partitions(tables.name, $1, $1) FROM unnest($2::text[]) AS tables(name)
+		`, month, partitionedTables)
+		if err != nil {
+			return fmt.Errorf("could not create partitions of %v: %w", month.Format("2006-01"), err)
+		}
+	}
+
+	db.partitions.add(months)
+	return nil
+}
+
+// PartitionPolicy says which monthly partitions are kept.
+type PartitionPolicy struct {
+	// Ahead is how many months after the current one get partitions in advance.
+	Ahead int
+
+	// Retention is how many months, the current one included, are kept; partitions
+	// of older months are detached, or dropped if Drop is set. 0 keeps all months.
+	Retention int
+	Drop      bool
+}
+
+// PartitionStats describes partitions of a table after maintenance.
+type PartitionStats struct {
+	Table string
+
+	// Partitions is how many partitions are attached, Oldest is the first month of
+	// the oldest one.
+	Partitions int
+	Oldest     time.Time
+
+	// Created and Removed are how many partitions were created, and detached or
+	// dropped, by the maintenance.
+	Created int
+	Removed int
+}
+
+// MaintainPartitions creates partitions of the month of now and the policy.Ahead
+// months after it, and detaches or drops partitions of months past the retention.
+// Detached partitions stay as tables of their own, i.e. to be archived; stored
+// payloads of the months are deleted.
+func (db *DB) MaintainPartitions(ctx context.Context, now time.Time, policy PartitionPolicy) ([]PartitionStats, error) {
+	current := monthStart(now.UTC())
+
+	var retained time.Time
+	if policy.Retention > 0 {
+		retained = current.AddDate(0, 1-policy.Retention, 0)
+	}
+
+	// saves of expired months fail from now on rather than recreate their partitions
+	db.partitions.retain(retained)
+
+	var stats []PartitionStats
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		stats = nil
+
+		for _, table := range partitionedTables {
+			stat := PartitionStats{Table: table}
+
+			err := tx.QueryRow(ctx, `SELECT create_month_partitions($1, $2, $3)`, table, current, current.AddDate(0, policy.Ahead, 0)).Scan(&stat.Created)
+			if err != nil {
+				return fmt.Errorf("could not create partitions of %v: %w", table, err)
+			}
+
+			months, err := attachedPartitions(ctx, tx, table)
+			if err != nil {
+				return err
+			}
+
+			for _, month := range months {
+				if !month.Before(retained) {
+					stat.Partitions++
+					if stat.Oldest.IsZero() {
+						stat.Oldest = month
+					}
+					continue
+				}
+
+				partition := pgx.Identifier{partitionName(table, month)}.Sanitize()
+
+				sql := "ALTER TABLE " + pgx.Identifier{table}.Sanitize() + " DETACH PARTITION " + partition
+				if policy.Drop {
+					sql = "DROP TABLE " + partition
+				}
+				if _, err := tx.Exec(ctx, sql); err != nil {
+					return fmt.Errorf("could not remove partition %v: %w", partition, err)
+				}
+				stat.Removed++
+			}
+
+			stats = append(stats, stat)
+		}
+
+		// payloads of expired months can't be reprocessed anymore
+		if !retained.IsZero() {
+			if _, err := tx.Exec(ctx, `DELETE FROM rsvp_payloads WHERE mtime < $1`, retained); err != nil {
+				return fmt.Errorf("could not delete expired rsvp payloads: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// attachedPartitions returns months of the partitions of the table, the oldest first.
+func attachedPartitions(ctx context.Context, tx pgx.Tx, table string) ([]time.Time, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT
+			pg_class.relname
+		FROM
+			pg_inherits INNER JOIN pg_class ON pg_inherits.inhrelid = pg_class.oid
+		WHERE
+			pg_inherits.inhparent = $1::text::regclass
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("could not query partitions of %v: %w", table, err)
+	}
+
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("could not query partitions of %v: %w", table, err)
+	}
+
+	var months []time.Time
+	for _, name := range names {
+		if month, ok := partitionMonth(table, name); ok {
+			months = append(months, month)
+		}
+	}
+
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+
+	return months, nil
+}
@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+func TestPartitionMonth(t *testing.T) {
+	may := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	require.Equal(t, "rsvps_y2023m05", partitionName("rsvps", may))
+	require.Equal(t, "event_counters_hourly_y2023m05", partitionName("event_counters_hourly", may))
+
+	month, ok := partitionMonth("rsvps", "rsvps_y2023m05")
+	require.True(t, ok)
+	require.Equal(t, may, month)
+
+	for _, name := range []string{"rsvps", "rsvps_default", "rsvps_y2023m13", "rsvps_y2023m05_old"} {
+		_, ok := partitionMonth("rsvps", name)
+		require.False(t, ok, name)
+	}
+
+	_, ok = partitionMonth("event_counters", "event_counters_hourly_y2023m05")
+	require.False(t, ok)
+}
+
+func TestPartitionMonths(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return d
+	}
+
+	months := newPartitionMonths()
+
+	missing, err := months.missing([]time.Time{date("2023-05-20"), date("2023-04-30"), date("2023-05-01")})
+	require.NoError(t, err)
+	require.Equal(t, []time.Time{date("2023-05-01"), date("2023-04-01")}, missing)
+
+	months.add(missing)
+
+	missing, err = months.missing([]time.Time{date("2023-05-31"), date("2023-06-01")})
+	require.NoError(t, err)
+	require.Equal(t, []time.Time{date("2023-06-01")}, missing)
+
+	// months before the retained one are neither known nor created anymore
+	months.retain(date("2023-05-01"))
+
+	_, err = months.missing([]time.Time{date("2023-04-30")})
+	require.ErrorIs(t, err, dbpkg.ErrPermanent)
+
+	missing, err = months.missing([]time.Time{date("2023-05-31")})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	months.forget()
+
+	missing, err = months.missing([]time.Time{date("2023-05-31")})
+	require.NoError(t, err)
+	require.Equal(t, []time.Time{date("2023-05-01")}, missing)
+}
@@ -7,9 +7,12 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype/zeronull"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
 
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
 	dbpkg "github.com/oizgagin/ing/pkg/db"
 	"github.com/oizgagin/ing/pkg/rsvps"
 )
@@ -19,6 +22,22 @@ type Config struct {
 	User   string `toml:"user"`
 	Pass   string `toml:"pass"`
 	DBName string `toml:"dbname"`
+
+	// SeenCacheSize is how many recently written dimension rows (venues, groups,
+	// members and events) are remembered to skip writing them again, 0 disables it.
+	SeenCacheSize int `toml:"seen_cache_size"`
+
+	// Counters of an event are spread over CounterSlots rows (picked by
+	// CounterSlotBy, "random" or "rsvp_id"), so that saves of a popular event don't
+	// contend for a single row. Slots of past days are folded together every
+	// CounterCompactInterval, if it's set.
+	CounterSlots           int                  `toml:"counter_slots"`
+	CounterSlotBy          string               `toml:"counter_slot_by"`
+	CounterCompactInterval configtypes.Duration `toml:"counter_compact_interval"`
+
+	// RollupInterval is how often weekly and monthly rollups of counters are
+	// refreshed, 1m by default.
+	RollupInterval configtypes.Duration `toml:"rollup_interval"`
 }
 
 func (c Config) URL() string {
@@ -32,11 +51,20 @@ func (c Config) URL() string {
 }
 
 type DB struct {
-	pool      *pgxpool.Pool
-	ctxCancel func()
+	l          *zap.Logger
+	pool       *pgxpool.Pool
+	seen       *seenSet
+	slots      counterSlots
+	partitions *partitionMonths
+	ctxCancel  func()
 }
 
-func NewDB(cfg Config) (*DB, error) {
+func NewDB(cfg Config, logger *zap.Logger) (*DB, error) {
+	slots, err := newCounterSlots(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	pool, err := pgxpool.New(context.Background(), cfg.URL())
 	if err != nil {
 		return nil, fmt.Errorf("could not create pg pool: %w", err)
@@ -51,141 +79,421 @@ func NewDB(cfg Config) (*DB, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	db := &DB{pool: pool, ctxCancel: cancel}
+	db := &DB{l: logger.With(zap.String("logger", "postgres")), pool: pool, seen: newSeenSet(cfg.SeenCacheSize), slots: slots, partitions: newPartitionMonths(), ctxCancel: cancel}
 
 	go db.metrics(ctx)
 
+	if cfg.CounterCompactInterval.Duration > 0 {
+		go db.compactCounters(ctx, cfg.CounterCompactInterval.Duration)
+	}
+
+	rollupInterval := cfg.RollupInterval.Duration
+	if rollupInterval <= 0 {
+		rollupInterval = defaultRollupInterval
+	}
+	go db.refreshRollups(ctx, rollupInterval)
+
 	return db, nil
 }
 
-func (db *DB) SaveRSVP(ctx context.Context, rsvp rsvps.RSVP) error {
+// SaveRSVP saves the rsvp in a single transaction. Dimensions which this process
+// already wrote with the same contents are skipped, and the remaining ones are sent
+// together with the payload, the consumer offset and the select of the stored rsvp
+// in a single batch.
+func (db *DB) SaveRSVP(ctx context.Context, record dbpkg.Record) error {
+	if err := db.ensurePartitions(ctx, db.pool, time.UnixMilli(record.RSVP.Mtime)); err != nil {
+		return classify(err)
+	}
+
+	dims := dimensions(recordSource(record.RSVP), record.RSVP)
+
+	skipped, err := db.saveRecord(ctx, record, dims)
+
+	// skipped dimensions may have been deleted behind our back (i.e. by a reprocess
+	// in another process), so they are sent once again
+	if skipped && isForeignKeyViolation(err) {
+		for _, dim := range dims {
+			db.seen.remove(dim.key)
+		}
+		_, err = db.saveRecord(ctx, record, dims)
+	}
+
+	return classify(err)
+}
+
+func (db *DB) saveRecord(ctx context.Context, record dbpkg.Record, dims []dimension) (bool, error) {
+	rsvp, origin := record.RSVP, record.Origin
+	source := recordSource(rsvp)
+
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("could not begin transaction: %w", err)
+		return false, fmt.Errorf("could not begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `
-		INSERT INTO
-			venues (id, name, lat, lon)
-		VALUES
-			($1, $2, $3, $4)
-		ON CONFLICT (id) DO NOTHING
-	`, rsvp.Venue.ID, rsvp.Venue.Name, rsvp.Venue.Lat, rsvp.Venue.Lon)
-
-	if err != nil {
-		return fmt.Errorf("could not insert venue: %w", err)
-	}
-
-	_, err = tx.Exec(ctx, `
-		INSERT INTO
-			groups (id, country, state, city, name, lat, lon, urlname, topics)
-		VALUES
-			($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		ON CONFLICT (id) DO NOTHING
-	`,
-		rsvp.Group.ID,
-		rsvp.Group.Country,
-		zeronull.Text(rsvp.Group.State),
-		rsvp.Group.City,
-		rsvp.Group.Name,
-		rsvp.Group.Lat,
-		rsvp.Group.Lon,
-		rsvp.Group.Urlname,
-		rsvp.Group.Topics,
+	var (
+		stmts   []statement
+		written []dimension
+		skipped bool
 	)
-	if err != nil {
-		return fmt.Errorf("could not insert group: %w", err)
+
+	for _, dim := range dims {
+		if db.seen.seen(dim.key, dim.hash) {
+			pgDimensionUpserts(dim.name, "skipped").Inc()
+			skipped = true
+			continue
+		}
+
+		pgDimensionUpserts(dim.name, "sent").Inc()
+		stmts = append(stmts, dim.statement)
+		written = append(written, dim)
+	}
+
+	if len(record.Raw) > 0 {
+		stmts = append(stmts, payloadStatement(record))
+	}
+
+	var offsetSaved int
+	if origin.ConsumerGroup != "" {
+		stmts = append(stmts, consumerOffsetStatement(origin, origin.Offset, &offsetSaved))
+	}
+
+	var prev storedRSVP
+	stmts = append(stmts, selectStoredRSVP(source, rsvp.ID, &prev)...)
+
+	if err := sendBatch(ctx, tx, stmts); err != nil {
+		return skipped, err
+	}
+
+	// the message was already saved by another consumer
+	if origin.ConsumerGroup != "" && offsetSaved == 0 {
+		return skipped, staleOffset(origin)
+	}
+
+	// the rsvp and its counters are written depending on the stored one, so they
+	// take another round trip
+	writes := saveRSVP(db.slots, source, rsvp, prev)
+	if err := sendBatch(ctx, tx, writes); err != nil {
+		return skipped, err
+	}
+
+	roundTrips := 1
+	if len(writes) > 0 {
+		roundTrips++
+	}
+	pgSaveRSVPRoundTrips.Update(float64(roundTrips))
+
+	if err := tx.Commit(ctx); err != nil {
+		return skipped, fmt.Errorf("could not commit rsvp: %w", err)
 	}
 
-	_, err = tx.Exec(ctx, `
-		INSERT INTO
-			members (id, name, photo)
-		VALUES
-			($1, $2, $3)
-		ON CONFLICT (id) DO NOTHING
-	`, rsvp.Member.ID, rsvp.Member.Name, rsvp.Member.Photo)
+	for _, dim := range written {
+		if dim.current == nil {
+			db.seen.add(dim.key, dim.hash)
+			continue
+		}
+
+		// the stored row of a newer rsvp may hold other info, so it isn't remembered
+		if *dim.current > 0 {
+			db.seen.add(dim.key, dim.hash)
+		}
+		if *dim.changed > 0 {
+			pgDimensionConflicts(dim.name).Add(*dim.changed)
+		}
+	}
+
+	return skipped, nil
+}
+
+// SaveConsumerOffset stores the offset of a message which wasn't saved as an RSVP
+// (i.e. it was parked), so that consumption is resumed after it. Offsets which
+// aren't above the stored one are ignored.
+func (db *DB) SaveConsumerOffset(ctx context.Context, origin rsvps.Origin) error {
+	stmt := consumerOffsetStatement(origin, origin.Offset, nil)
+
+	if _, err := db.pool.Exec(ctx, stmt.sql, stmt.args...); err != nil {
+		return fmt.Errorf("could not save %v: %w", stmt.name, err)
+	}
+	return nil
+}
+
+func (db *DB) ConsumerOffsets(ctx context.Context, consumerGroup, topic string) (map[int]int64, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT
+			partition_id, last_offset
+		FROM
+			consumer_offsets
+		WHERE
+			consumer_group = $1 AND topic = $2
+	`, consumerGroup, topic)
 
 	if err != nil {
-		return fmt.Errorf("could not insert member: %w", err)
-	}
-
-	_, err = tx.Exec(ctx, `
-		INSERT INTO
-			events (id, name, time, url, venue_id, group_id, member_id)
-		VALUES
-			($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (id) DO NOTHING
-	`,
-		rsvp.Event.ID,
-		rsvp.Event.Name,
-		time.UnixMilli(rsvp.Event.Time).UTC(),
-		rsvp.Event.URL,
-		rsvp.Venue.ID,
-		rsvp.Group.ID,
-		rsvp.Member.ID,
+		return nil, fmt.Errorf("could not query consumer offsets: %w", err)
+	}
+
+	var (
+		offsets = make(map[int]int64)
+
+		partition int
+		offset    int64
 	)
+	_, err = pgx.ForEachRow(rows, []any{&partition, &offset}, func() error {
+		offsets[partition] = offset
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("could not insert event: %w", err)
-	}
-
-	rsvpResponse := rsvp.Response == "yes"
-
-	_, err = tx.Exec(ctx, `
-		INSERT INTO
-			rsvps (id, mtime, guests, response, visibility, event_id)
-		VALUES
-			($1, $2, $3, $4, $5, $6)
-	`,
-		rsvp.ID,
-		time.UnixMilli(rsvp.Mtime).UTC(),
-		rsvp.Guests,
-		rsvpResponse,
-		rsvp.Visibility,
-		rsvp.Event.ID,
-	)
+		return nil, fmt.Errorf("could not query consumer offsets: %w", err)
+	}
 
-	if err != nil {
-		return fmt.Errorf("could not insert rsvp: %w", err)
+	return offsets, nil
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// consumerOffsetStatement moves the stored offset of the partition forward to the
+// offset of origin. The offset is fenced: it isn't moved if the stored one isn't
+// below first, i.e. if a consumer of a newer generation already saved messages
+// from first on. The number of moved offsets is scanned into saved, if set.
+func consumerOffsetStatement(origin rsvps.Origin, first int64, saved *int) statement {
+	stmt := statement{
+		name: "consumer offset",
+		sql: `
+			WITH saved AS (
+				INSERT INTO
+					consumer_offsets (consumer_group, topic, partition_id, last_offset)
+				VALUES
+					($1, $2, $3, $4)
+				ON CONFLICT (consumer_group, topic, partition_id) DO UPDATE
+					SET last_offset = EXCLUDED.last_offset
+					WHERE consumer_offsets.last_offset < $5
+				RETURNING 1
+			)
+			SELECT COUNT(*) FROM saved
+		`,
+		args: []any{origin.ConsumerGroup, origin.Topic, origin.Partition, origin.Offset, first},
+	}
+	if saved != nil {
+		stmt.dest = []any{saved}
 	}
+	return stmt
+}
+
+// staleOffset returns the error the transaction is rolled back with when its
+// consumer offset was fenced.
+func staleOffset(origin rsvps.Origin) error {
+	return fmt.Errorf("%w: partition %v of %v at %v", dbpkg.ErrStaleOffset, origin.Partition, origin.Topic, origin.Offset)
+}
 
-	if rsvpResponse {
-		_, err = tx.Exec(ctx, `
+// payloadStatement stores the payload the rsvp was decoded from with its codec,
+// every version of the rsvp is stored once.
+func payloadStatement(record dbpkg.Record) statement {
+	return statement{
+		name: "rsvp payload",
+		sql: `
 			INSERT INTO
-				event_counters (rsvp_date, event_id, confirmed_rsvps)
+				rsvp_payloads (source, rsvp_id, mtime, payload, codec, topic, partition_id, message_offset, received_at)
 			VALUES
-				($1, $2, 1)
-			ON CONFLICT (rsvp_date, event_id) DO UPDATE
-				SET confirmed_rsvps = event_counters.confirmed_rsvps + 1
-		`, time.UnixMilli(rsvp.Mtime).UTC().Truncate(24*time.Hour), rsvp.Event.ID)
+				($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (source, rsvp_id, mtime) DO NOTHING
+		`,
+		args: []any{
+			recordSource(record.RSVP),
+			record.RSVP.ID,
+			time.UnixMilli(record.RSVP.Mtime).UTC(),
+			record.Raw,
+			recordCodec(record),
+			record.Origin.Topic,
+			record.Origin.Partition,
+			record.Origin.Offset,
+			receivedAt(record.Origin),
+		},
+	}
+}
 
-		if err != nil {
-			return fmt.Errorf("could not update counters: %w", err)
+// jsonCodec is the codec of payloads which weren't tagged with one.
+const jsonCodec = "json"
+
+func recordCodec(record dbpkg.Record) string {
+	if record.Codec == "" {
+		return jsonCodec
+	}
+	return record.Codec
+}
+
+// recordSource returns the source the rsvp is stored under, rsvps which weren't
+// tagged by a stream belong to the default source.
+func recordSource(rsvp rsvps.RSVP) string {
+	if rsvp.Source == "" {
+		return rsvps.DefaultSource
+	}
+	return rsvp.Source
+}
+
+// rsvpAttrs never returns nil, so that rsvps without attrs are stored with an
+// empty object rather than JSON null.
+func rsvpAttrs(rsvp rsvps.RSVP) map[string]string {
+	if rsvp.Attrs == nil {
+		return map[string]string{}
+	}
+	return rsvp.Attrs
+}
+
+func receivedAt(origin rsvps.Origin) time.Time {
+	if origin.ReceivedAt.IsZero() {
+		return time.Now().UTC()
+	}
+	return origin.ReceivedAt.UTC()
+}
+
+// storedRSVP is the stored version of an rsvp, found is false if there is none.
+type storedRSVP struct {
+	found    bool
+	mtime    time.Time
+	response bool
+	guests   int
+	eventID  string
+}
+
+// saveRSVP returns the statements inserting the rsvp or, if it was already seen,
+// applying it as an update (only when it is newer than the stored one), keeping
+// event_counters and event_counters_hourly in sync with the response, the guests
+// and the time it was given at.
+func saveRSVP(slots counterSlots, source string, rsvp rsvps.RSVP, prev storedRSVP) []statement {
+	var (
+		mtime    = time.UnixMilli(rsvp.Mtime).UTC()
+		response = rsvp.Response == "yes"
+		slot     = slots.slot(rsvp.ID)
+	)
+
+	if !prev.found {
+		stmts := []statement{{
+			name: "rsvp insert",
+			sql: `
+				INSERT INTO
+					rsvps (source, id, mtime, guests, response, visibility, event_id, attrs)
+				VALUES
+					($1, $2, $3, $4, $5, $6, $7, $8)
+			`,
+			args: []any{source, rsvp.ID, mtime, rsvp.Guests, response, rsvp.Visibility, rsvp.Event.ID, rsvpAttrs(rsvp)},
+		}}
+
+		if response {
+			stmts = append(stmts, eventCounterStatement(mtime, source, rsvp.Event.ID, slot, 1, 1+int(rsvp.Guests)))
 		}
+		return stmts
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("could not commit rsvp: %w", err)
+	prevMtime := prev.mtime.UTC()
+
+	if !mtime.After(prevMtime) {
+		return nil
 	}
 
-	return nil
+	stmts := []statement{{
+		name: "rsvp update",
+		sql: `
+			UPDATE
+				rsvps
+			SET
+				mtime = $3, guests = $4, response = $5, visibility = $6, event_id = $7, attrs = $8
+			WHERE
+				source = $1 AND id = $2
+		`,
+		args: []any{source, rsvp.ID, mtime, rsvp.Guests, response, rsvp.Visibility, rsvp.Event.ID, rsvpAttrs(rsvp)},
+	}}
+
+	if prev.response == response && prev.guests == int(rsvp.Guests) && rsvpHour(prevMtime).Equal(rsvpHour(mtime)) && prev.eventID == rsvp.Event.ID {
+		return stmts
+	}
+
+	if prev.response {
+		stmts = append(stmts, eventCounterStatement(prevMtime, source, prev.eventID, slot, -1, -(1+prev.guests)))
+	}
+
+	if response {
+		stmts = append(stmts, eventCounterStatement(mtime, source, rsvp.Event.ID, slot, 1, 1+int(rsvp.Guests)))
+	}
+
+	return stmts
 }
 
-func (db *DB) TopkEvents(ctx context.Context, date time.Time, k uint) ([]dbpkg.TopkEvent, error) {
-	date = date.UTC().Truncate(24 * time.Hour)
+// selectStoredRSVP returns the statements locking the rsvp, whether it's stored
+// or not, and selecting the stored one into prev. They are separate statements, so
+// that the stored rsvp is read after the lock is taken.
+func selectStoredRSVP(source string, rsvpID int64, prev *storedRSVP) []statement {
+	return []statement{
+		{
+			name: "rsvp lock",
+			sql:  `SELECT ` + rsvpLockSQL("$1::text", "$2::bigint"),
+			args: []any{source, rsvpID},
+		},
+		{
+			name: "stored rsvp",
+			sql: `
+				SELECT
+					rsvps.mtime IS NOT NULL,
+					COALESCE(rsvps.mtime, 'epoch'),
+					COALESCE(rsvps.response, false),
+					COALESCE(rsvps.guests, 0),
+					COALESCE(rsvps.event_id, '')
+				FROM
+					(SELECT $1::text AS source, $2::bigint AS id) AS stored
+						LEFT JOIN rsvps ON rsvps.source = stored.source AND rsvps.id = stored.id
+			`,
+			args: []any{source, rsvpID},
+			dest: []any{&prev.found, &prev.mtime, &prev.response, &prev.guests, &prev.eventID},
+		},
+	}
+}
 
-	rows, err := db.pool.Query(ctx, `
-		WITH topk AS (
-			SELECT event_id, confirmed_rsvps FROM event_counters WHERE rsvp_date = $1 ORDER BY confirmed_rsvps DESC LIMIT $2
-		)
-		SELECT
-			events.id, events.name, events.time, events.url, topk.confirmed_rsvps
-		FROM
-			events INNER JOIN topk ON events.id = topk.event_id
-		ORDER BY
-			topk.confirmed_rsvps DESC
-	`, date, k)
+// eventCounterStatement adds the deltas of confirmed rsvps and headcount to the
+// daily and hourly counters of the event at the time.
+func eventCounterStatement(mtime time.Time, source, eventID string, slot, confirmed, headcount int) statement {
+	return statement{
+		name: "event counters",
+		sql: `
+			WITH hourly AS (
+				INSERT INTO
+					event_counters_hourly (rsvp_hour, source, event_id, slot, confirmed_rsvps, headcount)
+				VALUES
+					($2, $3, $4, $5, $6, $7)
+				ON CONFLICT (rsvp_hour, source, event_id, slot) DO UPDATE
+					SET
+						confirmed_rsvps = event_counters_hourly.confirmed_rsvps + $6,
+						headcount = event_counters_hourly.headcount + $7
+			)
+			INSERT INTO
+				event_counters (rsvp_date, source, event_id, slot, confirmed_rsvps, headcount)
+			VALUES
+				($1, $3, $4, $5, $6, $7)
+			ON CONFLICT (rsvp_date, source, event_id, slot) DO UPDATE
+				SET
+					confirmed_rsvps = event_counters.confirmed_rsvps + $6,
+					headcount = event_counters.headcount + $7
+		`,
+		args: []any{rsvpDate(mtime), rsvpHour(mtime), source, eventID, slot, confirmed, headcount},
+	}
+}
+
+func rsvpDate(mtime time.Time) time.Time {
+	return mtime.UTC().Truncate(24 * time.Hour)
+}
+
+func rsvpHour(mtime time.Time) time.Time {
+	return mtime.UTC().Truncate(time.Hour)
+}
+
+// TopkEvents sums counters of whole months and weeks of the range from the rollups,
+// and of the remaining days from event_counters.
+func (db *DB) TopkEvents(ctx context.Context, q dbpkg.TopkQuery) ([]dbpkg.TopkEvent, error) {
+	sql, args, err := topkSQL(q)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topk query: %w", err)
+	}
 
+	rows, err := db.pool.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, fmt.Errorf("could not query topk events: %w", err)
 	}
@@ -195,9 +503,23 @@ func (db *DB) TopkEvents(ctx context.Context, date time.Time, k uint) ([]dbpkg.T
 
 		topk     dbpkg.TopkEvent
 		topkTime time.Time
+		dims     = make([]string, len(q.GroupBy))
 	)
-	_, err = pgx.ForEachRow(rows, []any{&topk.Event.ID, &topk.Event.Name, &topkTime, &topk.Event.URL, &topk.ConfirmedRSVPs}, func() error {
+
+	scans := []any{&topk.Source, &topk.Event.ID, &topk.Event.Name, &topkTime, &topk.Event.URL, &topk.ConfirmedRSVPs, &topk.Headcount}
+	for i := range dims {
+		scans = append(scans, &dims[i])
+	}
+
+	_, err = pgx.ForEachRow(rows, scans, func() error {
 		topk.Event.Time = topkTime.UnixMilli()
+		topk.Dimensions = nil
+		if len(dims) > 0 {
+			topk.Dimensions = make(map[dbpkg.Dimension]string, len(dims))
+			for i, dim := range q.GroupBy {
+				topk.Dimensions[dim] = dims[i]
+			}
+		}
 		topks = append(topks, topk)
 		return nil
 	})
@@ -208,14 +530,96 @@ func (db *DB) TopkEvents(ctx context.Context, date time.Time, k uint) ([]dbpkg.T
 	return topks, nil
 }
 
-func (db *DB) GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo, error) {
+// EventConflicts finds events which had their info changed or reference a venue or
+// group which had its info changed.
+func (db *DB) EventConflicts(ctx context.Context, source string, limit uint) ([]dbpkg.EventConflict, error) {
+	rows, err := db.pool.Query(ctx, `
+		WITH changed AS (
+			SELECT
+				source, id
+			FROM
+				events
+			WHERE
+				versions > 1 AND ($1 = '' OR source = $1)
+			UNION
+			SELECT
+				events.source, events.id
+			FROM
+				venues
+					INNER JOIN events ON venues.source = events.source AND venues.id = events.venue_id
+			WHERE
+				venues.versions > 1 AND ($1 = '' OR venues.source = $1)
+			UNION
+			SELECT
+				events.source, events.id
+			FROM
+				groups
+					INNER JOIN events ON groups.source = events.source AND groups.id = events.group_id
+			WHERE
+				groups.versions > 1 AND ($1 = '' OR groups.source = $1)
+		)
+		SELECT
+			events.source,
+			events.id,
+			events.name,
+			events.time,
+			events.url,
+			events.versions,
+			venues.versions,
+			groups.versions,
+			GREATEST(
+				CASE WHEN events.versions > 1 THEN events.changed_at END,
+				CASE WHEN venues.versions > 1 THEN venues.changed_at END,
+				CASE WHEN groups.versions > 1 THEN groups.changed_at END
+			) AS last_changed
+		FROM
+			changed
+				INNER JOIN events ON changed.source = events.source AND changed.id = events.id
+				INNER JOIN venues ON events.source = venues.source AND events.venue_id = venues.id
+				INNER JOIN groups ON events.source = groups.source AND events.group_id = groups.id
+		ORDER BY
+			last_changed DESC, events.source, events.id
+		LIMIT $2
+	`, source, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not query event conflicts: %w", err)
+	}
+
 	var (
-		eventInfo  rsvps.EventInfo
-		groupState zeronull.Text
+		conflicts []dbpkg.EventConflict
+
+		conflict  dbpkg.EventConflict
+		eventTime time.Time
 	)
+	_, err = pgx.ForEachRow(rows, []any{
+		&conflict.Source,
+		&conflict.Event.ID,
+		&conflict.Event.Name,
+		&eventTime,
+		&conflict.Event.URL,
+		&conflict.EventVersions,
+		&conflict.VenueVersions,
+		&conflict.GroupVersions,
+		&conflict.LastChanged,
+	}, func() error {
+		conflict.Event.Time = eventTime.UnixMilli()
+		conflicts = append(conflicts, conflict)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not query event conflicts: %w", err)
+	}
 
-	err := db.pool.QueryRow(ctx, `
+	return conflicts, nil
+}
+
+// GetEventInfo returns info of the event of the source, or of the only event
+// with the id among all sources if the source is empty.
+func (db *DB) GetEventInfo(ctx context.Context, source, eventID string) (rsvps.EventInfo, error) {
+	rows, err := db.pool.Query(ctx, `
 		SELECT
+			events.source,
 			groups.id,
 			groups.country,
 			groups.state,
@@ -231,11 +635,25 @@ func (db *DB) GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo
 			venues.lon
 		FROM
 			events
-				INNER JOIN groups ON events.group_id = groups.id
-				INNER JOIN venues ON events.venue_id = venues.id
+				INNER JOIN groups ON events.source = groups.source AND events.group_id = groups.id
+				INNER JOIN venues ON events.source = venues.source AND events.venue_id = venues.id
 		WHERE
-			events.id = $1
-	`, eventID).Scan(
+			events.id = $1 AND ($2 = '' OR events.source = $2)
+		LIMIT 2
+	`, eventID, source)
+
+	if err != nil {
+		return rsvps.EventInfo{}, fmt.Errorf("could not query event info: %w", err)
+	}
+
+	var (
+		eventInfos []rsvps.EventInfo
+
+		eventInfo  rsvps.EventInfo
+		groupState zeronull.Text
+	)
+	_, err = pgx.ForEachRow(rows, []any{
+		&eventInfo.Source,
 		&eventInfo.Group.ID,
 		&eventInfo.Group.Country,
 		&groupState,
@@ -249,18 +667,27 @@ func (db *DB) GetEventInfo(ctx context.Context, eventID string) (rsvps.EventInfo
 		&eventInfo.Venue.Name,
 		&eventInfo.Venue.Lat,
 		&eventInfo.Venue.Lon,
-	)
-
+	}, func() error {
+		eventInfo.Group.State = string(groupState)
+		eventInfos = append(eventInfos, eventInfo)
+		return nil
+	})
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return rsvps.EventInfo{}, dbpkg.ErrNoEvents
-		}
 		return rsvps.EventInfo{}, fmt.Errorf("could not query event info: %w", err)
 	}
 
-	eventInfo.Group.State = string(groupState)
+	switch len(eventInfos) {
+	case 0:
+		return rsvps.EventInfo{}, dbpkg.ErrNoEvents
+	case 1:
+		return eventInfos[0], nil
+	default:
+		return rsvps.EventInfo{}, dbpkg.ErrAmbiguousEvent
+	}
+}
 
-	return eventInfo, nil
+func (db *DB) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
 }
 
 func (db *DB) Close() error {
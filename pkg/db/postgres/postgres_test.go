@@ -12,7 +12,9 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype/zeronull"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
 
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
 	dbpkg "github.com/oizgagin/ing/pkg/db"
 	"github.com/oizgagin/ing/pkg/db/postgres"
 	"github.com/oizgagin/ing/pkg/rsvps"
@@ -56,7 +58,7 @@ func TestDB_SaveRSVP(t *testing.T) {
 		},
 	}
 
-	err := db.SaveRSVP(ctx, rsvp)
+	err := db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp})
 	require.NoError(t, err)
 
 	require.Equal(t, rsvp.Venue, selectVenue(t, ctx, conn, rsvp.Venue.ID))
@@ -85,6 +87,310 @@ func TestDB_SaveRSVP(t *testing.T) {
 	require.Equal(t, wantRsvp, selectRsvp(t, ctx, conn, rsvp.ID))
 }
 
+func TestDB_SaveRSVP_Update(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day1 := time.Date(2023, 3, 4, 12, 30, 50, 0, time.UTC)
+	day2 := time.Date(2023, 3, 5, 12, 30, 50, 0, time.UTC)
+
+	rsvp := rsvps.RSVP{
+		ID:         1001,
+		Mtime:      day1.UnixMilli(),
+		Guests:     1,
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      rsvps.Venue{ID: 2001, Name: "venue_name1", Lat: 21, Lon: 22},
+		Member:     rsvps.Member{ID: 3001, Name: "member_name1", Photo: "member_photo1"},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 4001},
+		Group: rsvps.Group{
+			ID:      5001,
+			Name:    "group_name1",
+			Country: "US",
+			City:    "group_city1",
+			Lat:     51,
+			Lon:     52,
+			Urlname: "group_urlname1",
+			Topics:  []rsvps.GroupTopic{{Urlkey: "group_urlkey1", TopicName: "group_topicname1"}},
+		},
+	}
+
+	save := func(response string, mtime time.Time) {
+		curr := rsvp
+		curr.Response = response
+		curr.Mtime = mtime.UnixMilli()
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: curr}))
+	}
+
+	// yes at day1
+	save("yes", day1)
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+
+	// the same rsvp redelivered
+	save("yes", day1)
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+
+	// yes -> no
+	save("no", day1.Add(time.Minute))
+	require.Equal(t, 0, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+	require.Equal(t, "no", selectRsvp(t, ctx, conn, rsvp.ID).Response)
+
+	// stale yes is ignored
+	save("yes", day1)
+	require.Equal(t, 0, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+	require.Equal(t, "no", selectRsvp(t, ctx, conn, rsvp.ID).Response)
+
+	// no -> yes on the next day
+	save("yes", day2)
+	require.Equal(t, 0, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, day2, "event_id1"))
+	require.Equal(t, day2.UnixMilli(), selectRsvp(t, ctx, conn, rsvp.ID).Mtime)
+
+	topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day1, To: day1, K: 10})
+	require.NoError(t, err)
+	require.Empty(t, topks)
+}
+
+func TestDB_ConsumerOffsets(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	rsvp := rsvps.RSVP{
+		ID:         1001,
+		Mtime:      1002,
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      rsvps.Venue{ID: 2001, Name: "venue_name1"},
+		Member:     rsvps.Member{ID: 3001, Name: "member_name1"},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: 4001},
+		Group:      rsvps.Group{ID: 5001, Name: "group_name1", Country: "US", Topics: []rsvps.GroupTopic{}},
+	}
+
+	origin := func(partition int, offset int64) rsvps.Origin {
+		return rsvps.Origin{ConsumerGroup: "group1", Topic: "topic1", Partition: partition, Offset: offset}
+	}
+
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Origin: origin(1, 10)}))
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Origin: origin(1, 11)}))
+	require.NoError(t, db.SaveConsumerOffset(ctx, origin(2, 20)))
+
+	// offsets are not stored without a consumer group
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Origin: rsvps.Origin{Topic: "topic1", Partition: 3, Offset: 30}}))
+
+	offsets, err := db.ConsumerOffsets(ctx, "group1", "topic1")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{1: 11, 2: 20}, offsets)
+
+	// a consumer of an older generation can't save what was already saved
+	stale := rsvp
+	stale.Response = "no"
+	stale.Mtime++
+	err = db.SaveRSVP(ctx, dbpkg.Record{RSVP: stale, Origin: origin(1, 11)})
+	require.ErrorIs(t, err, dbpkg.ErrStaleOffset)
+	require.Equal(t, "yes", selectRsvp(t, ctx, conn, 1001).Response)
+
+	err = db.SaveRSVPs(ctx, []dbpkg.Record{
+		{RSVP: stale, Origin: origin(1, 11)},
+		{RSVP: stale, Origin: origin(1, 12)},
+	})
+	require.ErrorIs(t, err, dbpkg.ErrStaleOffset)
+	require.Equal(t, "yes", selectRsvp(t, ctx, conn, 1001).Response)
+
+	require.NoError(t, db.SaveConsumerOffset(ctx, origin(2, 19)))
+
+	offsets, err = db.ConsumerOffsets(ctx, "group1", "topic1")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{1: 11, 2: 20}, offsets)
+
+	offsets, err = db.ConsumerOffsets(ctx, "group2", "topic1")
+	require.NoError(t, err)
+	require.Empty(t, offsets)
+}
+
+func TestDB_SaveRSVPs(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day1 := time.Date(2023, 3, 4, 12, 30, 50, 0, time.UTC)
+	day2 := time.Date(2023, 3, 5, 12, 30, 50, 0, time.UTC)
+
+	newRsvp := func(id int64, eventID, response string, mtime time.Time) rsvps.RSVP {
+		return rsvps.RSVP{
+			ID:         id,
+			Mtime:      mtime.UnixMilli(),
+			Guests:     1,
+			Visibility: "public",
+			Response:   response,
+			Venue:      rsvps.Venue{ID: 2001, Name: "venue_name1", Lat: 21, Lon: 22},
+			Member:     rsvps.Member{ID: 3001, Name: "member_name1", Photo: "member_photo1"},
+			Event:      rsvps.Event{ID: eventID, Name: "event_name_" + eventID, URL: "event_url1", Time: 4001},
+			Group: rsvps.Group{
+				ID:      5001,
+				Name:    "group_name1",
+				Country: "US",
+				City:    "group_city1",
+				Urlname: "group_urlname1",
+				Topics:  []rsvps.GroupTopic{{Urlkey: "group_urlkey1", TopicName: "group_topicname1"}},
+			},
+		}
+	}
+
+	origin := func(partition int, offset int64) rsvps.Origin {
+		return rsvps.Origin{ConsumerGroup: "group1", Topic: "topic1", Partition: partition, Offset: offset}
+	}
+
+	// rsvp 1001 was saved before as yes at day1
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: newRsvp(1001, "event_id1", "yes", day1)}))
+
+	err := db.SaveRSVPs(ctx, []dbpkg.Record{
+		// 1001: yes -> no, then a stale yes
+		{RSVP: newRsvp(1001, "event_id1", "no", day1.Add(time.Minute)), Origin: origin(1, 10)},
+		{RSVP: newRsvp(1001, "event_id1", "yes", day1), Origin: origin(1, 11)},
+		// 1002: new, yes at day1 and then yes at day2
+		{RSVP: newRsvp(1002, "event_id1", "yes", day1), Origin: origin(2, 20)},
+		{RSVP: newRsvp(1002, "event_id1", "yes", day2), Origin: origin(1, 12)},
+		// 1003 and 1004: new, yes for another event
+		{RSVP: newRsvp(1003, "event_id2", "yes", day1), Origin: origin(2, 21)},
+		{RSVP: newRsvp(1004, "event_id2", "yes", day1), Origin: rsvps.Origin{}},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "no", selectRsvp(t, ctx, conn, 1001).Response)
+	require.Equal(t, day2.UnixMilli(), selectRsvp(t, ctx, conn, 1002).Mtime)
+
+	require.Equal(t, 0, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, day2, "event_id1"))
+	require.Equal(t, 2, selectEventCounter(t, ctx, conn, day1, "event_id2"))
+
+	require.Equal(t, "event_name_event_id2", selectEvent(t, ctx, conn, "event_id2").Name)
+
+	offsets, err := db.ConsumerOffsets(ctx, "group1", "topic1")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{1: 12, 2: 21}, offsets)
+
+	// redelivered batch changes nothing
+	err = db.SaveRSVPs(ctx, []dbpkg.Record{
+		{RSVP: newRsvp(1003, "event_id2", "yes", day1)},
+		{RSVP: newRsvp(1004, "event_id2", "yes", day1)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, selectEventCounter(t, ctx, conn, day1, "event_id2"))
+}
+
+func TestDB_Reprocess(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day1 := time.Date(2023, 3, 4, 12, 30, 50, 0, time.UTC)
+
+	payload := func(id int64, response string, mtime time.Time) []byte {
+		return []byte(fmt.Sprintf(`{
+			"rsvp_id": %d, "mtime": %d, "response": %q, "visibility": "public", "guests": 0,
+			"venue": {"venue_id": 2001, "venue_name": "venue_name1", "lat": 21, "lon": 22},
+			"member": {"member_id": 3001, "member_name": "member_name1", "photo": "member_photo1"},
+			"event": {"event_id": "event_id1", "event_name": "event_name1", "event_url": "event_url1", "time": 4001},
+			"group": {
+				"group_id": 5001, "group_name": "group_name1", "group_country": "us", "group_city": "group_city1",
+				"group_lat": 51, "group_lon": 52, "group_urlname": "group_urlname1", "group_topics": []
+			}
+		}`, id, mtime.UnixMilli(), response))
+	}
+
+	save := func(id int64, response string, mtime time.Time) {
+		raw := payload(id, response, mtime)
+
+		rsvp, err := rsvps.Decode(raw)
+		require.NoError(t, err)
+
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Raw: raw, Origin: rsvps.Origin{Topic: "topic1", Offset: id}}))
+	}
+
+	save(1001, "yes", day1)
+	save(1001, "no", day1.Add(time.Minute))
+	save(1002, "yes", day1)
+
+	// a buggy decoder used to drop group city
+	_, err := conn.Exec(ctx, `UPDATE groups SET city = ''`)
+	require.NoError(t, err)
+
+	// a payload the current decoder rejects
+	_, err = conn.Exec(ctx, `
+		INSERT INTO
+			rsvp_payloads (rsvp_id, mtime, payload, topic, partition_id, message_offset, received_at)
+		VALUES
+			(1003, $1, '{"rsvp_id": 1003, "foo": 1}', 'topic1', 0, 1003, $1)
+	`, day1)
+	require.NoError(t, err)
+
+	// an rsvp saved before payloads were kept can't be reprocessed
+	rsvp, err := rsvps.Decode(payload(1004, "yes", day1))
+	require.NoError(t, err)
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+
+	_, err = db.Reprocess(ctx, 2, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, "yes", selectRsvp(t, ctx, conn, 1004).Response)
+
+	_, err = conn.Exec(ctx, `DELETE FROM rsvps WHERE id = 1004`)
+	require.NoError(t, err)
+
+	// payloads of other codecs are stored as they were received
+	binary := []byte{0x08, 0xed, 0x07}
+	rsvp, err = rsvps.Decode(payload(1005, "yes", day1))
+	require.NoError(t, err)
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp, Raw: binary, Codec: "protobuf"}))
+
+	decode := func(ctx context.Context, codec string, data []byte) (rsvps.RSVP, error) {
+		if codec == "protobuf" {
+			require.Equal(t, binary, data)
+			return rsvp, nil
+		}
+		return rsvps.Decode(data)
+	}
+
+	result, err := db.Reprocess(ctx, 2, decode, nil)
+	require.NoError(t, err)
+	require.Equal(t, postgres.ReprocessResult{Reprocessed: 4, Rejected: map[string]int{": unknown_field": 1}}, result)
+	require.Equal(t, "yes", selectRsvp(t, ctx, conn, 1005).Response)
+
+	require.Equal(t, "group_city1", selectGroup(t, ctx, conn, 5001).City)
+	require.Equal(t, "no", selectRsvp(t, ctx, conn, 1001).Response)
+	require.Equal(t, "yes", selectRsvp(t, ctx, conn, 1002).Response)
+	require.Equal(t, 2, selectEventCounter(t, ctx, conn, day1, "event_id1"))
+}
+
 func TestDB_TopkEvents(t *testing.T) {
 
 	var (
@@ -156,34 +462,42 @@ func TestDB_TopkEvents(t *testing.T) {
 				Time: rsvpDates[eventID].UnixMilli(),
 			}
 
-			err := db.SaveRSVP(ctx, currRsvp)
+			err := db.SaveRSVP(ctx, dbpkg.Record{RSVP: currRsvp})
 			require.NoError(t, err)
 		}
 	}
 
-	topks1, err := db.TopkEvents(ctx, day1, 2)
+	topks1, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day1, To: day1, K: 2})
 	require.NoError(t, err)
 	require.Equal(t, []dbpkg.TopkEvent{
 		{
+			Source:         rsvps.DefaultSource,
 			Event:          rsvps.Event{ID: "event_id7", Name: "event_name7", URL: "event_url7", Time: day1.UnixMilli()},
 			ConfirmedRSVPs: eventCounters["event_id7"],
+			Headcount:      2 * eventCounters["event_id7"], // every rsvp brings a guest
 		},
 		{
+			Source:         rsvps.DefaultSource,
 			Event:          rsvps.Event{ID: "event_id5", Name: "event_name5", URL: "event_url5", Time: day1.UnixMilli()},
 			ConfirmedRSVPs: eventCounters["event_id5"],
+			Headcount:      2 * eventCounters["event_id5"],
 		},
 	}, topks1)
 
-	topks2, err := db.TopkEvents(ctx, day2, 2)
+	topks2, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day2, To: day2, K: 2})
 	require.NoError(t, err)
 	require.Equal(t, []dbpkg.TopkEvent{
 		{
+			Source:         rsvps.DefaultSource,
 			Event:          rsvps.Event{ID: "event_id6", Name: "event_name6", URL: "event_url6", Time: day2.UnixMilli()},
 			ConfirmedRSVPs: eventCounters["event_id6"],
+			Headcount:      2 * eventCounters["event_id6"],
 		},
 		{
+			Source:         rsvps.DefaultSource,
 			Event:          rsvps.Event{ID: "event_id4", Name: "event_name4", URL: "event_url4", Time: day2.UnixMilli()},
 			ConfirmedRSVPs: eventCounters["event_id4"],
+			Headcount:      2 * eventCounters["event_id4"],
 		},
 	}, topks2)
 }
@@ -226,17 +540,751 @@ func TestDB_GetEventInfo(t *testing.T) {
 		},
 	}
 
-	err := db.SaveRSVP(ctx, rsvp)
+	err := db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp})
 	require.NoError(t, err)
 
-	info, err := db.GetEventInfo(ctx, "event_id1")
+	info, err := db.GetEventInfo(ctx, "", "event_id1")
 	require.NoError(t, err)
-	require.Equal(t, rsvps.EventInfo{Venue: rsvp.Venue, Group: rsvp.Group}, info)
+	require.Equal(t, rsvps.EventInfo{Source: rsvps.DefaultSource, Venue: rsvp.Venue, Group: rsvp.Group}, info)
+}
+
+func TestDB_Sources(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, _, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day := time.Date(2023, 3, 4, 12, 30, 50, 0, time.UTC)
+
+	newRsvp := func(source string, id int64, venueName string) rsvps.RSVP {
+		return rsvps.RSVP{
+			Source:     source,
+			ID:         id,
+			Mtime:      day.UnixMilli(),
+			Guests:     1,
+			Visibility: "public",
+			Response:   "yes",
+			Venue:      rsvps.Venue{ID: 2001, Name: venueName, Lat: 21, Lon: 22},
+			Member:     rsvps.Member{ID: 3001, Name: "member_name1", Photo: "member_photo1"},
+			Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", URL: "event_url1", Time: day.UnixMilli()},
+			Group:      rsvps.Group{ID: 5001, Name: "group_name1", Country: "US", City: "group_city1", Topics: []rsvps.GroupTopic{}},
+		}
+	}
+
+	// the same ids in different sources are different rsvps, events and venues
+	for _, rsvp := range []rsvps.RSVP{
+		newRsvp("eu", 1001, "venue_eu"),
+		newRsvp("us", 1001, "venue_us"),
+		newRsvp("us", 1002, "venue_us"),
+	} {
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	}
+
+	topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day, To: day, K: 10})
+	require.NoError(t, err)
+	require.Len(t, topks, 2)
+	require.Equal(t, "us", topks[0].Source)
+	require.Equal(t, 2, topks[0].ConfirmedRSVPs)
+	require.Equal(t, "eu", topks[1].Source)
+	require.Equal(t, 1, topks[1].ConfirmedRSVPs)
+
+	topks, err = db.TopkEvents(ctx, dbpkg.TopkQuery{From: day, To: day, K: 10, Source: "eu"})
+	require.NoError(t, err)
+	require.Len(t, topks, 1)
+	require.Equal(t, "eu", topks[0].Source)
+
+	info, err := db.GetEventInfo(ctx, "us", "event_id1")
+	require.NoError(t, err)
+	require.Equal(t, "us", info.Source)
+	require.Equal(t, "venue_us", info.Venue.Name)
+
+	_, err = db.GetEventInfo(ctx, "", "event_id1")
+	require.ErrorIs(t, err, dbpkg.ErrAmbiguousEvent)
+
+	_, err = db.GetEventInfo(ctx, "asia", "event_id1")
+	require.ErrorIs(t, err, dbpkg.ErrNoEvents)
+}
+
+func TestDB_SaveRSVP_SeenDimensions(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	rsvp := rsvps.RSVP{
+		ID:         1001,
+		Mtime:      1002,
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      rsvps.Venue{ID: 2001, Name: "venue_name1"},
+		Member:     rsvps.Member{ID: 3001, Name: "member_name1"},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", Time: 4001},
+		Group:      rsvps.Group{ID: 5001, Name: "group_name1", Country: "us"},
+	}
+
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+
+	// dimensions of the second rsvp are skipped, since they were already written
+	rsvp.ID, rsvp.Member.ID = 1002, 3002
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	require.Equal(t, 2, selectEventCounter(t, ctx, conn, time.UnixMilli(rsvp.Mtime).UTC(), rsvp.Event.ID))
+
+	// dimensions deleted behind the back of the seen set are written again
+	require.NoError(t, flushAll(ctx, conn))
+
+	rsvp.ID = 1003
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	require.Equal(t, rsvp.Venue, selectVenue(t, ctx, conn, rsvp.Venue.ID))
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, time.UnixMilli(rsvp.Mtime).UTC(), rsvp.Event.ID))
+}
+
+func TestDB_CounterSlots(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	for _, slotBy := range []string{postgres.CounterSlotRandom, postgres.CounterSlotByRSVPID} {
+		t.Run(slotBy, func(t *testing.T) {
+			db, conn, tearDown := setUpWithConfig(t, ctx, func(cfg *postgres.Config) {
+				cfg.CounterSlots = 4
+				cfg.CounterSlotBy = slotBy
+			})
+			defer tearDown()
+
+			day := time.Date(2023, 4, 20, 12, 0, 0, 0, time.UTC)
+
+			rsvp := rsvps.RSVP{
+				Mtime:      day.UnixMilli(),
+				Visibility: "public",
+				Response:   "yes",
+				Venue:      rsvps.Venue{ID: 2001},
+				Member:     rsvps.Member{ID: 3001},
+				Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", Time: day.UnixMilli()},
+				Group:      rsvps.Group{ID: 5001, Country: "us"},
+			}
+
+			var records []dbpkg.Record
+			for id := int64(1); id <= 20; id++ {
+				rsvp.ID = id
+				if id <= 10 {
+					require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+				} else {
+					records = append(records, dbpkg.Record{RSVP: rsvp})
+				}
+			}
+			require.NoError(t, db.SaveRSVPs(ctx, records))
+
+			// an rsvp changed to "no" is taken off whatever slot it lands in
+			rsvp.ID, rsvp.Mtime, rsvp.Response = 1, day.Add(time.Minute).UnixMilli(), "no"
+			require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+
+			var slots int
+			require.NoError(t, conn.QueryRow(ctx, `SELECT COUNT(*) FROM event_counters`).Scan(&slots))
+			require.Greater(t, slots, 1)
+
+			topk, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day, To: day, K: 10})
+			require.NoError(t, err)
+			require.Len(t, topk, 1)
+			require.Equal(t, 19, topk[0].ConfirmedRSVPs)
+
+			// slots of the current day are left alone
+			folded, err := db.CompactCounters(ctx, day)
+			require.NoError(t, err)
+			require.Zero(t, folded)
+
+			folded, err = db.CompactCounters(ctx, day.Add(24*time.Hour))
+			require.NoError(t, err)
+			require.Greater(t, folded, 0)
+
+			require.NoError(t, conn.QueryRow(ctx, `SELECT COUNT(*) FROM event_counters`).Scan(&slots))
+			require.Equal(t, 1, slots)
+			require.Equal(t, 19, selectEventCounter(t, ctx, conn, day, "event_id1"))
+		})
+	}
+}
+
+func TestDB_TopkEventsRollups(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	// rollups are refreshed by the test only
+	db, _, tearDown := setUpWithConfig(t, ctx, func(cfg *postgres.Config) {
+		cfg.RollupInterval = configtypes.Duration{Duration: time.Hour}
+	})
+	defer tearDown()
+
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return d
+	}
+
+	save := func(id int64, eventID string, day time.Time, response string) {
+		t.Helper()
+
+		rsvp := rsvps.RSVP{
+			ID:         id,
+			Mtime:      day.Add(12 * time.Hour).UnixMilli(),
+			Visibility: "public",
+			Response:   response,
+			Venue:      rsvps.Venue{ID: 2001},
+			Member:     rsvps.Member{ID: 3001},
+			Event:      rsvps.Event{ID: eventID, Name: eventID, Time: day.UnixMilli()},
+			Group:      rsvps.Group{ID: 5001, Country: "us"},
+		}
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	}
+
+	topk := func(from, to time.Time) map[string]int {
+		t.Helper()
+
+		topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: from, To: to, K: 10})
+		require.NoError(t, err)
+
+		counters := make(map[string]int)
+		for _, topk := range topks {
+			counters[topk.Event.ID] = topk.ConfirmedRSVPs
+		}
+		return counters
+	}
+
+	// event_id1 in february and march, event_id2 across the week of 2023-03-06
+	save(1, "event_id1", date("2023-02-28"), "yes")
+	save(2, "event_id1", date("2023-03-01"), "yes")
+	save(3, "event_id1", date("2023-03-31"), "yes")
+	save(4, "event_id2", date("2023-03-06"), "yes")
+	save(5, "event_id2", date("2023-03-12"), "yes")
+	save(6, "event_id2", date("2023-04-01"), "yes")
+
+	refreshed, err := db.RefreshRollups(ctx)
+	require.NoError(t, err)
+	require.Greater(t, refreshed, 0)
+
+	require.Equal(t, map[string]int{"event_id1": 2, "event_id2": 2}, topk(date("2023-03-01"), date("2023-03-31")))
+	require.Equal(t, map[string]int{"event_id2": 2}, topk(date("2023-03-06"), date("2023-03-12")))
+	require.Equal(t, map[string]int{"event_id1": 3, "event_id2": 3}, topk(date("2023-02-20"), date("2023-04-02")))
+	require.Equal(t, map[string]int{"event_id1": 1}, topk(date("2023-02-28"), date("2023-02-28")))
+
+	// changes are picked up by the next refresh only
+	save(4, "event_id2", date("2023-03-07"), "no")
+	require.Equal(t, map[string]int{"event_id1": 2, "event_id2": 2}, topk(date("2023-03-01"), date("2023-03-31")))
+
+	refreshed, err = db.RefreshRollups(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, refreshed)
+
+	require.Equal(t, map[string]int{"event_id1": 2, "event_id2": 1}, topk(date("2023-03-01"), date("2023-03-31")))
+	require.Equal(t, map[string]int{"event_id2": 1}, topk(date("2023-03-06"), date("2023-03-12")))
+
+	refreshed, err = db.RefreshRollups(ctx)
+	require.NoError(t, err)
+	require.Zero(t, refreshed)
+}
+
+func TestDB_TopkEventsDimensions(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, _, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day := time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)
+
+	groups := map[int64]rsvps.Group{
+		5001: {ID: 5001, Country: "DE", City: "berlin", Topics: []rsvps.GroupTopic{{Urlkey: "hiking"}, {Urlkey: "go"}}},
+		5002: {ID: 5002, Country: "de", City: "munich", Topics: []rsvps.GroupTopic{{Urlkey: "hiking"}}},
+		5003: {ID: 5003, Country: "us", City: "boston", Topics: []rsvps.GroupTopic{{Urlkey: "go"}}},
+	}
+
+	// event_idN of group 500M gets N confirmed rsvps
+	events := map[string]int64{"event_id1": 5001, "event_id2": 5001, "event_id3": 5002, "event_id4": 5003}
+
+	var id int64
+	for i := 1; i <= 4; i++ {
+		eventID := fmt.Sprintf("event_id%d", i)
+		for j := 0; j < i; j++ {
+			id++
+			rsvp := rsvps.RSVP{
+				ID:         id,
+				Mtime:      day.UnixMilli(),
+				Visibility: "public",
+				Response:   "yes",
+				Venue:      rsvps.Venue{ID: 2001},
+				Member:     rsvps.Member{ID: 3001},
+				Event:      rsvps.Event{ID: eventID, Name: eventID, Time: day.UnixMilli()},
+				Group:      groups[events[eventID]],
+			}
+			require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+		}
+	}
+
+	query := func(filters map[dbpkg.Dimension]string, groupBy ...dbpkg.Dimension) []string {
+		t.Helper()
+
+		topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day, To: day, K: 1, Filters: filters, GroupBy: groupBy})
+		require.NoError(t, err)
+
+		var ranked []string
+		for _, topk := range topks {
+			ranked = append(ranked, fmt.Sprintf("%v %v %v", topk.Dimensions, topk.Event.ID, topk.ConfirmedRSVPs))
+		}
+		return ranked
+	}
+
+	require.Equal(t, []string{"map[] event_id3 3"}, query(map[dbpkg.Dimension]string{dbpkg.DimensionCountry: "DE"}))
+	require.Equal(t, []string{"map[] event_id2 2"}, query(map[dbpkg.Dimension]string{dbpkg.DimensionGroupID: "5001"}))
+	require.Equal(t, []string{"map[] event_id4 4"}, query(map[dbpkg.Dimension]string{dbpkg.DimensionTopic: "go"}))
+
+	require.Equal(t, []string{
+		"map[country:de] event_id3 3",
+		"map[country:us] event_id4 4",
+	}, query(nil, dbpkg.DimensionCountry))
+
+	require.Equal(t, []string{
+		"map[city:berlin topic:go] event_id2 2",
+		"map[city:berlin topic:hiking] event_id2 2",
+		"map[city:munich topic:hiking] event_id3 3",
+	}, query(map[dbpkg.Dimension]string{dbpkg.DimensionCountry: "de"}, dbpkg.DimensionCity, dbpkg.DimensionTopic))
+}
+
+func TestDB_TopkEventsTimeZone(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	save := func(id int64, eventID string, mtime time.Time, response string) {
+		t.Helper()
+
+		rsvp := rsvps.RSVP{
+			ID:         id,
+			Mtime:      mtime.UnixMilli(),
+			Visibility: "public",
+			Response:   response,
+			Venue:      rsvps.Venue{ID: 2001},
+			Member:     rsvps.Member{ID: 3001},
+			Event:      rsvps.Event{ID: eventID, Name: eventID, Time: mtime.UnixMilli()},
+			Group:      rsvps.Group{ID: 5001, Country: "us"},
+		}
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	}
+
+	topk := func(date time.Time, loc *time.Location) map[string]int {
+		t.Helper()
+
+		topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: date, To: date, Location: loc, K: 10})
+		require.NoError(t, err)
+
+		counters := make(map[string]int)
+		for _, topk := range topks {
+			counters[topk.Event.ID] = topk.ConfirmedRSVPs
+		}
+		return counters
+	}
+
+	// 03:00 UTC is still 2023-03-04 in New York
+	save(1, "event_id1", time.Date(2023, 3, 5, 3, 0, 0, 0, time.UTC), "yes")
+	save(2, "event_id2", time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC), "yes")
+	save(3, "event_id2", time.Date(2023, 3, 6, 4, 0, 0, 0, time.UTC), "yes")
+
+	day := time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC)
+
+	require.Equal(t, map[string]int{"event_id1": 1, "event_id2": 1}, topk(day, nil))
+	require.Equal(t, map[string]int{"event_id1": 1}, topk(day.AddDate(0, 0, -1), newYork))
+	require.Equal(t, map[string]int{"event_id2": 2}, topk(day, newYork))
+
+	// moving an rsvp to another hour moves its hourly counter
+	save(3, "event_id2", time.Date(2023, 3, 6, 6, 0, 0, 0, time.UTC), "yes")
+	require.Equal(t, map[string]int{"event_id2": 1}, topk(day, newYork))
+
+	// ranges with whole utc days read them from the daily counters
+	topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day.AddDate(0, 0, -1), To: day.AddDate(0, 0, 1), Location: newYork, K: 10})
+	require.NoError(t, err)
+	require.Len(t, topks, 2)
+	require.Equal(t, 2, topks[0].ConfirmedRSVPs)
+
+	var hourly int
+	require.NoError(t, conn.QueryRow(ctx, `SELECT COALESCE(SUM(confirmed_rsvps), 0) FROM event_counters_hourly`).Scan(&hourly))
+	require.Equal(t, 3, hourly)
+
+	// 2023-03-05 in Kolkata (+05:30) is from 18:30 UTC of the previous day to 18:30
+	// UTC, the partial hours are counted from rsvps
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	save(4, "event_id3", time.Date(2023, 3, 4, 18, 45, 0, 0, time.UTC), "yes")
+	save(5, "event_id3", time.Date(2023, 3, 5, 18, 15, 0, 0, time.UTC), "yes")
+	save(6, "event_id3", time.Date(2023, 3, 5, 18, 40, 0, 0, time.UTC), "yes")
+	save(7, "event_id3", time.Date(2023, 3, 4, 18, 20, 0, 0, time.UTC), "yes")
+	save(8, "event_id3", time.Date(2023, 3, 4, 18, 50, 0, 0, time.UTC), "no")
+
+	require.Equal(t, map[string]int{"event_id1": 1, "event_id2": 1, "event_id3": 2}, topk(day, kolkata))
+}
+
+func TestDB_TopkEventsHeadcount(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, _, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	day := time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC)
+
+	newRecord := func(id int64, eventID string, guests uint, mtime time.Time) dbpkg.Record {
+		return dbpkg.Record{RSVP: rsvps.RSVP{
+			ID:         id,
+			Mtime:      mtime.UnixMilli(),
+			Guests:     guests,
+			Visibility: "public",
+			Response:   "yes",
+			Venue:      rsvps.Venue{ID: 2001},
+			Member:     rsvps.Member{ID: 3001},
+			Event:      rsvps.Event{ID: eventID, Name: eventID, Time: day.UnixMilli()},
+			Group:      rsvps.Group{ID: 5001, Country: "us"},
+		}}
+	}
+
+	topk := func(rankBy dbpkg.RankBy) [][3]any {
+		t.Helper()
+
+		topks, err := db.TopkEvents(ctx, dbpkg.TopkQuery{From: day, To: day, K: 10, RankBy: rankBy})
+		require.NoError(t, err)
+
+		var ranked [][3]any
+		for _, topk := range topks {
+			ranked = append(ranked, [3]any{topk.Event.ID, topk.ConfirmedRSVPs, topk.Headcount})
+		}
+		return ranked
+	}
+
+	// three members of event_id1 come alone, a member of event_id2 brings four guests
+	require.NoError(t, db.SaveRSVP(ctx, newRecord(1, "event_id1", 0, day)))
+	require.NoError(t, db.SaveRSVPs(ctx, []dbpkg.Record{
+		newRecord(2, "event_id1", 0, day),
+		newRecord(3, "event_id1", 0, day),
+		newRecord(4, "event_id2", 4, day),
+	}))
+
+	require.Equal(t, [][3]any{{"event_id1", 3, 3}, {"event_id2", 1, 5}}, topk(""))
+	require.Equal(t, [][3]any{{"event_id1", 3, 3}, {"event_id2", 1, 5}}, topk(dbpkg.RankByRSVPs))
+	require.Equal(t, [][3]any{{"event_id2", 1, 5}, {"event_id1", 3, 3}}, topk(dbpkg.RankByHeadcount))
+
+	// guests are changed in place, by single and batch saves
+	require.NoError(t, db.SaveRSVP(ctx, newRecord(4, "event_id2", 1, day.Add(time.Minute))))
+	require.Equal(t, [][3]any{{"event_id1", 3, 3}, {"event_id2", 1, 2}}, topk(dbpkg.RankByHeadcount))
+
+	require.NoError(t, db.SaveRSVPs(ctx, []dbpkg.Record{newRecord(1, "event_id1", 2, day.Add(time.Minute))}))
+	require.Equal(t, [][3]any{{"event_id1", 3, 5}, {"event_id2", 1, 2}}, topk(dbpkg.RankByHeadcount))
+}
+
+func TestDB_DimensionVersions(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	t1 := time.Date(2023, 5, 15, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+
+	rsvp := rsvps.RSVP{
+		ID:         1001,
+		Mtime:      t1.UnixMilli(),
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      rsvps.Venue{ID: 2001, Name: "venue_name1", Lat: 21, Lon: 22},
+		Member:     rsvps.Member{ID: 3001, Name: "member_name1"},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", Time: 4001},
+		Group:      rsvps.Group{ID: 5001, Name: "group_name1", Country: "us", Topics: []rsvps.GroupTopic{}},
+	}
+
+	save := func(id int64, mtime time.Time, venue rsvps.Venue) {
+		t.Helper()
+
+		curr := rsvp
+		curr.ID, curr.Mtime, curr.Venue = id, mtime.UnixMilli(), venue
+		require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: curr}))
+	}
+
+	venueVersions := func() (validTo []*time.Time) {
+		t.Helper()
+
+		rows, err := conn.Query(ctx, `
+			SELECT valid_to FROM dimension_versions WHERE dimension = 'venues' AND id = '2001' ORDER BY valid_from
+		`)
+		require.NoError(t, err)
+		validTo, err = pgx.CollectRows(rows, pgx.RowTo[*time.Time])
+		require.NoError(t, err)
+		return
+	}
+
+	moved := rsvps.Venue{ID: 2001, Name: "venue_name2", Lat: 31, Lon: 32}
+
+	save(1001, t1, rsvp.Venue)
+
+	// other members rsvp to the event, which keeps the member who created it
+	other := rsvp
+	other.ID, other.Mtime, other.Member = 1011, t1.Add(10*time.Second).UnixMilli(), rsvps.Member{ID: 3002, Name: "member_name2"}
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: other}))
+
+	other.ID, other.Mtime, other.Member = 1012, t1.Add(20*time.Second).UnixMilli(), rsvps.Member{ID: 3003, Name: "member_name3"}
+	require.NoError(t, db.SaveRSVPs(ctx, []dbpkg.Record{{RSVP: other}}))
+
+	var (
+		memberID       int64
+		eventVersions  int
+		eventHistories int
+	)
+	err := conn.QueryRow(ctx, `
+		SELECT
+			member_id,
+			versions,
+			(SELECT COUNT(*) FROM dimension_versions WHERE dimension = 'events' AND id = 'event_id1')
+		FROM
+			events
+		WHERE
+			id = 'event_id1'
+	`).Scan(&memberID, &eventVersions, &eventHistories)
+	require.NoError(t, err)
+	require.Equal(t, int64(3001), memberID)
+	require.Equal(t, 1, eventVersions)
+	require.Equal(t, 1, eventHistories)
+
+	conflicts, err := db.EventConflicts(ctx, "", 10)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+
+	// the venue moved
+	save(1002, t2, moved)
+	require.Equal(t, moved, selectVenue(t, ctx, conn, 2001))
+
+	// an older rsvp with the previous venue info is delivered late
+	save(1003, t1.Add(time.Minute), rsvp.Venue)
+	require.Equal(t, moved, selectVenue(t, ctx, conn, 2001))
+
+	// a newer rsvp with the same info leaves the venue alone, so it keeps the mtime
+	// of the rsvp which moved it
+	save(1004, t3, moved)
+
+	var venueMtime time.Time
+	require.NoError(t, conn.QueryRow(ctx, `SELECT mtime FROM venues WHERE id = 2001`).Scan(&venueMtime))
+	require.Equal(t, t2, venueMtime)
+
+	versions := venueVersions()
+	require.Len(t, versions, 2)
+	require.NotNil(t, versions[0])
+	require.Equal(t, t2, *versions[0])
+	require.Nil(t, versions[1])
+
+	conflicts, err = db.EventConflicts(ctx, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []dbpkg.EventConflict{
+		{
+			Source:        rsvps.DefaultSource,
+			Event:         rsvps.Event{ID: "event_id1", Name: "event_name1", Time: 4001},
+			EventVersions: 1,
+			VenueVersions: 2,
+			GroupVersions: 1,
+			LastChanged:   t2,
+		},
+	}, conflicts)
+
+	conflicts, err = db.EventConflicts(ctx, "other", 10)
+	require.NoError(t, err)
+	require.Empty(t, conflicts)
+
+	// within a batch the latest rsvp wins regardless of its position
+	renamed, stale := rsvp, rsvp
+	renamed.ID, renamed.Mtime, renamed.Venue, renamed.Group.Name = 1005, t3.Add(time.Hour).UnixMilli(), moved, "group_name2"
+	stale.ID, stale.Mtime, stale.Venue = 1006, t3.Add(time.Minute).UnixMilli(), moved
+
+	require.NoError(t, db.SaveRSVPs(ctx, []dbpkg.Record{{RSVP: renamed}, {RSVP: stale}}))
+	require.Equal(t, "group_name2", selectGroup(t, ctx, conn, 5001).Name)
+
+	conflicts, err = db.EventConflicts(ctx, "", 10)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	require.Equal(t, 2, conflicts[0].GroupVersions)
+	require.Equal(t, t3.Add(time.Hour), conflicts[0].LastChanged)
+}
+
+func TestDB_Partitions(t *testing.T) {
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	db, conn, tearDown := setUp(t, ctx)
+	defer tearDown()
+
+	// partitions detached by the test would block saves of their months by later runs
+	defer func() {
+		rows, err := conn.Query(ctx, `
+			SELECT relname FROM pg_class WHERE relname ~ '_y[0-9]{4}m[0-9]{2}$' AND relkind = 'r' AND NOT relispartition
+		`)
+		require.NoError(t, err)
+		detached, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		for _, table := range detached {
+			_, err := conn.Exec(ctx, "DROP TABLE "+pgx.Identifier{table}.Sanitize())
+			require.NoError(t, err)
+		}
+	}()
+
+	jan := time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC)
+	feb := time.Date(2021, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	rsvp := rsvps.RSVP{
+		ID:         1001,
+		Mtime:      jan.UnixMilli(),
+		Visibility: "public",
+		Response:   "yes",
+		Venue:      rsvps.Venue{ID: 2001},
+		Member:     rsvps.Member{ID: 3001},
+		Event:      rsvps.Event{ID: "event_id1", Name: "event_name1", Time: jan.UnixMilli()},
+		Group:      rsvps.Group{ID: 5001, Country: "us"},
+	}
+
+	partitionRows := func(partition string) (n int) {
+		t.Helper()
+
+		require.NoError(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM "+pgx.Identifier{partition}.Sanitize()).Scan(&n))
+		return
+	}
+
+	// partitions of january and february are created on demand
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	require.Equal(t, 1, selectEventCounter(t, ctx, conn, jan, "event_id1"))
+
+	second := rsvp
+	second.ID, second.Mtime = 1002, feb.UnixMilli()
+	require.NoError(t, db.SaveRSVPs(ctx, []dbpkg.Record{{RSVP: second}}))
+
+	// the update moves the rsvp to the partition of february
+	rsvp.Mtime, rsvp.Response = feb.Add(time.Hour).UnixMilli(), "no"
+	require.NoError(t, db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp}))
+	require.Equal(t, rsvp.Mtime, selectRsvp(t, ctx, conn, rsvp.ID).Mtime)
+	require.Equal(t, 0, selectEventCounter(t, ctx, conn, jan, "event_id1"))
+	require.Equal(t, 0, partitionRows("rsvps_y2021m01"))
+	require.Equal(t, 2, partitionRows("rsvps_y2021m02"))
+
+	// march and april are created ahead, january is detached
+	stats, err := db.MaintainPartitions(ctx, time.Date(2021, 3, 10, 0, 0, 0, 0, time.UTC), postgres.PartitionPolicy{Ahead: 1, Retention: 2})
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+
+	for _, stat := range stats {
+		require.Equal(t, 2, stat.Created, stat.Table)
+		require.GreaterOrEqual(t, stat.Removed, 1, stat.Table)
+		require.GreaterOrEqual(t, stat.Partitions, 3, stat.Table)
+		require.Equal(t, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), stat.Oldest, stat.Table)
+	}
+
+	require.Equal(t, 1, partitionRows("event_counters_y2021m01"))
+
+	// rsvps of detached months aren't saved anymore
+	rsvp.ID, rsvp.Mtime = 1003, jan.UnixMilli()
+	err = db.SaveRSVP(ctx, dbpkg.Record{RSVP: rsvp})
+	require.ErrorIs(t, err, dbpkg.ErrPermanent)
+
+	// a month later february is dropped
+	stats, err = db.MaintainPartitions(ctx, time.Date(2021, 4, 10, 0, 0, 0, 0, time.UTC), postgres.PartitionPolicy{Ahead: 1, Retention: 2, Drop: true})
+	require.NoError(t, err)
+
+	for _, stat := range stats {
+		require.Equal(t, 1, stat.Created, stat.Table)
+		require.Equal(t, 1, stat.Removed, stat.Table)
+		require.Equal(t, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), stat.Oldest, stat.Table)
+	}
+
+	var dropped *string
+	require.NoError(t, conn.QueryRow(ctx, `SELECT to_regclass('rsvps_y2021m02')::text`).Scan(&dropped))
+	require.Nil(t, dropped)
+
+	// payloads of dropped months aren't reprocessed, so the months aren't brought back
+	_, err = conn.Exec(ctx, `
+		INSERT INTO
+			rsvp_payloads (rsvp_id, mtime, payload, topic, partition_id, message_offset, received_at)
+		VALUES
+			(1004, $1, '{}', 'topic1', 0, 1004, $1)
+	`, feb)
+	require.NoError(t, err)
+
+	result, err := db.Reprocess(ctx, 10, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Expired)
+	require.Equal(t, 0, result.Reprocessed)
+
+	require.NoError(t, conn.QueryRow(ctx, `SELECT to_regclass('rsvps_y2021m02')::text`).Scan(&dropped))
+	require.Nil(t, dropped)
+
+	// and are deleted by the next maintenance
+	_, err = db.MaintainPartitions(ctx, time.Date(2021, 4, 10, 0, 0, 0, 0, time.UTC), postgres.PartitionPolicy{Ahead: 1, Retention: 2, Drop: true})
+	require.NoError(t, err)
+
+	var payloads int
+	require.NoError(t, conn.QueryRow(ctx, `SELECT COUNT(*) FROM rsvp_payloads`).Scan(&payloads))
+	require.Equal(t, 0, payloads)
 }
 
 func setUp(t *testing.T, ctx context.Context) (*postgres.DB, *pgx.Conn, func()) {
 	t.Helper()
 
+	return setUpWithConfig(t, ctx, func(*postgres.Config) {})
+}
+
+func setUpWithConfig(t *testing.T, ctx context.Context, configure func(cfg *postgres.Config)) (*postgres.DB, *pgx.Conn, func()) {
+	t.Helper()
+
 	postgresAddr := os.Getenv("ING_E2E_POSTGRES_ADDR")
 	require.NotEmpty(t, postgresAddr)
 
@@ -254,9 +1302,12 @@ func setUp(t *testing.T, ctx context.Context) (*postgres.DB, *pgx.Conn, func())
 		User:   postgresUser,
 		Pass:   postgresPass,
 		DBName: postgresDB,
+
+		SeenCacheSize: 1000,
 	}
+	configure(&cfg)
 
-	db, err := postgres.NewDB(cfg)
+	db, err := postgres.NewDB(cfg, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	conn, err := pgx.Connect(ctx, cfg.URL())
@@ -383,10 +1434,40 @@ func selectRsvp(t *testing.T, ctx context.Context, conn *pgx.Conn, rsvpID int64)
 	return
 }
 
+func selectEventCounter(t *testing.T, ctx context.Context, conn *pgx.Conn, date time.Time, eventID string) (confirmedRSVPs int) {
+	err := conn.QueryRow(ctx, `
+		SELECT
+			COALESCE(SUM(confirmed_rsvps), 0)
+		FROM event_counters
+			WHERE rsvp_date = $1 AND event_id = $2
+	`, date.UTC().Truncate(24*time.Hour), eventID).Scan(&confirmedRSVPs)
+
+	require.NoError(t, err)
+	return
+}
+
 func flushAll(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.Exec(ctx, `DELETE FROM rsvp_payloads`); err != nil {
+		return fmt.Errorf("could not truncate rsvp_payloads table: %w", err)
+	}
+	if _, err := conn.Exec(ctx, `DELETE FROM consumer_offsets`); err != nil {
+		return fmt.Errorf("could not truncate consumer_offsets table: %w", err)
+	}
 	if _, err := conn.Exec(ctx, `DELETE FROM event_counters`); err != nil {
 		return fmt.Errorf("could not truncate event_counters table: %w", err)
 	}
+	if _, err := conn.Exec(ctx, `DELETE FROM event_counters_hourly`); err != nil {
+		return fmt.Errorf("could not truncate event_counters_hourly table: %w", err)
+	}
+	if _, err := conn.Exec(ctx, `DELETE FROM event_counters_weekly`); err != nil {
+		return fmt.Errorf("could not truncate event_counters_weekly table: %w", err)
+	}
+	if _, err := conn.Exec(ctx, `DELETE FROM event_counters_monthly`); err != nil {
+		return fmt.Errorf("could not truncate event_counters_monthly table: %w", err)
+	}
+	if _, err := conn.Exec(ctx, `DELETE FROM event_counter_changes`); err != nil {
+		return fmt.Errorf("could not truncate event_counter_changes table: %w", err)
+	}
 	if _, err := conn.Exec(ctx, `DELETE FROM rsvps`); err != nil {
 		return fmt.Errorf("could not truncate rsvps table: %w", err)
 	}
@@ -402,6 +1483,9 @@ func flushAll(ctx context.Context, conn *pgx.Conn) error {
 	if _, err := conn.Exec(ctx, `DELETE FROM venues`); err != nil {
 		return fmt.Errorf("could not truncate venues table: %w", err)
 	}
+	if _, err := conn.Exec(ctx, `DELETE FROM dimension_versions`); err != nil {
+		return fmt.Errorf("could not truncate dimension_versions table: %w", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,227 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// ReprocessResult tells how many stored payloads were reprocessed, how many were
+// rejected by the decoder, by rejection reason ("field: reason"), how many were
+// dropped by the process func, and how many were skipped as older than the
+// retained partitions.
+type ReprocessResult struct {
+	Reprocessed int
+	Rejected    map[string]int
+	Dropped     int
+	Expired     int
+}
+
+// DecodeFunc decodes a stored payload with the codec it was received with. Errors
+// other than the ones of rsvps.Decode (i.e. the schema registry is down) abort the
+// reprocessing.
+type DecodeFunc func(ctx context.Context, codec string, payload []byte) (rsvps.RSVP, error)
+
+// decodeJSON decodes payloads when no DecodeFunc is given, payloads of other codecs
+// are rejected.
+func decodeJSON(_ context.Context, codec string, payload []byte) (rsvps.RSVP, error) {
+	if codec != jsonCodec {
+		return rsvps.RSVP{}, &rsvps.DecodeError{Reason: "unknown_codec", Err: fmt.Errorf("no decoder of codec %q", codec)}
+	}
+	return rsvps.Decode(payload)
+}
+
+// ProcessFunc modifies a decoded RSVP before it is saved (i.e. derives its Attrs),
+// it returns false if the RSVP must not be saved.
+type ProcessFunc func(ctx context.Context, rsvp *rsvps.RSVP) (bool, error)
+
+// Reprocess re-derives venues, groups, members, events, rsvps and event counters
+// from the stored raw payloads with the current decoders, in batches of batchSize
+// payloads. Payloads are decoded by decode, or as JSON if it is nil, and decoded
+// RSVPs are passed through process, if it is not nil. Everything
+// is done in a single transaction, so readers see either the old or the new data;
+// writers should be stopped while it is running. It refuses to run if any stored
+// rsvp has no payload of its version (i.e. it was saved before payloads were
+// kept), since such rsvps would be lost. Payloads of months which partitions were
+// removed past the retention are skipped rather than bring the months back.
+func (db *DB) Reprocess(ctx context.Context, batchSize int, decode DecodeFunc, process ProcessFunc) (ReprocessResult, error) {
+	result := ReprocessResult{Rejected: make(map[string]int)}
+
+	if batchSize <= 0 {
+		return result, fmt.Errorf("invalid batch size %v, must be positive", batchSize)
+	}
+	if decode == nil {
+		decode = decodeJSON
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// partitions created on demand are rolled back together with the transaction
+	committed := false
+	defer func() {
+		if !committed {
+			db.partitions.forget()
+		}
+	}()
+
+	var missing int
+	err = tx.QueryRow(ctx, `
+		SELECT
+			COUNT(*)
+		FROM
+			rsvps
+		WHERE
+			NOT EXISTS (
+				SELECT 1 FROM rsvp_payloads
+				WHERE rsvp_payloads.source = rsvps.source AND rsvp_payloads.rsvp_id = rsvps.id AND rsvp_payloads.mtime = rsvps.mtime
+			)
+	`).Scan(&missing)
+	if err != nil {
+		return result, fmt.Errorf("could not count rsvps without payloads: %w", err)
+	}
+	if missing > 0 {
+		return result, fmt.Errorf("%v stored rsvps have no payloads and would be lost by reprocessing", missing)
+	}
+
+	// partitions of months before the oldest attached one were removed past the
+	// retention, so they aren't created on demand
+	months, err := attachedPartitions(ctx, tx, "rsvps")
+	if err != nil {
+		return result, err
+	}
+	var retained time.Time
+	if len(months) > 0 {
+		retained = months[0]
+		db.partitions.retain(retained)
+	}
+
+	for _, table := range []string{"event_counters", "event_counters_hourly", "rsvps", "events", "venues", "groups", "members", "dimension_versions"} {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+table); err != nil {
+			return result, fmt.Errorf("could not delete from %v: %w", table, err)
+		}
+	}
+
+	// payloads are reprocessed in the order they were received, so that the first
+	// seen members win and dimension versions are recorded as they were originally
+
+	var (
+		lastReceivedAt = time.Time{}
+		lastSource     = ""
+		lastRsvpID     = int64(-1)
+		lastMtime      = time.Time{}
+	)
+
+	for {
+		rows, err := tx.Query(ctx, `
+			SELECT
+				source, rsvp_id, mtime, codec, payload, topic, partition_id, message_offset, received_at
+			FROM
+				rsvp_payloads
+			WHERE
+				(received_at, source, rsvp_id, mtime) > ($1, $2, $3, $4)
+			ORDER BY
+				received_at, source, rsvp_id, mtime
+			LIMIT $5
+		`, lastReceivedAt, lastSource, lastRsvpID, lastMtime, batchSize)
+
+		if err != nil {
+			return result, fmt.Errorf("could not query rsvp payloads: %w", err)
+		}
+
+		var (
+			records []dbpkg.Record
+			fetched int
+
+			codec   string
+			payload []byte
+			origin  rsvps.Origin
+		)
+		_, err = pgx.ForEachRow(rows, []any{&lastSource, &lastRsvpID, &lastMtime, &codec, &payload, &origin.Topic, &origin.Partition, &origin.Offset, &lastReceivedAt}, func() error {
+			fetched++
+
+			if lastMtime.Before(retained) {
+				result.Expired++
+				return nil
+			}
+
+			rsvp, err := decode(ctx, codec, payload)
+			if err != nil {
+				if !rejected(err) {
+					return fmt.Errorf("could not decode rsvp %v of source %v: %w", lastRsvpID, lastSource, err)
+				}
+				field, reason := rsvps.RejectReason(err)
+				result.Rejected[field+": "+reason]++
+				return nil
+			}
+
+			rsvp.Source = lastSource
+
+			if process != nil {
+				keep, err := process(ctx, &rsvp)
+				if err != nil {
+					return fmt.Errorf("could not process rsvp %v of source %v: %w", rsvp.ID, rsvp.Source, err)
+				}
+				if !keep {
+					result.Dropped++
+					return nil
+				}
+			}
+
+			origin.ReceivedAt = lastReceivedAt
+			records = append(records, dbpkg.Record{RSVP: rsvp, Origin: origin})
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("could not query rsvp payloads: %w", err)
+		}
+
+		if fetched == 0 {
+			break
+		}
+
+		if len(records) > 0 {
+			// within the transaction, since it holds locks of the partitioned tables
+			if err := db.ensurePartitions(ctx, tx, recordMtimes(records)...); err != nil {
+				return result, err
+			}
+			if err := stage(ctx, tx, records); err != nil {
+				return result, err
+			}
+			if err := upsertStaged(ctx, tx, db.slots); err != nil {
+				return result, err
+			}
+		}
+
+		result.Reprocessed += len(records)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return result, fmt.Errorf("could not commit reprocessed rsvps: %w", err)
+	}
+	committed = true
+
+	// dimensions were rewritten, possibly with other contents
+	db.seen.reset()
+
+	return result, nil
+}
+
+// rejected tells if the payload was rejected by the decoder, rather than couldn't
+// be decoded at the moment.
+func rejected(err error) bool {
+	var (
+		decodeErr     *rsvps.DecodeError
+		validationErr *rsvps.ValidationError
+	)
+	return errors.As(err, &decodeErr) || errors.As(err, &validationErr)
+}
@@ -0,0 +1,188 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// defaultRollupInterval is how often rollups are refreshed if it isn't configured.
+const defaultRollupInterval = time.Minute
+
+// rollupLockID is the advisory lock serializing rollup refreshes of all processes,
+// concurrent refreshes would conflict on rollup rows.
+const rollupLockID = 0x696e67726f6c6c // "ingroll"
+
+// rollup is a table of event counters summed over periods, rows are keyed by the
+// first date of the period.
+type rollup struct {
+	table  string
+	column string
+	span   string // the length of the period as an SQL interval
+	start  func(date time.Time) time.Time
+}
+
+var rollups = []rollup{
+	{table: "event_counters_weekly", column: "week", span: "7 days", start: weekStart},
+	{table: "event_counters_monthly", column: "month", span: "1 month", start: monthStart},
+}
+
+// weekStart returns the monday of the ISO week of the date.
+func weekStart(date time.Time) time.Time {
+	return date.AddDate(0, 0, -(int(date.Weekday())+6)%7)
+}
+
+func monthStart(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// topkPeriods splits the range of dates (both inclusive) into whole months and
+// weeks, which are read from rollups, and the remaining days, which are read from
+// event_counters.
+func topkPeriods(from, to time.Time) (days, weeks, months []time.Time) {
+	from, to = rsvpDate(from), rsvpDate(to)
+
+	days, weeks, months = []time.Time{}, []time.Time{}, []time.Time{}
+
+	for date := from; !date.After(to); {
+		if date.Day() == 1 && !date.AddDate(0, 1, -1).After(to) {
+			months = append(months, date)
+			date = date.AddDate(0, 1, 0)
+			continue
+		}
+
+		// a week isn't taken if it overlaps a month which is read whole
+		if weekEnd := date.AddDate(0, 0, 6); date.Weekday() == time.Monday && !weekEnd.After(to) &&
+			(weekEnd.Month() == date.Month() || monthStart(weekEnd).AddDate(0, 1, -1).After(to)) {
+			weeks = append(weeks, date)
+			date = date.AddDate(0, 0, 7)
+			continue
+		}
+
+		days = append(days, date)
+		date = date.AddDate(0, 0, 1)
+	}
+
+	return days, weeks, months
+}
+
+func (db *DB) refreshRollups(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			refreshed, err := db.RefreshRollups(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				db.l.Error("could not refresh rollups", zap.Error(err))
+				pgRollupRefreshErrors.Inc()
+				continue
+			}
+			pgRollupRefreshedPeriods.Add(refreshed)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RefreshRollups recomputes rollup periods of counter dates changed since the last
+// refresh (as logged by the event_counters trigger), it returns how many periods
+// were recomputed.
+func (db *DB) RefreshRollups(ctx context.Context) (int, error) {
+	var refreshed int
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, rollupLockID); err != nil {
+			return fmt.Errorf("could not lock rollups: %w", err)
+		}
+
+		// changes logged by transactions which aren't committed yet stay for the
+		// next refresh
+		rows, err := tx.Query(ctx, `
+			WITH changed AS (
+				DELETE FROM
+					event_counter_changes
+				RETURNING
+					rsvp_date
+			)
+			SELECT DISTINCT rsvp_date FROM changed
+		`)
+		if err != nil {
+			return fmt.Errorf("could not query changed counters: %w", err)
+		}
+
+		dates, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+		if err != nil {
+			return fmt.Errorf("could not query changed counters: %w", err)
+		}
+
+		for _, rollup := range rollups {
+			periods := rollupPeriods(rollup, dates)
+			if len(periods) == 0 {
+				continue
+			}
+
+			if err := refreshRollup(ctx, tx, rollup, periods); err != nil {
+				return err
+			}
+			refreshed += len(periods)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not refresh rollups: %w", err)
+	}
+
+	return refreshed, nil
+}
+
+func rollupPeriods(rollup rollup, dates []time.Time) []time.Time {
+	var (
+		periods []time.Time
+		seen    = make(map[time.Time]bool)
+	)
+	for _, date := range dates {
+		start := rollup.start(date.UTC())
+		if !seen[start] {
+			seen[start] = true
+			periods = append(periods, start)
+		}
+	}
+	return periods
+}
+
+func refreshRollup(ctx context.Context, tx pgx.Tx, rollup rollup, periods []time.Time) error {
+	_, err := tx.Exec(ctx, `DELETE FROM `+rollup.table+` WHERE `+rollup.column+` = ANY($1::date[])`, periods)
+	if err != nil {
+		return fmt.Errorf("could not delete from %v: %w", rollup.table, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO
+			`+rollup.table+` (`+rollup.column+`, source, event_id, confirmed_rsvps, headcount)
+		SELECT
+			periods.start, source, event_id, SUM(confirmed_rsvps), SUM(headcount)
+		FROM
+			unnest($1::date[]) AS periods(start)
+			INNER JOIN event_counters ON
+				rsvp_date >= periods.start AND rsvp_date < periods.start + interval '`+rollup.span+`'
+		GROUP BY
+			periods.start, source, event_id
+		HAVING
+			SUM(confirmed_rsvps) <> 0 OR SUM(headcount) <> 0
+	`, periods)
+	if err != nil {
+		return fmt.Errorf("could not insert into %v: %w", rollup.table, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopkPeriods(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return d
+	}
+	dates := func(ss ...string) []time.Time {
+		ds := []time.Time{}
+		for _, s := range ss {
+			ds = append(ds, date(s))
+		}
+		return ds
+	}
+
+	days, weeks, months := topkPeriods(date("2023-03-05"), date("2023-03-05"))
+	require.Equal(t, dates("2023-03-05"), days)
+	require.Empty(t, weeks)
+	require.Empty(t, months)
+
+	// march is whole, the week of 2023-02-27 overlaps it, 2023-04-03 is a monday
+	days, weeks, months = topkPeriods(date("2023-02-25"), date("2023-04-10"))
+	require.Equal(t, dates("2023-02-25", "2023-02-26", "2023-02-27", "2023-02-28", "2023-04-01", "2023-04-02", "2023-04-10"), days)
+	require.Equal(t, dates("2023-04-03"), weeks)
+	require.Equal(t, dates("2023-03-01"), months)
+
+	// weeks may cross months
+	days, weeks, months = topkPeriods(date("2023-02-27"), date("2023-03-12"))
+	require.Empty(t, days)
+	require.Equal(t, dates("2023-02-27", "2023-03-06"), weeks)
+	require.Empty(t, months)
+
+	days, weeks, months = topkPeriods(date("2023-03-05"), date("2023-03-04"))
+	require.Empty(t, days)
+	require.Empty(t, weeks)
+	require.Empty(t, months)
+}
+
+func TestRollupPeriods(t *testing.T) {
+	dates := []time.Time{
+		time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	require.Equal(t, []time.Time{
+		time.Date(2023, 2, 27, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC),
+	}, rollupPeriods(rollups[0], dates))
+
+	require.Equal(t, []time.Time{
+		time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+	}, rollupPeriods(rollups[1], dates))
+}
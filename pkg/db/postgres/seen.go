@@ -0,0 +1,130 @@
+package postgres
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// seenSet is a bounded LRU of dimension rows (venues, groups, members and events)
+// recently written by this process, with hashes of their contents. Members are
+// never updated once stored, and versioned rows aren't updated by rsvps carrying
+// the info they already hold, whatever their mtimes, so a row which was written
+// with the same contents doesn't have to be sent again. A nil seenSet never reports
+// rows as seen.
+type seenSet struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List // of *seenEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type seenEntry struct {
+	key  string
+	hash uint64
+}
+
+func newSeenSet(size int) *seenSet {
+	if size <= 0 {
+		return nil
+	}
+	return &seenSet{size: size, order: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+// seen tells if the row was written with the same contents.
+func (s *seenSet) seen(key string, hash uint64) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok || elem.Value.(*seenEntry).hash != hash {
+		return false
+	}
+
+	s.order.MoveToFront(elem)
+	return true
+}
+
+// add marks the row as written, it has to be called only after the transaction
+// which wrote the row was committed, and not for versioned rows which hold other
+// info because the stored ones are newer.
+func (s *seenSet) add(key string, hash uint64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		elem.Value.(*seenEntry).hash = hash
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.items[key] = s.order.PushFront(&seenEntry{key: key, hash: hash})
+
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*seenEntry).key)
+	}
+}
+
+func (s *seenSet) remove(key string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.order.Remove(elem)
+		delete(s.items, key)
+	}
+}
+
+// reset forgets all rows, i.e. after they were deleted.
+func (s *seenSet) reset() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.order.Init()
+	s.items = make(map[string]*list.Element, s.size)
+}
+
+func (s *seenSet) len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// dimensionKey identifies a dimension row.
+func dimensionKey(table, source string, id any) string {
+	return fmt.Sprintf("%s\x00%s\x00%v", table, source, id)
+}
+
+// contentHash hashes the values a dimension row is written with.
+func contentHash(values ...any) uint64 {
+	h := fnv.New64a()
+	for _, v := range values {
+		fmt.Fprintf(h, "%v\x00", v)
+	}
+	return h.Sum64()
+}
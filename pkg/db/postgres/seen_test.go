@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet(2)
+
+	var (
+		venue1 = dimensionKey("venues", "default", 1)
+		venue2 = dimensionKey("venues", "default", 2)
+		venue3 = dimensionKey("venues", "default", 3)
+		hash1  = contentHash("venue", 55.75, 37.62)
+		hash2  = contentHash("venue renamed", 55.75, 37.62)
+	)
+
+	require.False(t, s.seen(venue1, hash1))
+
+	s.add(venue1, hash1)
+	require.True(t, s.seen(venue1, hash1))
+	require.False(t, s.seen(venue1, hash2), "contents changed")
+	require.False(t, s.seen(dimensionKey("venues", "eu", 1), hash1), "other source")
+	require.False(t, s.seen(dimensionKey("groups", "default", 1), hash1), "other table")
+
+	// venue1 is used more recently than venue2, so venue2 is evicted
+	s.add(venue2, hash1)
+	require.True(t, s.seen(venue1, hash1))
+	s.add(venue3, hash1)
+	require.Equal(t, 2, s.len())
+	require.True(t, s.seen(venue1, hash1))
+	require.False(t, s.seen(venue2, hash1))
+	require.True(t, s.seen(venue3, hash1))
+
+	s.remove(venue3)
+	require.False(t, s.seen(venue3, hash1))
+
+	s.reset()
+	require.Equal(t, 0, s.len())
+	require.False(t, s.seen(venue1, hash1))
+}
+
+func TestSeenSet_Disabled(t *testing.T) {
+	s := newSeenSet(0)
+
+	s.add("key", 1)
+	require.False(t, s.seen("key", 1))
+	require.Equal(t, 0, s.len())
+}
@@ -0,0 +1,256 @@
+package postgres
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+// topkCounters selects counters of the range (days $1, weeks $2 and months $3, see
+// topkPeriods, and hours from $6 to $7 and from $8 to $9, see topkHours) summed by
+// events of the source $4, or of all sources if it's empty; events are kept if the
+// rank column is positive. If partial, confirmed rsvps from $10 to $11 and from $12
+// to $13, which aren't whole UTC hours, are counted from rsvps.
+func topkCounters(rank string, partial bool) string {
+	var rsvps string
+	if partial {
+		rsvps = `
+		UNION ALL
+		SELECT source, event_id, 1 AS confirmed_rsvps, 1 + guests AS headcount FROM rsvps
+		WHERE response AND ((mtime >= $10 AND mtime < $11) OR (mtime >= $12 AND mtime < $13))`
+	}
+
+	return `
+	counters AS (
+		SELECT source, event_id, confirmed_rsvps, headcount FROM event_counters WHERE rsvp_date = ANY($1::date[])
+		UNION ALL
+		SELECT source, event_id, confirmed_rsvps, headcount FROM event_counters_weekly WHERE week = ANY($2::date[])
+		UNION ALL
+		SELECT source, event_id, confirmed_rsvps, headcount FROM event_counters_monthly WHERE month = ANY($3::date[])
+		UNION ALL
+		SELECT source, event_id, confirmed_rsvps, headcount FROM event_counters_hourly
+		WHERE (rsvp_hour >= $6 AND rsvp_hour < $7) OR (rsvp_hour >= $8 AND rsvp_hour < $9)` + rsvps + `
+	), totals AS (
+		SELECT
+			source, event_id, SUM(confirmed_rsvps) AS confirmed_rsvps, SUM(headcount) AS headcount
+		FROM
+			counters
+		WHERE
+			$4 = '' OR source = $4
+		GROUP BY
+			source, event_id
+		HAVING
+			SUM(` + rank + `) > 0
+	)
+`
+}
+
+// topkRankColumns are the counter columns events are ranked by.
+var topkRankColumns = map[dbpkg.RankBy]string{
+	"":                    "confirmed_rsvps",
+	dbpkg.RankByRSVPs:     "confirmed_rsvps",
+	dbpkg.RankByHeadcount: "headcount",
+}
+
+// topkHours splits the calendar dates (both inclusive) of the location into whole
+// UTC days from first to last, which are read as of the UTC time zone, the ranges
+// of whole UTC hours before and after them, which are read from the hourly
+// counters, and the ranges of the partial hours the dates start and end with, if
+// the offset of the location isn't a whole number of hours (i.e. Asia/Kolkata is
+// +05:30), which are read from rsvps.
+func topkHours(from, to time.Time, loc *time.Location) (first, last time.Time, hours, partial [4]time.Time) {
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc).UTC()
+	end := time.Date(to.Year(), to.Month(), to.Day()+1, 0, 0, 0, 0, loc).UTC()
+
+	startHour := start.Truncate(time.Hour)
+	if startHour.Before(start) {
+		startHour = startHour.Add(time.Hour)
+	}
+	endHour := end.Truncate(time.Hour)
+	partial = [4]time.Time{start, startHour, endHour, end}
+
+	first = start.Truncate(24 * time.Hour)
+	if first.Before(start) {
+		first = first.AddDate(0, 0, 1)
+	}
+	last = end.Truncate(24 * time.Hour)
+
+	if !first.Before(last) {
+		// no whole UTC days, so an empty range of them
+		return first, first.AddDate(0, 0, -1), [4]time.Time{startHour, endHour, endHour, endHour}, partial
+	}
+
+	return first, last.AddDate(0, 0, -1), [4]time.Time{startHour, first, last, endHour}, partial
+}
+
+// topkDimension is how a dimension is selected (as text) and filtered by in topk
+// queries joining events with their groups.
+type topkDimension struct {
+	column  string
+	filter  string // the condition on the value given by the %v parameter
+	lateral string // the join the column needs, if any
+}
+
+// filters only use columns of groups, so that they can be answered by its indexes
+var topkDimensions = map[dbpkg.Dimension]topkDimension{
+	dbpkg.DimensionCountry: {
+		column: `lower(groups.country)`,
+		filter: `lower(groups.country) = lower(%v)`,
+	},
+	dbpkg.DimensionState: {
+		column: `COALESCE(groups.state, '')`,
+		// groups without a state are stored with NULL and grouped under '', the
+		// equality is kept for the index
+		filter: `(groups.state = %[1]v OR (%[1]v = '' AND groups.state IS NULL))`,
+	},
+	dbpkg.DimensionCity: {
+		column: `groups.city`,
+		filter: `groups.city = %v`,
+	},
+	dbpkg.DimensionGroupID: {
+		column: `groups.id::text`,
+		filter: `groups.id = %v`,
+	},
+	dbpkg.DimensionTopic: {
+		column:  `topics.topic->>'urlkey'`,
+		filter:  `groups.topics @> jsonb_build_array(jsonb_build_object('urlkey', %v::text))`,
+		lateral: `CROSS JOIN LATERAL jsonb_array_elements(groups.topics) AS topics(topic)`,
+	},
+}
+
+// topkSQL returns the query of the top k events and its arguments, rows are events
+// followed by values of the group by dimensions.
+func topkSQL(q dbpkg.TopkQuery) (string, []any, error) {
+	var (
+		days, weeks, months []time.Time
+		hours, partial      [4]time.Time
+	)
+	if q.Location == nil || q.Location == time.UTC {
+		days, weeks, months = topkPeriods(q.From, q.To)
+	} else {
+		var first, last time.Time
+		first, last, hours, partial = topkHours(q.From, q.To, q.Location)
+		days, weeks, months = topkPeriods(first, last)
+	}
+
+	args := []any{days, weeks, months, q.Source, q.K, hours[0], hours[1], hours[2], hours[3]}
+
+	// rsvps are only scanned for the partial hours of zones with offsets in
+	// fractions of hours
+	hasPartial := partial[0].Before(partial[1]) || partial[2].Before(partial[3])
+	if hasPartial {
+		args = append(args, partial[0], partial[1], partial[2], partial[3])
+	}
+
+	rank, ok := topkRankColumns[q.RankBy]
+	if !ok {
+		return "", nil, dbpkg.ValidateRankBy(q.RankBy)
+	}
+
+	// the global ranking only joins the top k events
+	if len(q.Filters) == 0 && len(q.GroupBy) == 0 {
+		return `
+			WITH ` + topkCounters(rank, hasPartial) + `, topk AS (
+				SELECT
+					source, event_id, confirmed_rsvps, headcount
+				FROM
+					totals
+				ORDER BY
+					` + rank + ` DESC
+				LIMIT $5
+			)
+			SELECT
+				events.source, events.id, events.name, events.time, events.url, topk.confirmed_rsvps, topk.headcount
+			FROM
+				events INNER JOIN topk ON events.source = topk.source AND events.id = topk.event_id
+			ORDER BY
+				topk.` + rank + ` DESC
+		`, args, nil
+	}
+
+	var (
+		columns   []string
+		partition []string
+		order     []string
+		lateral   string
+		filters   = []string{"TRUE"}
+		grouped   = make(map[dbpkg.Dimension]bool)
+	)
+
+	for i, dim := range q.GroupBy {
+		d, ok := topkDimensions[dim]
+		if !ok {
+			return "", nil, dbpkg.ValidateDimension(dim)
+		}
+		if grouped[dim] {
+			return "", nil, fmt.Errorf("duplicate group by dimension %q", dim)
+		}
+		grouped[dim] = true
+
+		columns = append(columns, fmt.Sprintf("%v AS dim%d", d.column, i))
+		partition = append(partition, d.column)
+		order = append(order, fmt.Sprintf("dim%d", i))
+		if d.lateral != "" {
+			lateral = d.lateral
+		}
+	}
+
+	for dim := range q.Filters {
+		if err := dbpkg.ValidateDimension(dim); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, dim := range dbpkg.Dimensions {
+		if value, ok := q.Filters[dim]; ok {
+			arg, err := topkFilterArg(dim, value)
+			if err != nil {
+				return "", nil, err
+			}
+			args = append(args, arg)
+			filters = append(filters, fmt.Sprintf(topkDimensions[dim].filter, fmt.Sprintf("$%d", len(args))))
+		}
+	}
+
+	over := "ORDER BY totals." + rank + " DESC"
+	if len(partition) > 0 {
+		over = "PARTITION BY " + strings.Join(partition, ", ") + " " + over
+	}
+
+	return `
+		WITH ` + topkCounters(rank, hasPartial) + `, ranked AS (
+			SELECT
+				events.source, events.id, events.name, events.time, events.url, totals.confirmed_rsvps, totals.headcount,
+				` + strings.Join(append(columns, "row_number() OVER ("+over+") AS rank"), ",\n\t\t\t\t") + `
+			FROM
+				totals
+					INNER JOIN events ON events.source = totals.source AND events.id = totals.event_id
+					INNER JOIN groups ON groups.source = events.source AND groups.id = events.group_id
+					` + lateral + `
+			WHERE
+				` + strings.Join(filters, " AND ") + `
+		)
+		SELECT
+			` + strings.Join(append([]string{"source", "id", "name", "time", "url", "confirmed_rsvps", "headcount"}, order...), ", ") + `
+		FROM
+			ranked
+		WHERE
+			rank <= $5
+		ORDER BY
+			` + strings.Join(append(order, rank+" DESC"), ", ") + `
+	`, args, nil
+}
+
+func topkFilterArg(dim dbpkg.Dimension, value string) (any, error) {
+	if dim != dbpkg.DimensionGroupID {
+		return value, nil
+	}
+
+	groupID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group id %q: %w", value, err)
+	}
+	return groupID, nil
+}
@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	dbpkg "github.com/oizgagin/ing/pkg/db"
+)
+
+func TestTopkSQL(t *testing.T) {
+	day := time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC)
+
+	_, args, err := topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10})
+	require.NoError(t, err)
+	require.Len(t, args, 9)
+
+	sql, args, err := topkSQL(dbpkg.TopkQuery{
+		From: day, To: day, K: 10,
+		Filters: map[dbpkg.Dimension]string{dbpkg.DimensionGroupID: "5001", dbpkg.DimensionCountry: "de"},
+		GroupBy: []dbpkg.Dimension{dbpkg.DimensionTopic},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []any{"de", int64(5001)}, args[9:], "filters are in the order of dimensions")
+	require.Contains(t, sql, "jsonb_array_elements")
+	require.Contains(t, sql, "lower(groups.country) = lower($10) AND groups.id = $11")
+
+	// state is grouped by as '' if it's NULL, so it's filtered by the same way
+	sql, args, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, Filters: map[dbpkg.Dimension]string{dbpkg.DimensionState: ""}})
+	require.NoError(t, err)
+	require.Equal(t, []any{""}, args[9:])
+	require.Contains(t, sql, "(groups.state = $10 OR ($10 = '' AND groups.state IS NULL))")
+
+	sql, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, RankBy: dbpkg.RankByHeadcount})
+	require.NoError(t, err)
+	require.Contains(t, sql, "SUM(headcount) > 0")
+	require.Contains(t, sql, "topk.headcount DESC")
+
+	_, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, RankBy: "guests"})
+	require.Error(t, err)
+
+	_, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, Filters: map[dbpkg.Dimension]string{"venue": "1"}})
+	require.Error(t, err)
+
+	_, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, Filters: map[dbpkg.Dimension]string{dbpkg.DimensionGroupID: "abc"}})
+	require.Error(t, err)
+
+	_, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, GroupBy: []dbpkg.Dimension{"venue"}})
+	require.Error(t, err)
+
+	_, _, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, K: 10, GroupBy: []dbpkg.Dimension{dbpkg.DimensionCity, dbpkg.DimensionCity}})
+	require.Error(t, err)
+}
+
+func TestTopkHours(t *testing.T) {
+	day := time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC)
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	// 2023-03-05 in New York is from 05:00 UTC to 05:00 UTC of the next day
+	first, last, hours, _ := topkHours(day, day, newYork)
+	require.True(t, last.Before(first), "no whole utc days")
+	require.Equal(t, [4]time.Time{
+		time.Date(2023, 3, 5, 5, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 5, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 5, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 5, 0, 0, 0, time.UTC),
+	}, hours)
+
+	// daylight saving time starts on 2023-03-12
+	first, last, hours, _ = topkHours(day, day.AddDate(0, 0, 7), newYork)
+	require.Equal(t, time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC), first)
+	require.Equal(t, time.Date(2023, 3, 12, 0, 0, 0, 0, time.UTC), last)
+	require.Equal(t, [4]time.Time{
+		time.Date(2023, 3, 5, 5, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 13, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 13, 4, 0, 0, 0, time.UTC),
+	}, hours)
+
+	// +05:30 starts and ends with partial hours, which are counted from rsvps
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	first, last, hours, partial := topkHours(day, day.AddDate(0, 0, 1), kolkata)
+	require.Equal(t, time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC), first)
+	require.Equal(t, time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC), last)
+	require.Equal(t, [4]time.Time{
+		time.Date(2023, 3, 4, 19, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 18, 0, 0, 0, time.UTC),
+	}, hours)
+	require.Equal(t, [4]time.Time{
+		time.Date(2023, 3, 4, 18, 30, 0, 0, time.UTC),
+		time.Date(2023, 3, 4, 19, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 18, 0, 0, 0, time.UTC),
+		time.Date(2023, 3, 6, 18, 30, 0, 0, time.UTC),
+	}, partial)
+
+	sql, args, err := topkSQL(dbpkg.TopkQuery{From: day, To: day, Location: kolkata, K: 10, Filters: map[dbpkg.Dimension]string{dbpkg.DimensionCity: "Pune"}})
+	require.NoError(t, err)
+	require.Len(t, args, 14)
+	require.Contains(t, sql, "FROM rsvps")
+	require.Contains(t, sql, "groups.city = $14")
+
+	// whole hour zones don't read rsvps
+	sql, args, err = topkSQL(dbpkg.TopkQuery{From: day, To: day, Location: newYork, K: 10})
+	require.NoError(t, err)
+	require.Len(t, args, 9)
+	require.NotContains(t, sql, "FROM rsvps")
+
+	// Lord Howe Island is +10:30 in winter and +11:00 in summer, which starts on
+	// 2023-10-01
+	lordHowe, err := time.LoadLocation("Australia/Lord_Howe")
+	require.NoError(t, err)
+
+	summer := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	_, _, _, partial = topkHours(summer.AddDate(0, 0, 1), summer.AddDate(0, 0, 7), lordHowe)
+	require.Equal(t, partial[0], partial[1])
+	require.Equal(t, partial[2], partial[3])
+	_, _, _, partial = topkHours(summer.AddDate(0, 0, -1), summer, lordHowe)
+	require.Equal(t, time.Date(2023, 9, 29, 13, 30, 0, 0, time.UTC), partial[0])
+	require.Equal(t, time.Date(2023, 9, 29, 14, 0, 0, 0, time.UTC), partial[1])
+	require.Equal(t, partial[2], partial[3])
+}
@@ -0,0 +1,35 @@
+package dlq
+
+import "context"
+
+const (
+	StageDecode = "decode"
+	StageSave   = "save"
+)
+
+// Letter is a message which couldn't be processed, parked with the details of
+// its failure so that it can be audited and replayed later.
+type Letter struct {
+	Key   []byte
+	Value []byte
+
+	Err      string
+	Stage    string
+	Attempts int
+
+	// Topic is the topic the message is replayed to, the one it was read from or,
+	// for pushed rsvps, the one their source is consumed from. Letters without a
+	// topic can't be replayed.
+	Topic     string
+	Partition int
+	Offset    int64
+
+	// Source is the source the rsvp was pushed to, or the Redis stream or the file
+	// it was read from, if it wasn't read from a topic.
+	Source string
+}
+
+type Sink interface {
+	Park(ctx context.Context, letter Letter) error
+	Close() error
+}
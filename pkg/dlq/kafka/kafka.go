@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
+)
+
+const (
+	headerError     = "ing-error"
+	headerStage     = "ing-stage"
+	headerAttempts  = "ing-attempts"
+	headerTopic     = "ing-topic"
+	headerPartition = "ing-partition"
+	headerOffset    = "ing-offset"
+	headerSource    = "ing-source"
+)
+
+// defaultReplayIdleTimeout is used when the replay idle timeout isn't set.
+const defaultReplayIdleTimeout = 10 * time.Second
+
+type Config struct {
+	Brokers      []string             `toml:"brokers"`
+	Topic        string               `toml:"topic"`
+	WriteTimeout configtypes.Duration `toml:"write_timeout"`
+
+	ReplayConsumerGroup string               `toml:"replay_consumer_group"`
+	ReplayIdleTimeout   configtypes.Duration `toml:"replay_idle_timeout"`
+}
+
+type Sink struct {
+	w *kafka.Writer
+}
+
+func NewSink(cfg Config) *Sink {
+	return &Sink{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			WriteTimeout: cfg.WriteTimeout.Duration,
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (s *Sink) Park(ctx context.Context, letter dlq.Letter) error {
+	err := s.w.WriteMessages(ctx, kafka.Message{
+		Key:   letter.Key,
+		Value: letter.Value,
+		Headers: []kafka.Header{
+			{Key: headerError, Value: []byte(letter.Err)},
+			{Key: headerStage, Value: []byte(letter.Stage)},
+			{Key: headerAttempts, Value: []byte(strconv.Itoa(letter.Attempts))},
+			{Key: headerTopic, Value: []byte(letter.Topic)},
+			{Key: headerPartition, Value: []byte(strconv.Itoa(letter.Partition))},
+			{Key: headerOffset, Value: []byte(strconv.FormatInt(letter.Offset, 10))},
+			{Key: headerSource, Value: []byte(letter.Source)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not park message: %w", err)
+	}
+
+	dlqParkedMessages(letter.Stage).Inc()
+
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return s.w.Close()
+}
+
+// Replay reads parked messages and produces them back to the topics they were
+// originally read from. Messages without a topic (i.e. pushed rsvps of sources
+// which aren't consumed from Kafka) are skipped. It returns when no new messages
+// were parked during the idle timeout, defaultReplayIdleTimeout if it isn't set.
+func Replay(ctx context.Context, cfg Config, l *zap.Logger) (int, error) {
+	l = l.With(zap.String("logger", "dlq_replay"))
+
+	idleTimeout := cfg.ReplayIdleTimeout.Duration
+	if idleTimeout <= 0 {
+		idleTimeout = defaultReplayIdleTimeout
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Brokers,
+		GroupID: cfg.ReplayConsumerGroup,
+		Topic:   cfg.Topic,
+	})
+	defer r.Close()
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Balancer:     &kafka.Hash{},
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer w.Close()
+
+	var replayed int
+
+	for {
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, idleTimeout)
+		m, err := r.FetchMessage(fetchCtx)
+		fetchCancel()
+
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return replayed, nil
+			}
+			return replayed, fmt.Errorf("could not fetch parked message: %w", err)
+		}
+
+		topic := header(m, headerTopic)
+		if topic == "" {
+			l.Warn("skipping parked message, it has no topic to be replayed to",
+				zap.Int("partition", m.Partition),
+				zap.Int64("offset", m.Offset),
+				zap.String("source", header(m, headerSource)),
+				zap.String("stage", header(m, headerStage)),
+				zap.String("error", header(m, headerError)),
+			)
+
+			if err := r.CommitMessages(ctx, m); err != nil {
+				return replayed, fmt.Errorf("could not commit skipped message: %w", err)
+			}
+
+			dlqSkippedMessages.Inc()
+			continue
+		}
+
+		l.Debug("replaying parked message",
+			zap.Int("partition", m.Partition),
+			zap.Int64("offset", m.Offset),
+			zap.String("topic", topic),
+			zap.String("stage", header(m, headerStage)),
+			zap.String("error", header(m, headerError)),
+		)
+
+		if err := w.WriteMessages(ctx, kafka.Message{Topic: topic, Key: m.Key, Value: m.Value}); err != nil {
+			return replayed, fmt.Errorf("could not replay parked message: %w", err)
+		}
+
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return replayed, fmt.Errorf("could not commit replayed message: %w", err)
+		}
+
+		replayed++
+		dlqReplayedMessages.Inc()
+	}
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+//go:build e2e
+
+package kafka_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	segmentiokafka "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/dlq/kafka"
+)
+
+func TestSink_ParkReplay(t *testing.T) {
+	const (
+		topic    = "ing_e2e_dlq_test_source_topic"
+		dlqTopic = "ing_e2e_dlq_test_topic"
+	)
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	brokerAddr := os.Getenv("ING_E2E_KAFKA_BROKER_ADDR")
+	require.NotEmpty(t, brokerAddr)
+
+	require.NoError(t, createTopic(ctx, brokerAddr, topic, 10))
+	require.NoError(t, createTopic(ctx, brokerAddr, dlqTopic, 10))
+
+	cfg := kafka.Config{
+		Brokers:             []string{brokerAddr},
+		Topic:               dlqTopic,
+		WriteTimeout:        configtypes.Duration{Duration: 10 * time.Second},
+		ReplayConsumerGroup: "ing_e2e_dlq_test_replay_consumergroup",
+		ReplayIdleTimeout:   configtypes.Duration{Duration: 5 * time.Second},
+	}
+
+	sink := kafka.NewSink(cfg)
+	defer sink.Close()
+
+	letters := []dlq.Letter{
+		{Value: []byte(`{"rsvp_id":`), Err: "unexpected EOF", Stage: dlq.StageDecode, Attempts: 1, Topic: topic, Offset: 1},
+		{Value: []byte(`{"rsvp_id":1}`), Err: "could not insert rsvp", Stage: dlq.StageSave, Attempts: 4, Topic: topic, Offset: 2},
+		// a pushed rsvp of a source which isn't consumed from kafka
+		{Value: []byte(`{"rsvp_id":2}`), Err: "parked by processor", Stage: dlq.StageSave, Attempts: 1, Source: "pushed"},
+	}
+
+	for _, letter := range letters {
+		require.NoError(t, sink.Park(ctx, letter))
+	}
+
+	r := segmentiokafka.NewReader(segmentiokafka.ReaderConfig{Brokers: []string{brokerAddr}, Topic: dlqTopic})
+	defer r.Close()
+
+	for _, letter := range letters {
+		m, err := r.ReadMessage(ctx)
+		require.NoError(t, err)
+		require.Equal(t, letter.Value, m.Value)
+		require.Contains(t, m.Headers, segmentiokafka.Header{Key: "ing-stage", Value: []byte(letter.Stage)})
+		require.Contains(t, m.Headers, segmentiokafka.Header{Key: "ing-error", Value: []byte(letter.Err)})
+		require.Contains(t, m.Headers, segmentiokafka.Header{Key: "ing-attempts", Value: []byte(fmt.Sprint(letter.Attempts))})
+		require.Contains(t, m.Headers, segmentiokafka.Header{Key: "ing-offset", Value: []byte(fmt.Sprint(letter.Offset))})
+		require.Contains(t, m.Headers, segmentiokafka.Header{Key: "ing-source", Value: []byte(letter.Source)})
+	}
+
+	// the letter without a topic is skipped
+	replayed, err := kafka.Replay(ctx, cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.Equal(t, len(letters)-1, replayed)
+
+	sr := segmentiokafka.NewReader(segmentiokafka.ReaderConfig{Brokers: []string{brokerAddr}, Topic: topic})
+	defer sr.Close()
+
+	for _, letter := range letters[:len(letters)-1] {
+		m, err := sr.ReadMessage(ctx)
+		require.NoError(t, err)
+		require.Equal(t, letter.Value, m.Value)
+	}
+}
+
+func createTopic(ctx context.Context, brokerAddr, topic string, maxRetries int) error {
+
+	create := func() error {
+		conn, err := segmentiokafka.DialContext(ctx, "tcp", brokerAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return conn.CreateTopics(segmentiokafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     1,
+			ReplicationFactor: 1,
+		})
+	}
+
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		err = create()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not create topic %v at %v: timeout", topic, brokerAddr)
+		case <-time.After(time.Second):
+		}
+	}
+
+	return fmt.Errorf("could not create topic %v at %v: %v", topic, brokerAddr, err)
+}
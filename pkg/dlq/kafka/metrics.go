@@ -0,0 +1,16 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	dlqReplayedMessages = metrics.NewCounter("dlq_replayed_messages_total")
+	dlqSkippedMessages  = metrics.NewCounter("dlq_skipped_messages_total")
+)
+
+func dlqParkedMessages(stage string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`dlq_parked_messages_total{stage=%q}`, stage))
+}
@@ -0,0 +1,148 @@
+package rsvps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	ReasonMalformed          = "malformed"
+	ReasonUnknownField       = "unknown_field"
+	ReasonTypeMismatch       = "type_mismatch"
+	ReasonUnsupportedVersion = "unsupported_version"
+	ReasonUnknownSchema      = "unknown_schema"
+)
+
+// DecodeError tells why a payload could not be decoded, Reason is one of the
+// Reason* constants.
+type DecodeError struct {
+	// Field is set only if it is known to the decoder
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode rsvp: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Version1 is the format of the Meetup RSVP stream.
+const Version1 = 1
+
+var decoders = map[int]func(data []byte) (RSVP, error){
+	Version1: decodeV1,
+}
+
+// Decode decodes and validates an RSVP. Payloads may carry their format version
+// in the schema_version field, which defaults to Version1.
+//
+// If the payload was decoded but the RSVP is invalid, the RSVP is returned along
+// with a *ValidationError.
+func Decode(data []byte) (RSVP, error) {
+	// json.Unmarshal also rejects trailing data after the payload
+	var header struct {
+		Version int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return RSVP{}, decodeError(err)
+	}
+
+	version := header.Version
+	if version == 0 {
+		version = Version1
+	}
+
+	decode, ok := decoders[version]
+	if !ok {
+		return RSVP{}, &DecodeError{
+			Field:  "schema_version",
+			Reason: ReasonUnsupportedVersion,
+			Err:    fmt.Errorf("unsupported schema version %v", version),
+		}
+	}
+
+	rsvp, err := decode(data)
+	if err != nil {
+		return RSVP{}, err
+	}
+
+	return rsvp, rsvp.Validate()
+}
+
+// RejectReason returns the field and the reason an RSVP was rejected for, to be
+// used as metric labels.
+func RejectReason(err error) (field, reason string) {
+	var (
+		decodeErr     *DecodeError
+		validationErr *ValidationError
+	)
+	switch {
+	case errors.As(err, &decodeErr):
+		return decodeErr.Field, decodeErr.Reason
+	case errors.As(err, &validationErr):
+		return validationErr.Field, validationErr.Reason
+	}
+	return "", ReasonMalformed
+}
+
+// Encode encodes the RSVP in the Version1 format, i.e. so that it's decoded again
+// from its stored payload.
+func Encode(rsvp RSVP) ([]byte, error) {
+	return json.Marshal(wireRSVP{RSVP: rsvp, Group: wireGroup(rsvp.Group)})
+}
+
+// wireRSVP is an RSVP with the keys of the stream, which prefixes all group keys.
+type wireRSVP struct {
+	RSVP
+	Group wireGroup `json:"group"`
+}
+
+type wireGroup struct {
+	ID      int64        `json:"group_id"`
+	Name    string       `json:"group_name"`
+	Country string       `json:"group_country"`
+	State   string       `json:"group_state"`
+	City    string       `json:"group_city"`
+	Lat     float64      `json:"group_lat"`
+	Lon     float64      `json:"group_lon"`
+	Urlname string       `json:"group_urlname"`
+	Topics  []GroupTopic `json:"group_topics"`
+}
+
+func decodeV1(data []byte) (RSVP, error) {
+	var v1 struct {
+		Version int `json:"schema_version"`
+		wireRSVP
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&v1); err != nil {
+		return RSVP{}, decodeError(err)
+	}
+
+	rsvp := v1.RSVP
+	rsvp.Group = Group(v1.Group)
+	return rsvp, nil
+}
+
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &typeErr):
+		return &DecodeError{Field: typeErr.Field, Reason: ReasonTypeMismatch, Err: err}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// Field is left empty as it comes from the payload and may be anything
+		return &DecodeError{Reason: ReasonUnknownField, Err: err}
+	}
+	return &DecodeError{Reason: ReasonMalformed, Err: err}
+}
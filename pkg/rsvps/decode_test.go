@@ -0,0 +1,150 @@
+package rsvps_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+const validRsvp = `{
+	"venue": {"venue_name": "Cafe Vitus", "lon": 121.54731, "lat": 25.052959, "venue_id": 19712922},
+	"visibility": "public",
+	"response": "yes",
+	"guests": 1,
+	"member": {
+		"member_id": 120119272,
+		"photo": "http://photos3.meetupstatic.com/photos/member/thumb_262125756.jpeg",
+		"member_name": "Allen Wang",
+		"other_services": {"twitter": {"identifier": "@allen"}}
+	},
+	"rsvp_id": 1658733801,
+	"mtime": 1489925470960,
+	"event": {
+		"event_name": "Play Intermediate Volleyball",
+		"event_id": "jkpwmlywgbmb",
+		"time": 1491613200000,
+		"event_url": "https://www.meetup.com/Taipei-Sports-and-Social-Club/events/236786445/"
+	},
+	"group": {
+		"group_topics": [{"urlkey": "fitness", "topic_name": "Fitness"}],
+		"group_city": "Taipei",
+		"group_state": "TP",
+		"group_country": "tw",
+		"group_id": 16585312,
+		"group_name": "Taipei Sports and Social Club",
+		"group_lon": 121.45,
+		"group_urlname": "Taipei-Sports-and-Social-Club",
+		"group_lat": 25.02
+	}
+}`
+
+func TestDecode(t *testing.T) {
+
+	t.Run("valid", func(t *testing.T) {
+		rsvp, err := rsvps.Decode([]byte(validRsvp))
+		require.NoError(t, err)
+
+		require.Equal(t, rsvps.RSVP{
+			ID:         1658733801,
+			Mtime:      1489925470960,
+			Guests:     1,
+			Visibility: "public",
+			Response:   "yes",
+			Venue:      rsvps.Venue{ID: 19712922, Name: "Cafe Vitus", Lat: 25.052959, Lon: 121.54731},
+			Member: rsvps.Member{
+				ID:            120119272,
+				Name:          "Allen Wang",
+				Photo:         "http://photos3.meetupstatic.com/photos/member/thumb_262125756.jpeg",
+				OtherServices: map[string]rsvps.MemberService{"twitter": {Identifier: "@allen"}},
+			},
+			Event: rsvps.Event{
+				ID:   "jkpwmlywgbmb",
+				Name: "Play Intermediate Volleyball",
+				URL:  "https://www.meetup.com/Taipei-Sports-and-Social-Club/events/236786445/",
+				Time: 1491613200000,
+			},
+			Group: rsvps.Group{
+				ID:      16585312,
+				Name:    "Taipei Sports and Social Club",
+				Country: "tw",
+				State:   "TP",
+				City:    "Taipei",
+				Lat:     25.02,
+				Lon:     121.45,
+				Urlname: "Taipei-Sports-and-Social-Club",
+				Topics:  []rsvps.GroupTopic{{Urlkey: "fitness", TopicName: "Fitness"}},
+			},
+		}, rsvp)
+	})
+
+	tests := []struct {
+		name    string
+		payload string
+		field   string
+		reason  string
+	}{
+		{"malformed", `{"rsvp_id":`, "", rsvps.ReasonMalformed},
+		{"trailing data", `{"rsvp_id":1} {}`, "", rsvps.ReasonMalformed},
+		{"unknown field", `{"rsvp_id":1,"foo":2}`, "", rsvps.ReasonUnknownField},
+		{"type mismatch", `{"rsvp_id":1,"group":{"group_lat":"25.02"}}`, "group.group_lat", rsvps.ReasonTypeMismatch},
+		{"unsupported version", `{"schema_version":2}`, "schema_version", rsvps.ReasonUnsupportedVersion},
+		{"no rsvp id", `{"mtime":1489925470960}`, "rsvp_id", rsvps.ReasonNotPositive},
+		{"invalid response", replace(`"response": "yes"`, `"response": "maybe"`), "response", rsvps.ReasonNotInEnum},
+		{"invalid visibility", replace(`"visibility": "public"`, `"visibility": "hidden"`), "visibility", rsvps.ReasonNotInEnum},
+		{"mtime in seconds", replace(`"mtime": 1489925470960`, `"mtime": 1489925470`), "mtime", rsvps.ReasonOutOfRange},
+		{"venue lat", replace(`"lat": 25.052959`, `"lat": 125.052959`), "venue.lat", rsvps.ReasonOutOfRange},
+		{"group lon", replace(`"group_lon": 121.45`, `"group_lon": -221.45`), "group.group_lon", rsvps.ReasonOutOfRange},
+		{"no member id", replace(`"member_id": 120119272`, `"member_id": 0`), "member.member_id", rsvps.ReasonNotPositive},
+		{"no event id", replace(`"event_id": "jkpwmlywgbmb"`, `"event_id": ""`), "event.event_id", rsvps.ReasonEmpty},
+		{"no group id", replace(`"group_id": 16585312`, `"group_id": 0`), "group.group_id", rsvps.ReasonNotPositive},
+		{"long country", replace(`"group_country": "tw"`, `"group_country": "twn"`), "group.group_country", rsvps.ReasonTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := rsvps.Decode([]byte(test.payload))
+			require.Error(t, err)
+
+			field, reason := rsvps.RejectReason(err)
+			require.Equal(t, test.field, field)
+			require.Equal(t, test.reason, reason)
+		})
+	}
+
+	t.Run("invalid rsvp is returned", func(t *testing.T) {
+		rsvp, err := rsvps.Decode([]byte(replace(`"response": "yes"`, `"response": "maybe"`)))
+		require.Error(t, err)
+		require.Equal(t, int64(1658733801), rsvp.ID)
+	})
+}
+
+func TestEncode(t *testing.T) {
+	rsvp, err := rsvps.Decode([]byte(validRsvp))
+	require.NoError(t, err)
+
+	raw, err := rsvps.Encode(rsvp)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"group_state":"TP"`)
+
+	decoded, err := rsvps.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, rsvp, decoded)
+
+	// the API and the cache keep their own keys
+	group, err := json.Marshal(rsvp.Group)
+	require.NoError(t, err)
+	require.Contains(t, string(group), `"state":"TP"`)
+	require.Contains(t, string(group), `"topics":[`)
+}
+
+func replace(old, new string) string {
+	replaced := strings.Replace(validRsvp, old, new, 1)
+	if replaced == validRsvp {
+		panic("nothing replaced: " + old)
+	}
+	return replaced
+}
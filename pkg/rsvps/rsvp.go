@@ -1,6 +1,17 @@
 package rsvps
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
 type RSVP struct {
+	// Source is the feed the RSVP was consumed from, it's set by the stream rather
+	// than decoded. All ids of an RSVP are only unique within its source.
+	Source string `json:"-"`
+
 	ID         int64  `json:"rsvp_id"`
 	Mtime      int64  `json:"mtime"`
 	Guests     uint   `json:"guests"`
@@ -11,6 +22,10 @@ type RSVP struct {
 	Member Member `json:"member"`
 	Event  Event  `json:"event"`
 	Group  Group  `json:"group"`
+
+	// Attrs are derived by rsvp processors (i.e. the local date of the event) rather
+	// than decoded, they are stored with the RSVP.
+	Attrs map[string]string `json:"-"`
 }
 
 type Venue struct {
@@ -21,9 +36,16 @@ type Venue struct {
 }
 
 type Member struct {
-	ID    int64  `json:"member_id"`
-	Name  string `json:"member_name"`
-	Photo string `json:"photo"`
+	ID            int64                    `json:"member_id"`
+	Name          string                   `json:"member_name"`
+	Photo         string                   `json:"photo"`
+	OtherServices map[string]MemberService `json:"other_services,omitempty"`
+}
+
+// MemberService is a member's account in another service (i.e. twitter), it is
+// not stored.
+type MemberService struct {
+	Identifier string `json:"identifier"`
 }
 
 type Event struct {
@@ -33,6 +55,8 @@ type Event struct {
 	Time int64  `json:"time"`
 }
 
+// Group is encoded with the keys of the API and the cache, which differ from the
+// keys of the stream (see Decode and Encode).
 type Group struct {
 	ID      int64        `json:"group_id"`
 	Name    string       `json:"group_name"`
@@ -51,6 +75,117 @@ type GroupTopic struct {
 }
 
 type EventInfo struct {
-	Group Group
-	Venue Venue
+	Source string
+	Group  Group
+	Venue  Venue
+}
+
+// Origin tells where an RSVP was read from.
+type Origin struct {
+	Topic      string
+	Partition  int
+	Offset     int64
+	ReceivedAt time.Time
+
+	// ConsumerGroup is set when the offset has to be stored along with the RSVP,
+	// so that consumption can be resumed from the stored offsets.
+	ConsumerGroup string
+}
+
+const (
+	ReasonEmpty       = "empty"
+	ReasonNotPositive = "not_positive"
+	ReasonNotInEnum   = "not_in_enum"
+	ReasonOutOfRange  = "out_of_range"
+	ReasonTooLong     = "too_long"
+)
+
+// ValidationError tells which field of an RSVP is invalid and why, Reason is one
+// of the Reason* constants.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %v: %v", e.Field, strings.ReplaceAll(e.Reason, "_", " "))
+}
+
+// DefaultSource is the source of RSVPs which come from a stream or an API call
+// that doesn't name its source.
+const DefaultSource = "default"
+
+var sourceRe = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+// ValidateSource checks that the source name can be stored, names consist of up
+// to 50 lowercase letters, digits, '-' and '_'.
+func ValidateSource(source string) error {
+	if !sourceRe.MatchString(source) {
+		return fmt.Errorf("invalid source %q, must match %v", source, sourceRe)
+	}
+	return nil
+}
+
+// minMtime is when Meetup was founded, nothing could have been modified before.
+var minMtime = time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+// maxMtimeSkew is how far in the future an mtime may be due to clock skew.
+const maxMtimeSkew = 24 * time.Hour
+
+// Validate checks that the RSVP can be stored and counted.
+func (rsvp RSVP) Validate() error {
+	invalid := func(field, reason string) error {
+		return &ValidationError{Field: field, Reason: reason}
+	}
+
+	switch {
+	case rsvp.ID <= 0:
+		return invalid("rsvp_id", ReasonNotPositive)
+	case rsvp.Mtime < minMtime || rsvp.Mtime > time.Now().Add(maxMtimeSkew).UnixMilli():
+		return invalid("mtime", ReasonOutOfRange)
+	case rsvp.Response != "yes" && rsvp.Response != "no":
+		return invalid("response", ReasonNotInEnum)
+	case rsvp.Visibility != "public" && rsvp.Visibility != "private":
+		return invalid("visibility", ReasonNotInEnum)
+
+	// venue is optional, i.e. for online events
+	case rsvp.Venue.ID < 0:
+		return invalid("venue.venue_id", ReasonOutOfRange)
+	case !validLat(rsvp.Venue.Lat):
+		return invalid("venue.lat", ReasonOutOfRange)
+	case !validLon(rsvp.Venue.Lon):
+		return invalid("venue.lon", ReasonOutOfRange)
+
+	case rsvp.Member.ID <= 0:
+		return invalid("member.member_id", ReasonNotPositive)
+
+	case rsvp.Event.ID == "":
+		return invalid("event.event_id", ReasonEmpty)
+	case len(rsvp.Event.ID) > 100:
+		return invalid("event.event_id", ReasonTooLong)
+
+	case rsvp.Group.ID <= 0:
+		return invalid("group.group_id", ReasonNotPositive)
+	case rsvp.Group.Country == "":
+		return invalid("group.group_country", ReasonEmpty)
+	case len(rsvp.Group.Country) > 2:
+		return invalid("group.group_country", ReasonTooLong)
+	case len(rsvp.Group.State) > 2:
+		return invalid("group.group_state", ReasonTooLong)
+	case len(rsvp.Group.City) > 100:
+		return invalid("group.group_city", ReasonTooLong)
+	case !validLat(rsvp.Group.Lat):
+		return invalid("group.group_lat", ReasonOutOfRange)
+	case !validLon(rsvp.Group.Lon):
+		return invalid("group.group_lon", ReasonOutOfRange)
+	}
+	return nil
+}
+
+func validLat(lat float64) bool {
+	return lat >= -90 && lat <= 90
+}
+
+func validLon(lon float64) bool {
+	return lon >= -180 && lon <= 180
 }
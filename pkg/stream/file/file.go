@@ -0,0 +1,376 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type Config struct {
+	// Paths are files or glob patterns of NDJSON files, optionally gzip or zstd
+	// compressed. Files are read one by one in the order of their names.
+	Paths []string `toml:"paths"`
+
+	// Speed is a multiplier of the original pace of RSVPs (driven by their mtimes),
+	// i.e. 1 replays them at the original speed and 10 is ten times faster.
+	// Zero replays them as fast as possible.
+	Speed float64 `toml:"speed"`
+
+	MaxLineSize int `toml:"max_line_size"`
+
+	// Nacked RSVPs are redelivered up to MaxRedeliveries times after the
+	// RedeliveryBackoff, and then parked.
+	MaxRedeliveries   int                  `toml:"max_redeliveries"`
+	RedeliveryBackoff configtypes.Duration `toml:"redelivery_backoff"`
+}
+
+type Stream struct {
+	l *zap.Logger
+
+	dlq dlq.Sink
+
+	files             []string
+	speed             float64
+	maxLineSize       int
+	maxRedeliveries   int
+	redeliveryBackoff time.Duration
+
+	ch     chan streampkg.Message
+	chOnce sync.Once
+
+	ctxCancel func()
+	wg        sync.WaitGroup
+
+	stats struct {
+		lines           uint64 // atomic
+		nackedMsgs      uint64 // atomic
+		redeliveredMsgs uint64 // atomic
+		parkedMsgs      uint64 // atomic
+		failedFiles     uint64 // atomic
+	}
+}
+
+// NewStream creates a stream replaying the configured files. RSVPs which can't be
+// saved are parked to the dead letter sink, if it is nil they are only logged.
+// If an RSVP can't be parked the replay is stopped, so that it isn't lost.
+func NewStream(cfg Config, logger *zap.Logger, deadLetters dlq.Sink) (*Stream, error) {
+	if cfg.Speed < 0 {
+		return nil, fmt.Errorf("invalid speed %v, must be non-negative", cfg.Speed)
+	}
+	if cfg.MaxRedeliveries < 0 {
+		return nil, fmt.Errorf("invalid max redeliveries %v, must be non-negative", cfg.MaxRedeliveries)
+	}
+
+	var files []string
+	for _, path := range cfg.Paths {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %v: %w", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %v", path)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	maxLineSize := cfg.MaxLineSize
+	if maxLineSize == 0 {
+		maxLineSize = 1 << 20
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := &Stream{
+		l:                 logger.With(zap.String("logger", "file_stream")),
+		dlq:               deadLetters,
+		files:             files,
+		speed:             cfg.Speed,
+		maxLineSize:       maxLineSize,
+		maxRedeliveries:   cfg.MaxRedeliveries,
+		redeliveryBackoff: cfg.RedeliveryBackoff.Duration,
+		ch:                make(chan streampkg.Message),
+		ctxCancel:         cancel,
+	}
+
+	stream.wg.Add(1)
+	go stream.loop(ctx)
+	go stream.metrics(ctx)
+
+	return stream, nil
+}
+
+func (stream *Stream) RSVPS() <-chan streampkg.Message {
+	return stream.ch
+}
+
+func (stream *Stream) Close() error {
+	stream.ctxCancel()
+	stream.wg.Wait()
+	stream.chOnce.Do(func() { close(stream.ch) })
+	return nil
+}
+
+func (stream *Stream) loop(ctx context.Context) {
+	defer stream.wg.Done()
+
+	pacer := newPacer(stream.speed)
+
+	// a file which can't be read (i.e. a truncated archive) doesn't stop the
+	// replay of the following ones
+	var failed int
+	for _, filename := range stream.files {
+		if err := stream.readFile(ctx, filename, pacer); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failed++
+			atomic.AddUint64(&stream.stats.failedFiles, 1)
+			stream.l.Error("could not replay file", zap.String("file", filename), zap.Error(err))
+		}
+	}
+
+	stream.l.Info("replay finished", zap.Int("files", len(stream.files)), zap.Int("failed_files", failed))
+}
+
+func (stream *Stream) readFile(ctx context.Context, filename string, pacer *pacer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open %v: %w", filename, err)
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("could not read %v: %w", filename, err)
+	}
+	defer r.Close()
+
+	l := stream.l.With(zap.String("file", filename))
+
+	l.Info("replaying file")
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), stream.maxLineSize)
+
+	for line := int64(1); scanner.Scan(); line++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddUint64(&stream.stats.lines, 1)
+
+		rsvp, err := rsvps.Decode(raw)
+		if err != nil {
+			fileStreamRejectedLines(rsvps.RejectReason(err)).Inc()
+			l.Error("invalid line", zap.Int64("line", line), zap.Error(err))
+			continue
+		}
+
+		if !pacer.wait(ctx, rsvp.Mtime) {
+			return ctx.Err()
+		}
+
+		origin := rsvps.Origin{Topic: filename, Offset: line, ReceivedAt: time.Now()}
+
+		// scanner reuses its buffer
+		raw = append([]byte(nil), raw...)
+
+		if !stream.send(ctx, rsvp, raw, origin, 1) {
+			return ctx.Err()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %v: %w", filename, err)
+	}
+	return nil
+}
+
+func (stream *Stream) send(ctx context.Context, rsvp rsvps.RSVP, raw []byte, origin rsvps.Origin, attempt int) bool {
+	var once sync.Once
+
+	nack := func(err error) {
+		once.Do(func() { stream.redeliver(ctx, rsvp, raw, origin, attempt, err) })
+	}
+
+	select {
+	case stream.ch <- streampkg.NewMessage(rsvp, raw, origin, nil, nack):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// redeliver sends the nacked message once again after the backoff, or parks it if
+// it must not be redelivered or its redeliveries are exhausted.
+func (stream *Stream) redeliver(ctx context.Context, rsvp rsvps.RSVP, raw []byte, origin rsvps.Origin, attempt int, err error) {
+	atomic.AddUint64(&stream.stats.nackedMsgs, 1)
+
+	l := stream.l.With(
+		zap.String("file", origin.Topic),
+		zap.Int64("line", origin.Offset),
+		zap.Int("attempt", attempt),
+		zap.NamedError("nack_error", err),
+	)
+
+	if park := errors.Is(err, streampkg.ErrPark); park || attempt > stream.maxRedeliveries {
+		if !park {
+			l.Error("redeliveries exhausted")
+		}
+
+		stream.wg.Add(1)
+		go func() {
+			defer stream.wg.Done()
+			stream.park(ctx, l, raw, origin, attempt, err)
+		}()
+		return
+	}
+
+	atomic.AddUint64(&stream.stats.redeliveredMsgs, 1)
+	l.Debug("redelivering rsvp")
+
+	stream.wg.Add(1)
+	go func() {
+		defer stream.wg.Done()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stream.redeliveryBackoff):
+		}
+
+		stream.send(ctx, rsvp, raw, origin, attempt+1)
+	}()
+}
+
+// park hands the message over to the dead letter sink. If it can't be parked the
+// replay is stopped, it has to be resumed from the logged file and line.
+func (stream *Stream) park(ctx context.Context, l *zap.Logger, raw []byte, origin rsvps.Origin, attempts int, err error) {
+	atomic.AddUint64(&stream.stats.parkedMsgs, 1)
+
+	if stream.dlq == nil {
+		l.Error("dropping rsvp, no dead letter sink")
+		return
+	}
+
+	// lines aren't read from a topic, so they can't be replayed
+	letter := dlq.Letter{
+		Value:    raw,
+		Err:      err.Error(),
+		Stage:    dlq.StageSave,
+		Attempts: attempts,
+		Offset:   origin.Offset,
+		Source:   origin.Topic,
+	}
+
+	if parkErr := stream.dlq.Park(ctx, letter); parkErr != nil {
+		if ctx.Err() == nil {
+			l.Error("stopping replay, could not park rsvp", zap.Error(parkErr))
+			stream.ctxCancel()
+		}
+		return
+	}
+
+	l.Info("parked rsvp")
+}
+
+func (stream *Stream) metrics(ctx context.Context) {
+	for {
+		fileStreamLines.Add(int(atomic.SwapUint64(&stream.stats.lines, 0)))
+		fileStreamNackedMessages.Add(int(atomic.SwapUint64(&stream.stats.nackedMsgs, 0)))
+		fileStreamRedeliveredMessages.Add(int(atomic.SwapUint64(&stream.stats.redeliveredMsgs, 0)))
+		fileStreamParkedMessages.Add(int(atomic.SwapUint64(&stream.stats.parkedMsgs, 0)))
+		fileStreamFailedFiles.Add(int(atomic.SwapUint64(&stream.stats.failedFiles, 0)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+func decompress(f io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(f)
+
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// pacer delays RSVPs to replay them at the pace of their mtimes.
+type pacer struct {
+	speed float64
+
+	started    bool
+	firstMtime int64
+	startedAt  time.Time
+}
+
+func newPacer(speed float64) *pacer {
+	return &pacer{speed: speed}
+}
+
+func (p *pacer) wait(ctx context.Context, mtime int64) bool {
+	if p.speed == 0 {
+		return ctx.Err() == nil
+	}
+
+	if !p.started {
+		p.started, p.firstMtime, p.startedAt = true, mtime, time.Now()
+		return ctx.Err() == nil
+	}
+
+	elapsed := time.Duration(float64(mtime-p.firstMtime) / p.speed * float64(time.Millisecond))
+
+	delay := time.Until(p.startedAt.Add(elapsed))
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
@@ -0,0 +1,245 @@
+package file_test
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+	"github.com/oizgagin/ing/pkg/stream/file"
+)
+
+func TestStream(t *testing.T) {
+
+	t.Run("gzip", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		stream, err := file.NewStream(file.Config{Paths: []string{"../kafka/testdata/meetups.json.gz"}}, zaptest.NewLogger(t), nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		want := parseRsvps(t, readGzip(t, "../kafka/testdata/meetups.json.gz"))
+
+		require.Equal(t, want, readStream(t, ctx, stream, len(want)))
+	})
+
+	t.Run("globs, plain and zstd", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		raw := readGzip(t, "../kafka/testdata/meetups.json.gz")
+		lines := strings.Split(raw, "\n")
+		half := len(lines) / 2
+
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "rsvps1.json"), strings.Join(lines[:half], "\n"), nil)
+		writeFile(t, filepath.Join(dir, "rsvps2.json.zst"), strings.Join(lines[half:], "\n"), func(w io.Writer) io.WriteCloser {
+			zw, err := zstd.NewWriter(w)
+			require.NoError(t, err)
+			return zw
+		})
+
+		stream, err := file.NewStream(file.Config{Paths: []string{filepath.Join(dir, "rsvps*")}}, zaptest.NewLogger(t), nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		want := parseRsvps(t, raw)
+
+		require.Equal(t, want, readStream(t, ctx, stream, len(want)))
+	})
+
+	t.Run("original pace", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		var (
+			mtime = time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC).UnixMilli()
+			lines []string
+		)
+		for i := 0; i < 3; i++ {
+			lines = append(lines, rsvpLineAt(i+1, mtime+int64(i)*100))
+		}
+
+		filename := filepath.Join(t.TempDir(), "rsvps.json")
+		writeFile(t, filename, strings.Join(lines, "\n"), nil)
+
+		stream, err := file.NewStream(file.Config{Paths: []string{filename}, Speed: 2}, zaptest.NewLogger(t), nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		start := time.Now()
+		require.Len(t, readStream(t, ctx, stream, len(lines)), len(lines))
+		require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("nacks", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		filename := filepath.Join(t.TempDir(), "rsvps.json")
+		writeFile(t, filename, strings.Join([]string{rsvpLine(1), rsvpLine(2)}, "\n"), nil)
+
+		deadLetters := &sink{}
+
+		stream, err := file.NewStream(file.Config{Paths: []string{filename}, MaxRedeliveries: 1}, zaptest.NewLogger(t), deadLetters)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		// the first rsvp is redelivered once and then parked, the second one is
+		// parked right away
+		var got []int64
+		for len(got) < 3 {
+			select {
+			case msg := <-stream.RSVPS():
+				got = append(got, msg.RSVP.ID)
+				if msg.RSVP.ID == 1 {
+					msg.Nack(errors.New("could not save rsvp"))
+				} else {
+					msg.Nack(fmt.Errorf("invalid rsvp: %w", streampkg.ErrPark))
+				}
+			case <-ctx.Done():
+				t.Fatalf("got %v rsvps", got)
+			}
+		}
+		require.ElementsMatch(t, []int64{1, 1, 2}, got)
+
+		require.Eventually(t, func() bool { return len(deadLetters.parked()) == 2 }, time.Second, 10*time.Millisecond)
+		for _, letter := range deadLetters.parked() {
+			require.Equal(t, filename, letter.Source)
+			require.Empty(t, letter.Topic)
+		}
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "rsvps1.json"), rsvpLine(1), nil)
+		// a gzip header without the rest of the archive
+		writeFile(t, filepath.Join(dir, "rsvps2.json.gz"), "\x1f\x8b", nil)
+		writeFile(t, filepath.Join(dir, "rsvps3.json"), rsvpLine(3), nil)
+
+		stream, err := file.NewStream(file.Config{Paths: []string{filepath.Join(dir, "rsvps*")}}, zaptest.NewLogger(t), nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		got := readStream(t, ctx, stream, 2)
+		require.EqualValues(t, 1, got[0].ID)
+		require.EqualValues(t, 3, got[1].ID)
+	})
+
+	t.Run("no files", func(t *testing.T) {
+		_, err := file.NewStream(file.Config{Paths: []string{filepath.Join(t.TempDir(), "*.json")}}, zaptest.NewLogger(t), nil)
+		require.Error(t, err)
+	})
+}
+
+func rsvpLine(id int) string {
+	return rsvpLineAt(id, time.Date(2023, 3, 5, 12, 0, 0, 0, time.UTC).UnixMilli())
+}
+
+func rsvpLineAt(id int, mtime int64) string {
+	return fmt.Sprintf(
+		`{"rsvp_id":%d,"mtime":%d,"response":"yes","visibility":"public","member":{"member_id":1},"event":{"event_id":"event_id1"},"group":{"group_id":1,"group_country":"us"}}`,
+		id, mtime,
+	)
+}
+
+func readStream(t *testing.T, ctx context.Context, stream *file.Stream, n int) (got []rsvps.RSVP) {
+	t.Helper()
+
+	for len(got) < n {
+		select {
+		case msg := <-stream.RSVPS():
+			msg.Ack()
+			got = append(got, msg.RSVP)
+		case <-ctx.Done():
+			t.Fatalf("got %v rsvps out of %v", len(got), n)
+		}
+	}
+	return got
+}
+
+func readGzip(t *testing.T, filename string) string {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	defer gzr.Close()
+
+	content, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func writeFile(t *testing.T, filename, content string, compress func(w io.Writer) io.WriteCloser) {
+	t.Helper()
+
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress != nil {
+		cw := compress(f)
+		defer func() { require.NoError(t, cw.Close()) }()
+		w = cw
+	}
+
+	_, err = io.WriteString(w, content)
+	require.NoError(t, err)
+}
+
+func parseRsvps(t *testing.T, raw string) (valid []rsvps.RSVP) {
+	t.Helper()
+
+	for _, line := range strings.Split(raw, "\n") {
+		if rsvp, err := rsvps.Decode([]byte(line)); err == nil {
+			valid = append(valid, rsvp)
+		}
+	}
+	return
+}
+
+type sink struct {
+	mu      sync.Mutex
+	letters []dlq.Letter
+}
+
+func (s *sink) Park(ctx context.Context, letter dlq.Letter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *sink) Close() error {
+	return nil
+}
+
+func (s *sink) parked() []dlq.Letter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dlq.Letter(nil), s.letters...)
+}
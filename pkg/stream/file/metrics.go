@@ -0,0 +1,19 @@
+package file
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	fileStreamLines               = metrics.NewCounter("file_stream_lines_total")
+	fileStreamNackedMessages      = metrics.NewCounter("file_stream_nacked_messages_total")
+	fileStreamRedeliveredMessages = metrics.NewCounter("file_stream_redelivered_messages_total")
+	fileStreamParkedMessages      = metrics.NewCounter("file_stream_parked_messages_total")
+	fileStreamFailedFiles         = metrics.NewCounter("file_stream_failed_files_total")
+)
+
+func fileStreamRejectedLines(field, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`file_stream_rejected_lines_total{field=%q,reason=%q}`, field, reason))
+}
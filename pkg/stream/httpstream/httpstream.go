@@ -0,0 +1,303 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+)
+
+type Config struct {
+	URL string `toml:"url"`
+
+	// SinceMtimeParam is the query parameter used to resume the stream from the
+	// mtime of the last received RSVP after a reconnect.
+	SinceMtimeParam string `toml:"since_mtime_param"`
+
+	ConnectTimeout configtypes.Duration `toml:"connect_timeout"`
+	KeepAlive      configtypes.Duration `toml:"keep_alive"`
+
+	// IdleTimeout is how long the connection may stay silent before it is
+	// considered dead and the stream reconnects.
+	IdleTimeout configtypes.Duration `toml:"idle_timeout"`
+
+	MinBackoff configtypes.Duration `toml:"min_backoff"`
+	MaxBackoff configtypes.Duration `toml:"max_backoff"`
+
+	MaxLineSize int `toml:"max_line_size"`
+}
+
+type Stream struct {
+	l *zap.Logger
+
+	client *http.Client
+
+	url             string
+	sinceMtimeParam string
+	idleTimeout     time.Duration
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	maxLineSize     int
+
+	lastMtime int64
+
+	ch     chan streampkg.Message
+	chOnce sync.Once
+
+	ctxCancel func()
+	wg        sync.WaitGroup
+
+	stats struct {
+		connects    uint64 // atomic
+		disconnects uint64 // atomic
+		lines       uint64 // atomic
+		nackedMsgs  uint64 // atomic
+	}
+}
+
+func NewStream(cfg Config, logger *zap.Logger) (*Stream, error) {
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid url %q", cfg.URL)
+	}
+
+	if cfg.MinBackoff.Duration <= 0 || cfg.MaxBackoff.Duration < cfg.MinBackoff.Duration {
+		return nil, fmt.Errorf("invalid backoff [%v, %v]", cfg.MinBackoff.Duration, cfg.MaxBackoff.Duration)
+	}
+
+	maxLineSize := cfg.MaxLineSize
+	if maxLineSize == 0 {
+		maxLineSize = 1 << 20
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout.Duration,
+		KeepAlive: cfg.KeepAlive.Duration,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := &Stream{
+		l: logger.With(zap.String("logger", "http_stream")),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   cfg.ConnectTimeout.Duration,
+				ResponseHeaderTimeout: cfg.ConnectTimeout.Duration,
+			},
+		},
+		url:             cfg.URL,
+		sinceMtimeParam: cfg.SinceMtimeParam,
+		idleTimeout:     cfg.IdleTimeout.Duration,
+		minBackoff:      cfg.MinBackoff.Duration,
+		maxBackoff:      cfg.MaxBackoff.Duration,
+		maxLineSize:     maxLineSize,
+		ch:              make(chan streampkg.Message),
+		ctxCancel:       cancel,
+	}
+
+	stream.wg.Add(1)
+	go stream.loop(ctx)
+	go stream.metrics(ctx)
+
+	return stream, nil
+}
+
+func (stream *Stream) RSVPS() <-chan streampkg.Message {
+	return stream.ch
+}
+
+func (stream *Stream) Close() error {
+	stream.ctxCancel()
+	stream.wg.Wait()
+	stream.client.CloseIdleConnections()
+	stream.chOnce.Do(func() { close(stream.ch) })
+	return nil
+}
+
+func (stream *Stream) loop(ctx context.Context) {
+	defer stream.wg.Done()
+
+	backoff := stream.minBackoff
+
+	for {
+		connected, err := stream.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		atomic.AddUint64(&stream.stats.disconnects, 1)
+
+		if connected {
+			backoff = stream.minBackoff
+		}
+
+		stream.l.Error("http stream disconnected", zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > stream.maxBackoff {
+			backoff = stream.maxBackoff
+		}
+	}
+}
+
+// consume reads the stream till the connection breaks, connected is true if
+// the connection was established.
+func (stream *Stream) consume(ctx context.Context) (connected bool, err error) {
+	connCtx, connCancel := context.WithCancel(ctx)
+	defer connCancel()
+
+	req, err := http.NewRequestWithContext(connCtx, http.MethodGet, stream.streamURL(), nil)
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+
+	resp, err := stream.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not connect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	atomic.AddUint64(&stream.stats.connects, 1)
+	stream.l.Info("http stream connected", zap.Int64("since_mtime", stream.lastMtime))
+
+	var (
+		body io.Reader = resp.Body
+		idle *time.Timer
+	)
+	if stream.idleTimeout > 0 {
+		idle = time.AfterFunc(stream.idleTimeout, connCancel)
+		defer idle.Stop()
+
+		body = &idleReader{r: resp.Body, timer: idle, timeout: stream.idleTimeout}
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), stream.maxLineSize)
+
+	for scanner.Scan() {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			// keep-alive
+			continue
+		}
+
+		atomic.AddUint64(&stream.stats.lines, 1)
+
+		rsvp, err := rsvps.Decode(raw)
+		if err != nil {
+			httpStreamRejectedLines(rsvps.RejectReason(err)).Inc()
+			stream.l.Error("invalid line", zap.Error(err))
+			continue
+		}
+
+		// waiting for the handler doesn't count as idling
+		if idle != nil {
+			idle.Stop()
+		}
+
+		origin := rsvps.Origin{Topic: stream.url, ReceivedAt: time.Now()}
+
+		// scanner reuses its buffer
+		raw = append([]byte(nil), raw...)
+
+		select {
+		case stream.ch <- streampkg.NewMessage(rsvp, raw, origin, nil, stream.nack(rsvp)):
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+
+		if idle != nil {
+			idle.Reset(stream.idleTimeout)
+		}
+
+		if rsvp.Mtime > stream.lastMtime {
+			stream.lastMtime = rsvp.Mtime
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if connCtx.Err() != nil && ctx.Err() == nil {
+			return true, fmt.Errorf("no data for %v", stream.idleTimeout)
+		}
+		return true, err
+	}
+
+	return true, io.EOF
+}
+
+func (stream *Stream) streamURL() string {
+	if stream.lastMtime == 0 || stream.sinceMtimeParam == "" {
+		return stream.url
+	}
+
+	u, _ := url.Parse(stream.url)
+
+	q := u.Query()
+	q.Set(stream.sinceMtimeParam, strconv.FormatInt(stream.lastMtime, 10))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// nack only logs the failure, since the stream can't be rewound to redeliver
+// a single message.
+func (stream *Stream) nack(rsvp rsvps.RSVP) func(err error) {
+	return func(err error) {
+		atomic.AddUint64(&stream.stats.nackedMsgs, 1)
+		stream.l.Error("rsvp was not processed", zap.Int64("rsvp_id", rsvp.ID), zap.Error(err))
+	}
+}
+
+func (stream *Stream) metrics(ctx context.Context) {
+	for {
+		httpStreamConnects.Add(int(atomic.SwapUint64(&stream.stats.connects, 0)))
+		httpStreamDisconnects.Add(int(atomic.SwapUint64(&stream.stats.disconnects, 0)))
+		httpStreamLines.Add(int(atomic.SwapUint64(&stream.stats.lines, 0)))
+		httpStreamNackedMessages.Add(int(atomic.SwapUint64(&stream.stats.nackedMsgs, 0)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// idleReader postpones the idle timer on every successful read.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package httpstream_test
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	"github.com/oizgagin/ing/pkg/stream/httpstream"
+)
+
+func TestStream(t *testing.T) {
+
+	t.Run("reconnects and resumes", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		feed := newFeed(t)
+		half := len(feed.lines) / 2
+
+		// handlers run off the test goroutine, so they can't stop the test
+		server := httptest.NewServer(feed.handler(func(conn int, w http.ResponseWriter, r *http.Request) {
+			switch conn {
+			case 1:
+				assert.Empty(t, r.URL.Query().Get("since_mtime"))
+				feed.write(w, feed.lines[:half])
+			default:
+				assert.Equal(t, fmt.Sprint(feed.mtimes[half-1]), r.URL.Query().Get("since_mtime"))
+				feed.write(w, feed.lines[half:])
+				<-r.Context().Done()
+			}
+		}))
+		defer server.Close()
+
+		stream := newStream(t, server.URL, 0)
+		defer stream.Close()
+
+		require.Equal(t, feed.rsvps, readStream(t, ctx, stream, len(feed.rsvps)))
+	})
+
+	t.Run("reconnects on idle connection", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		feed := newFeed(t)
+
+		server := httptest.NewServer(feed.handler(func(conn int, w http.ResponseWriter, r *http.Request) {
+			switch conn {
+			case 1:
+				feed.write(w, feed.lines[:1])
+			default:
+				feed.write(w, feed.lines[1:])
+			}
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		stream := newStream(t, server.URL, 200*time.Millisecond)
+		defer stream.Close()
+
+		require.Equal(t, feed.rsvps, readStream(t, ctx, stream, len(feed.rsvps)))
+	})
+}
+
+func newStream(t *testing.T, url string, idleTimeout time.Duration) *httpstream.Stream {
+	t.Helper()
+
+	stream, err := httpstream.NewStream(httpstream.Config{
+		URL:             url,
+		SinceMtimeParam: "since_mtime",
+		ConnectTimeout:  configtypes.Duration{Duration: time.Second},
+		IdleTimeout:     configtypes.Duration{Duration: idleTimeout},
+		MinBackoff:      configtypes.Duration{Duration: 10 * time.Millisecond},
+		MaxBackoff:      configtypes.Duration{Duration: 100 * time.Millisecond},
+	}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	return stream
+}
+
+func readStream(t *testing.T, ctx context.Context, stream *httpstream.Stream, n int) (got []rsvps.RSVP) {
+	t.Helper()
+
+	for len(got) < n {
+		select {
+		case msg := <-stream.RSVPS():
+			msg.Ack()
+			got = append(got, msg.RSVP)
+		case <-ctx.Done():
+			t.Fatalf("got %v rsvps out of %v", len(got), n)
+		}
+	}
+	return got
+}
+
+// feed serves valid rsvps from the testdata ordered by their mtimes
+type feed struct {
+	lines  []string
+	mtimes []int64
+	rsvps  []rsvps.RSVP
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newFeed(t *testing.T) *feed {
+	t.Helper()
+
+	f, err := os.Open("../kafka/testdata/meetups.json.gz")
+	require.NoError(t, err)
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	defer gzr.Close()
+
+	content, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+
+	type entry struct {
+		line string
+		rsvp rsvps.RSVP
+	}
+
+	var entries []entry
+	for _, line := range strings.Split(string(content), "\n") {
+		if rsvp, err := rsvps.Decode([]byte(line)); err == nil {
+			entries = append(entries, entry{line: line, rsvp: rsvp})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].rsvp.Mtime < entries[j].rsvp.Mtime })
+
+	var fd feed
+	for _, e := range entries {
+		fd.lines = append(fd.lines, e.line)
+		fd.mtimes = append(fd.mtimes, e.rsvp.Mtime)
+		fd.rsvps = append(fd.rsvps, e.rsvp)
+	}
+
+	return &fd
+}
+
+func (f *feed) handler(serve func(conn int, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.conns++
+		conn := f.conns
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		serve(conn, w, r)
+	}
+}
+
+func (f *feed) write(w http.ResponseWriter, lines []string) {
+	for _, line := range lines {
+		io.WriteString(w, line+"\n")
+	}
+	w.(http.Flusher).Flush()
+}
@@ -0,0 +1,18 @@
+package httpstream
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	httpStreamConnects       = metrics.NewCounter("http_stream_connects_total")
+	httpStreamDisconnects    = metrics.NewCounter("http_stream_disconnects_total")
+	httpStreamLines          = metrics.NewCounter("http_stream_lines_total")
+	httpStreamNackedMessages = metrics.NewCounter("http_stream_nacked_messages_total")
+)
+
+func httpStreamRejectedLines(field, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`http_stream_rejected_lines_total{field=%q,reason=%q}`, field, reason))
+}
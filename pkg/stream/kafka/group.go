@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+)
+
+// groupLoop consumes assigned partitions starting from the offsets stored in the
+// database. Each partition has at most one message in flight, so the stored offset
+// is always the offset of the last processed message of the partition.
+func (stream *Stream) groupLoop(ctx context.Context) {
+	defer stream.wg.Done()
+
+	for {
+		gen, err := stream.group.Next(ctx)
+		if err != nil {
+			return
+		}
+
+		stream.l.Info("joined consumer group generation", zap.Int32("generation", gen.ID))
+
+		for _, assignment := range gen.Assignments[stream.topic] {
+			partition, offset := assignment.ID, assignment.Offset
+
+			gen.Start(func(ctx context.Context) {
+				stream.partitionLoop(ctx, partition, offset)
+			})
+		}
+	}
+}
+
+func (stream *Stream) partitionLoop(ctx context.Context, partition int, offset int64) {
+	l := stream.l.With(zap.Int("partition", partition))
+
+	stored, ok, err := stream.storedOffset(ctx, partition)
+	if err != nil {
+		return
+	}
+	if ok {
+		offset = stored + 1
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     stream.brokers,
+		Topic:       stream.topic,
+		Partition:   partition,
+		Logger:      kafka.LoggerFunc(stream.kafkaLogger.log),
+		ErrorLogger: kafka.LoggerFunc(stream.kafkaLogger.errorLog),
+	})
+	defer r.Close()
+
+	if err := r.SetOffset(offset); err != nil {
+		l.Error("could not set partition offset", zap.Int64("offset", offset), zap.Error(err))
+		return
+	}
+
+	l.Info("consuming partition", zap.Int64("offset", offset))
+
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return
+		}
+
+		if !stream.process(ctx, m) {
+			return
+		}
+	}
+}
+
+func (stream *Stream) storedOffset(ctx context.Context, partition int) (int64, bool, error) {
+	for {
+		offsets, err := stream.store.ConsumerOffsets(ctx, stream.consumerGroup, stream.topic)
+		if err == nil {
+			offset, ok := offsets[partition]
+			return offset, ok, nil
+		}
+
+		stream.l.Error("could not get stored offsets", zap.Int("partition", partition), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		case <-time.After(stream.redeliveryBackoff):
+		}
+	}
+}
+
+// process delivers the message and waits till it's acked, redelivering or parking
+// it on nacks. It returns false if the partition has to be stopped.
+func (stream *Stream) process(ctx context.Context, m kafka.Message) bool {
+	l := stream.l.With(
+		zap.Int("partition", m.Partition),
+		zap.Int64("offset", m.Offset),
+	)
+
+	l.Debug("received kafka message")
+
+	rsvp, err := stream.decode(ctx, m)
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		kafkaRejectedMessages(rsvps.RejectReason(err)).Inc()
+		l.Error("invalid kafka message", zap.Error(err))
+		return stream.parkOrStop(ctx, l, m, dlq.StageDecode, 1, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var (
+			once   sync.Once
+			result = make(chan error, 1)
+		)
+
+		ack := func() { once.Do(func() { result <- nil }) }
+		nack := func(err error) { once.Do(func() { result <- err }) }
+
+		select {
+		case stream.ch <- stream.message(m, rsvp, ack, nack):
+		case <-ctx.Done():
+			return false
+		}
+
+		// the message has been received, so it is going to be either acked or nacked
+		err := <-result
+		if err == nil {
+			return true
+		}
+
+		if errors.Is(err, streampkg.ErrPark) {
+			return stream.parkOrStop(ctx, l, m, dlq.StageSave, attempt, err)
+		}
+
+		if attempt > stream.maxRedeliveries {
+			l.Error("redeliveries exhausted", zap.Int("attempt", attempt), zap.NamedError("nack_error", err))
+			return stream.parkOrStop(ctx, l, m, dlq.StageSave, attempt, err)
+		}
+
+		atomic.AddUint64(&stream.stats.redeliveredMsgs, 1)
+		l.Debug("redelivering kafka message", zap.Int("attempt", attempt), zap.NamedError("nack_error", err))
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(stream.redeliveryBackoff):
+		}
+	}
+}
+
+// parkOrStop parks the message. If it couldn't be parked the partition has to be
+// stopped, as the offsets of the following messages would skip it; it's consumed
+// again from the stored offset after the next rebalance.
+func (stream *Stream) parkOrStop(ctx context.Context, l *zap.Logger, m kafka.Message, stage string, attempts int, err error) bool {
+	if stream.park(ctx, m, stage, attempts, err) {
+		return true
+	}
+	if ctx.Err() == nil {
+		l.Error("stopping partition, could not park kafka message")
+	}
+	return false
+}
@@ -2,7 +2,7 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -11,8 +11,31 @@ import (
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 
+	"github.com/oizgagin/ing/pkg/codec"
+	"github.com/oizgagin/ing/pkg/codec/avro"
 	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
 	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+)
+
+const (
+	// OffsetStorageBroker commits offsets to the consumer group on the broker
+	// after messages are acked, which gives at-least-once processing.
+	OffsetStorageBroker = "broker"
+
+	// OffsetStorageDB stores offsets in the database in the same transaction as
+	// the RSVPs, and partitions are resumed from the stored offsets, which gives
+	// exactly-once processing.
+	OffsetStorageDB = "db"
+)
+
+const (
+	// parkAttempts bounds the attempts to park a message and to mark it as done.
+	parkAttempts = 5
+	// minParkBackoff is the least pause between the attempts, so that they don't
+	// spin with a zero redelivery backoff.
+	minParkBackoff = 100 * time.Millisecond
 )
 
 type Config struct {
@@ -21,30 +44,94 @@ type Config struct {
 	ConsumerGroup      string               `toml:"consumer_group"`
 	SessionTimeout     configtypes.Duration `toml:"session_timeout"`
 	AutocommitInterval configtypes.Duration `toml:"autocommit_interval"`
+	OffsetStorage      string               `toml:"offset_storage"`
+	MaxRedeliveries    int                  `toml:"max_redeliveries"`
+	RedeliveryBackoff  configtypes.Duration `toml:"redelivery_backoff"`
+	WriteTimeout       configtypes.Duration `toml:"write_timeout"`
+
+	// Codecs maps topics to payload codecs ("json", "avro" or "protobuf"), topics
+	// which aren't listed are decoded as JSON.
+	Codecs         map[string]string   `toml:"codecs"`
+	SchemaRegistry avro.RegistryConfig `toml:"schema-registry"`
+}
+
+// OffsetStore keeps consumer offsets when they are stored in the database.
+type OffsetStore interface {
+	ConsumerOffsets(ctx context.Context, consumerGroup, topic string) (map[int]int64, error)
+	SaveConsumerOffset(ctx context.Context, origin rsvps.Origin) error
 }
 
 type Stream struct {
-	r *kafka.Reader
+	r     *kafka.Reader        // set when offsets are stored at the broker
+	group *kafka.ConsumerGroup // set when offsets are stored in the database
+	store OffsetStore
 
 	l *zap.Logger
 
-	ch     chan rsvps.RSVP
+	dlq dlq.Sink
+
+	codecs       map[string]*codec.Codec
+	defaultCodec *codec.Codec
+
+	ch     chan streampkg.Message
 	chOnce sync.Once
 
+	offsets  *offsetTracker
+	commitMu sync.Mutex
+
+	brokers       []string
+	topic         string
+	consumerGroup string
+
+	maxRedeliveries   int
+	redeliveryBackoff time.Duration
+
+	kafkaLogger *kafkaLogger
+
+	ctx       context.Context
 	ctxCancel func()
+	wg        sync.WaitGroup
 
 	stats struct {
-		invalidMsgs uint64 // atomic
+		redeliveredMsgs uint64 // atomic
+		parkedMsgs      uint64 // atomic
 	}
 }
 
-func NewStream(cfg Config, logger *zap.Logger) *Stream {
+// NewStream creates a stream reading from the configured topic. Messages which
+// can't be decoded or saved are parked to the dead letter sink, if it is nil they
+// are only logged. The offset store is only used with the "db" offset storage.
+func NewStream(cfg Config, logger *zap.Logger, deadLetters dlq.Sink, store OffsetStore) (*Stream, error) {
 	kafkaLogger := newKafkaLogger(logger)
 
+	codecs, err := newCodecs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	stream := &Stream{
-		r: kafka.NewReader(kafka.ReaderConfig{
+		store:             store,
+		l:                 logger.With(zap.String("logger", "kafka_stream")),
+		dlq:               deadLetters,
+		codecs:            codecs,
+		defaultCodec:      codecs[""],
+		ch:                make(chan streampkg.Message),
+		offsets:           newOffsetTracker(),
+		brokers:           cfg.Brokers,
+		topic:             cfg.Topic,
+		consumerGroup:     cfg.ConsumerGroup,
+		maxRedeliveries:   cfg.MaxRedeliveries,
+		redeliveryBackoff: cfg.RedeliveryBackoff.Duration,
+		kafkaLogger:       kafkaLogger,
+		ctx:               ctx,
+		ctxCancel:         cancel,
+	}
+
+	switch cfg.OffsetStorage {
+	case "", OffsetStorageBroker:
+		stream.r = kafka.NewReader(kafka.ReaderConfig{
 			Brokers:        cfg.Brokers,
 			GroupID:        cfg.ConsumerGroup,
 			Topic:          cfg.Topic,
@@ -52,32 +139,96 @@ func NewStream(cfg Config, logger *zap.Logger) *Stream {
 			CommitInterval: cfg.AutocommitInterval.Duration,
 			Logger:         kafka.LoggerFunc(kafkaLogger.log),
 			ErrorLogger:    kafka.LoggerFunc(kafkaLogger.errorLog),
-		}),
-		l:         logger.With(zap.String("logger", "kafka_stream")),
-		ch:        make(chan rsvps.RSVP),
-		ctxCancel: cancel,
+		})
+
+		stream.wg.Add(1)
+		go stream.loop(ctx)
+
+	case OffsetStorageDB:
+		if store == nil {
+			cancel()
+			return nil, fmt.Errorf("no offset store for %q offset storage", cfg.OffsetStorage)
+		}
+
+		group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+			ID:             cfg.ConsumerGroup,
+			Brokers:        cfg.Brokers,
+			Topics:         []string{cfg.Topic},
+			SessionTimeout: cfg.SessionTimeout.Duration,
+			Logger:         kafka.LoggerFunc(kafkaLogger.log),
+			ErrorLogger:    kafka.LoggerFunc(kafkaLogger.errorLog),
+		})
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("could not create consumer group: %w", err)
+		}
+		stream.group = group
+
+		stream.wg.Add(1)
+		go stream.groupLoop(ctx)
+
+	default:
+		cancel()
+		return nil, fmt.Errorf("invalid offset storage %q, must be in (%q or %q)", cfg.OffsetStorage, OffsetStorageBroker, OffsetStorageDB)
 	}
 
-	go stream.loop(ctx)
 	go stream.metrics(ctx)
 
-	return stream
+	return stream, nil
+}
+
+// newCodecs creates the codecs of the configured topics, the codec of the ""
+// topic is used for the topics which aren't configured.
+func newCodecs(cfg Config) (map[string]*codec.Codec, error) {
+	var registry *avro.Registry
+	if cfg.SchemaRegistry.URL != "" {
+		registry = avro.NewRegistry(cfg.SchemaRegistry)
+	}
+
+	codecs := make(map[string]*codec.Codec)
+
+	for topic, name := range cfg.Codecs {
+		c, err := codec.New(name, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid codec of topic %q: %w", topic, err)
+		}
+		codecs[topic] = c
+	}
+
+	if _, ok := codecs[""]; !ok {
+		codecs[""], _ = codec.New(codec.JSON, nil)
+	}
+
+	return codecs, nil
 }
 
-func (stream *Stream) RSVPS() <-chan rsvps.RSVP {
+func (stream *Stream) RSVPS() <-chan streampkg.Message {
 	return stream.ch
 }
 
 func (stream *Stream) Close() error {
-	err := stream.r.Close()
 	stream.ctxCancel()
+
+	var err error
+	if stream.group != nil {
+		err = stream.group.Close()
+	}
+
+	stream.wg.Wait()
+
+	if stream.r != nil {
+		err = stream.r.Close()
+	}
+
 	stream.chOnce.Do(func() { close(stream.ch) })
 	return err
 }
 
 func (stream *Stream) loop(ctx context.Context) {
+	defer stream.wg.Done()
+
 	for {
-		m, err := stream.r.ReadMessage(ctx)
+		m, err := stream.r.FetchMessage(ctx)
 		if err != nil {
 			return
 		}
@@ -89,33 +240,284 @@ func (stream *Stream) loop(ctx context.Context) {
 
 		l.Debug("received kafka message")
 
-		var rsvp rsvps.RSVP
-		if err := json.Unmarshal(m.Value, &rsvp); err != nil {
-			atomic.AddUint64(&stream.stats.invalidMsgs, 1)
+		stream.offsets.track(m.Partition, m.Offset)
+
+		rsvp, err := stream.decode(ctx, m)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			kafkaRejectedMessages(rsvps.RejectReason(err)).Inc()
 			l.Error("invalid kafka message", zap.Error(err))
+
+			// the message isn't committed till it's parked, so that the loop
+			// doesn't wait for the dead letter sink
+			stream.wg.Add(1)
+			go func(m kafka.Message, err error) {
+				defer stream.wg.Done()
+				stream.park(ctx, m, dlq.StageDecode, 1, err)
+			}(m, err)
 			continue
 		}
 
+		if !stream.send(ctx, m, rsvp, 1) {
+			return
+		}
+	}
+}
+
+// decode decodes the message with the codec of its topic, retrying while it fails
+// for a temporary reason, i.e. the schema registry is down. It returns the
+// context error if the context is done meanwhile.
+func (stream *Stream) decode(ctx context.Context, m kafka.Message) (rsvps.RSVP, error) {
+	c := stream.codec(m.Topic)
+
+	for {
+		rsvp, err := c.Decode(ctx, m.Value)
+		if !codec.Temporary(err) {
+			return rsvp, err
+		}
+
+		stream.l.Error("could not decode kafka message, retrying",
+			zap.Int("partition", m.Partition),
+			zap.Int64("offset", m.Offset),
+			zap.String("codec", c.Name()),
+			zap.Error(err),
+		)
+
 		select {
-		case stream.ch <- rsvp:
 		case <-ctx.Done():
+			return rsvps.RSVP{}, ctx.Err()
+		case <-time.After(stream.redeliveryBackoff):
+		}
+	}
+}
+
+// codec returns the codec of the topic.
+func (stream *Stream) codec(topic string) *codec.Codec {
+	if c, ok := stream.codecs[topic]; ok {
+		return c
+	}
+	return stream.defaultCodec
+}
+
+func (stream *Stream) send(ctx context.Context, m kafka.Message, rsvp rsvps.RSVP, attempt int) bool {
+	msg := stream.newMessage(m, rsvp, attempt)
+
+	select {
+	case stream.ch <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (stream *Stream) newMessage(m kafka.Message, rsvp rsvps.RSVP, attempt int) streampkg.Message {
+	var once sync.Once
+
+	ack := func() {
+		once.Do(func() {
+			if err := stream.done(m); err != nil {
+				stream.l.Error("could not mark kafka message as done",
+					zap.Int("partition", m.Partition),
+					zap.Int64("offset", m.Offset),
+					zap.Error(err),
+				)
+			}
+		})
+	}
+
+	nack := func(err error) {
+		once.Do(func() { stream.redeliver(m, rsvp, attempt, err) })
+	}
+
+	return stream.message(m, rsvp, ack, nack)
+}
+
+// message carries the payload as is, so that it's stored and can be reprocessed
+// with the codec of its topic.
+func (stream *Stream) message(m kafka.Message, rsvp rsvps.RSVP, ack func(), nack func(err error)) streampkg.Message {
+	msg := streampkg.NewMessage(rsvp, m.Value, stream.origin(m), ack, nack)
+	msg.Codec = stream.codec(m.Topic).Name()
+	return msg
+}
+
+func (stream *Stream) redeliver(m kafka.Message, rsvp rsvps.RSVP, attempt int, err error) {
+	l := stream.l.With(
+		zap.Int("partition", m.Partition),
+		zap.Int64("offset", m.Offset),
+		zap.Int("attempt", attempt),
+		zap.NamedError("nack_error", err),
+	)
+
+	if park := errors.Is(err, streampkg.ErrPark); park || attempt > stream.maxRedeliveries {
+		if !park {
+			l.Error("redeliveries exhausted")
+		}
+
+		stream.wg.Add(1)
+		go func() {
+			defer stream.wg.Done()
+			stream.park(stream.ctx, m, dlq.StageSave, attempt, err)
+		}()
+		return
+	}
+
+	atomic.AddUint64(&stream.stats.redeliveredMsgs, 1)
+	l.Debug("redelivering kafka message")
+
+	stream.wg.Add(1)
+	go func() {
+		defer stream.wg.Done()
+
+		select {
+		case <-stream.ctx.Done():
 			return
+		case <-time.After(stream.redeliveryBackoff):
+		}
+
+		stream.send(stream.ctx, m, rsvp, attempt+1)
+	}()
+}
+
+// park hands the message over to the dead letter sink and marks it as done. Both
+// are retried up to parkAttempts times, unless the context is done meanwhile; if
+// they fail the message isn't marked as done and will be fetched again. It reports
+// whether the message was parked and marked as done.
+func (stream *Stream) park(ctx context.Context, m kafka.Message, stage string, attempts int, err error) bool {
+	l := stream.l.With(
+		zap.Int("partition", m.Partition),
+		zap.Int64("offset", m.Offset),
+		zap.String("stage", stage),
+	)
+
+	atomic.AddUint64(&stream.stats.parkedMsgs, 1)
+
+	if stream.dlq == nil {
+		l.Error("dropping kafka message, no dead letter sink", zap.Error(err))
+		return stream.markDone(ctx, l, m)
+	}
+
+	letter := dlq.Letter{
+		Key:       m.Key,
+		Value:     m.Value,
+		Err:       err.Error(),
+		Stage:     stage,
+		Attempts:  attempts,
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+	}
+
+	parked := stream.retryPark(ctx, l, "could not park kafka message", func() error {
+		return stream.dlq.Park(ctx, letter)
+	})
+	if !parked {
+		return false
+	}
+
+	l.Info("parked kafka message")
+
+	return stream.markDone(ctx, l, m)
+}
+
+// markDone marks the parked message as done. Otherwise the message would be
+// fetched and parked once again after a restart.
+func (stream *Stream) markDone(ctx context.Context, l *zap.Logger, m kafka.Message) bool {
+	return stream.retryPark(ctx, l, "could not mark kafka message as done", func() error {
+		return stream.done(m)
+	})
+}
+
+// retryPark calls f until it succeeds, up to parkAttempts times, pausing for the
+// redelivery backoff but at least minParkBackoff between the calls.
+func (stream *Stream) retryPark(ctx context.Context, l *zap.Logger, msg string, f func() error) bool {
+	backoff := stream.redeliveryBackoff
+	if backoff < minParkBackoff {
+		backoff = minParkBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return true
+		}
+
+		l.Error(msg, zap.Int("attempt", attempt), zap.Error(err))
+
+		if attempt == parkAttempts {
+			kafkaParkFailures.Inc()
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
 		}
 	}
 }
 
+// done marks the message as processed. Saved RSVPs store their offsets by
+// themselves when offsets are kept in the database, so it only matters for
+// messages which were parked or dropped.
+func (stream *Stream) done(m kafka.Message) error {
+	if stream.group != nil {
+		if err := stream.store.SaveConsumerOffset(stream.ctx, stream.origin(m)); err != nil {
+			return fmt.Errorf("could not save consumer offset: %w", err)
+		}
+		return nil
+	}
+
+	stream.commit(m)
+	return nil
+}
+
+func (stream *Stream) commit(m kafka.Message) {
+	// commits are serialized so that a lower offset never overwrites a higher one
+	stream.commitMu.Lock()
+	defer stream.commitMu.Unlock()
+
+	offset, ok := stream.offsets.markDone(m.Partition, m.Offset)
+	if !ok {
+		return
+	}
+
+	commitMsg := kafka.Message{Topic: m.Topic, Partition: m.Partition, Offset: offset}
+
+	if err := stream.r.CommitMessages(stream.ctx, commitMsg); err != nil {
+		stream.l.Error("could not commit kafka offset",
+			zap.Int("partition", m.Partition),
+			zap.Int64("offset", offset),
+			zap.Error(err),
+		)
+	}
+}
+
+func (stream *Stream) origin(m kafka.Message) rsvps.Origin {
+	origin := rsvps.Origin{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, ReceivedAt: time.Now()}
+	if stream.group != nil {
+		origin.ConsumerGroup = stream.consumerGroup
+	}
+	return origin
+}
+
 func (stream *Stream) metrics(ctx context.Context) {
 	for {
-		stats := stream.r.Stats()
-
-		kafkaDials.Set(uint64(stats.Dials))
-		kafkaFetches.Set(uint64(stats.Fetches))
-		kafkaMessages.Set(uint64(stats.Messages))
-		kafkaInvalidMessages.Set(atomic.LoadUint64(&stream.stats.invalidMsgs))
-		kafkaBytes.Set(uint64(stats.Bytes))
-		kafkaRebalances.Set(uint64(stats.Rebalances))
-		kafkaTimeouts.Set(uint64(stats.Timeouts))
-		kafkaErrors.Set(uint64(stats.Errors))
+		if stream.r != nil {
+			stats := stream.r.Stats()
+
+			kafkaDials.Add(int(stats.Dials))
+			kafkaFetches.Add(int(stats.Fetches))
+			kafkaMessages.Add(int(stats.Messages))
+			kafkaBytes.Add(int(stats.Bytes))
+			kafkaRebalances.Add(int(stats.Rebalances))
+			kafkaTimeouts.Add(int(stats.Timeouts))
+			kafkaErrors.Add(int(stats.Errors))
+		}
+
+		kafkaRedeliveredMessages.Add(int(atomic.SwapUint64(&stream.stats.redeliveredMsgs, 0)))
+		kafkaParkedMessages.Add(int(atomic.SwapUint64(&stream.stats.parkedMsgs, 0)))
 
 		select {
 		case <-ctx.Done():
@@ -5,7 +5,6 @@ package kafka_test
 import (
 	"compress/gzip"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -42,16 +41,17 @@ func TestStream(t *testing.T) {
 	brokerAddr, producer, logger, rawRsvps, tearDown := setUp(t, ctx, topic)
 	defer tearDown(t)
 
-	stream := kafka.NewStream(kafka.Config{
+	stream, err := kafka.NewStream(kafka.Config{
 		Brokers:            []string{brokerAddr},
 		Topic:              topic,
 		ConsumerGroup:      consumerGroup,
 		SessionTimeout:     configtypes.Duration{Duration: time.Minute},
 		AutocommitInterval: configtypes.Duration{Duration: time.Second},
-	}, logger)
+	}, logger, nil, nil)
+	require.NoError(t, err)
 	defer stream.Close()
 
-	err := producer.produceMsgs(ctx, rawRsvps)
+	err = producer.produceMsgs(ctx, rawRsvps)
 	require.NoError(t, err)
 
 	gotRsvps := readStream(ctx, stream, 5*time.Second) // TODO: get rid of hardcoded 5s window, wait for all messages explicitly
@@ -68,6 +68,56 @@ func TestStream(t *testing.T) {
 	require.Equal(t, wantRsvps, gotRsvps)
 }
 
+func TestStream_DBOffsetStorage(t *testing.T) {
+	const (
+		topic         = "ing_e2e_kafka_test_dboffsets_topic"
+		consumerGroup = "ing_e2e_kafka_test_dboffsets_consumergroup"
+	)
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	brokerAddr, producer, logger, rawRsvps, tearDown := setUp(t, ctx, topic)
+	defer tearDown(t)
+
+	err := producer.produceMsgs(ctx, rawRsvps)
+	require.NoError(t, err)
+
+	// pretend that the first half of messages has been already saved
+	half := len(rawRsvps) / 2
+
+	store := newOffsetStore()
+	err = store.SaveConsumerOffset(ctx, rsvps.Origin{ConsumerGroup: consumerGroup, Topic: topic, Partition: 0, Offset: int64(half - 1)})
+	require.NoError(t, err)
+
+	stream, err := kafka.NewStream(kafka.Config{
+		Brokers:        []string{brokerAddr},
+		Topic:          topic,
+		ConsumerGroup:  consumerGroup,
+		SessionTimeout: configtypes.Duration{Duration: time.Minute},
+		OffsetStorage:  kafka.OffsetStorageDB,
+	}, logger, nil, store)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	gotRsvps := readStream(ctx, stream, 5*time.Second)
+
+	wantRsvps := parseRsvps(rawRsvps[half:])
+
+	cmpRsvp := func(rsvp1, rsvp2 rsvps.RSVP) bool {
+		return rsvp1.ID < rsvp2.ID
+	}
+
+	sort.Slice(gotRsvps, func(i, j int) bool { return cmpRsvp(gotRsvps[i], gotRsvps[j]) })
+	sort.Slice(wantRsvps, func(i, j int) bool { return cmpRsvp(wantRsvps[i], wantRsvps[j]) })
+
+	require.Equal(t, wantRsvps, gotRsvps)
+}
+
 func setUp(t *testing.T, ctx context.Context, topic string) (string, *producer, *zap.Logger, []string, func(t *testing.T)) {
 	t.Helper()
 
@@ -147,8 +197,7 @@ func getTestRsvps(filename string) ([]string, error) {
 
 func parseRsvps(raws []string) (valid []rsvps.RSVP) {
 	for _, raw := range raws {
-		var rsvp rsvps.RSVP
-		if err := json.Unmarshal([]byte(raw), &rsvp); err == nil {
+		if rsvp, err := rsvps.Decode([]byte(raw)); err == nil {
 			valid = append(valid, rsvp)
 		}
 	}
@@ -164,9 +213,10 @@ func readStream(ctx context.Context, stream *kafka.Stream, duration time.Duratio
 	)
 
 	go func() {
-		for rsvp := range stream.RSVPS() {
+		for msg := range stream.RSVPS() {
 			readOnce.Do(func() { close(readCh) })
-			rsvps = append(rsvps, rsvp)
+			rsvps = append(rsvps, msg.RSVP)
+			msg.Ack()
 		}
 	}()
 
@@ -210,3 +260,37 @@ func (p *producer) produceMsgs(ctx context.Context, msgs []string) error {
 	}
 	return nil
 }
+
+type offsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]map[int]int64
+}
+
+func newOffsetStore() *offsetStore {
+	return &offsetStore{offsets: make(map[string]map[int]int64)}
+}
+
+func (s *offsetStore) ConsumerOffsets(ctx context.Context, consumerGroup, topic string) (map[int]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offsets := make(map[int]int64)
+	for partition, offset := range s.offsets[consumerGroup+"/"+topic] {
+		offsets[partition] = offset
+	}
+	return offsets, nil
+}
+
+func (s *offsetStore) SaveConsumerOffset(ctx context.Context, origin rsvps.Origin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := origin.ConsumerGroup + "/" + origin.Topic
+	if s.offsets[key] == nil {
+		s.offsets[key] = make(map[int]int64)
+	}
+	if offset, ok := s.offsets[key][origin.Partition]; !ok || offset < origin.Offset {
+		s.offsets[key][origin.Partition] = origin.Offset
+	}
+	return nil
+}
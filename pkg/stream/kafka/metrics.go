@@ -1,14 +1,24 @@
 package kafka
 
-import "github.com/VictoriaMetrics/metrics"
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
 
 var (
-	kafkaDials           = metrics.NewCounter("kafka_dials_total")
-	kafkaFetches         = metrics.NewCounter("kafka_fetches_total")
-	kafkaMessages        = metrics.NewCounter("kafka_messages_total")
-	kafkaInvalidMessages = metrics.NewCounter("kafka_invalid_messages_total")
-	kafkaBytes           = metrics.NewCounter("kafka_bytes_total")
-	kafkaRebalances      = metrics.NewCounter("kafka_rebalances_total")
-	kafkaTimeouts        = metrics.NewCounter("kafka_timeouts_total")
-	kafkaErrors          = metrics.NewCounter("kafka_errors_total")
+	kafkaDials               = metrics.NewCounter("kafka_dials_total")
+	kafkaFetches             = metrics.NewCounter("kafka_fetches_total")
+	kafkaMessages            = metrics.NewCounter("kafka_messages_total")
+	kafkaRedeliveredMessages = metrics.NewCounter("kafka_redelivered_messages_total")
+	kafkaParkedMessages      = metrics.NewCounter("kafka_parked_messages_total")
+	kafkaParkFailures        = metrics.NewCounter("kafka_park_failures_total")
+	kafkaBytes               = metrics.NewCounter("kafka_bytes_total")
+	kafkaRebalances          = metrics.NewCounter("kafka_rebalances_total")
+	kafkaTimeouts            = metrics.NewCounter("kafka_timeouts_total")
+	kafkaErrors              = metrics.NewCounter("kafka_errors_total")
 )
+
+func kafkaRejectedMessages(field, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`kafka_rejected_messages_total{field=%q,reason=%q}`, field, reason))
+}
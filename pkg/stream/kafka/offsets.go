@@ -0,0 +1,66 @@
+package kafka
+
+import "sync"
+
+// offsetTracker tracks in-flight messages per partition and tells which offset
+// can be committed, so that an offset is never committed past a message which
+// hasn't been processed yet.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+type partitionOffsets struct {
+	pending []int64        // in-flight offsets in the order they were fetched
+	done    map[int64]bool // in-flight offset -> whether it was processed
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[int]*partitionOffsets)}
+}
+
+func (t *offsetTracker) track(partition int, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partition]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		t.partitions[partition] = p
+	}
+
+	if n := len(p.pending); n > 0 && p.pending[n-1] >= offset {
+		// the partition was rewound (i.e. after a rebalance), so in-flight offsets
+		// will be fetched again and must not be committed
+		p.pending = p.pending[:0]
+		p.done = make(map[int64]bool)
+	}
+
+	p.pending = append(p.pending, offset)
+	p.done[offset] = false
+}
+
+// markDone marks offset as processed and returns the highest offset which can be
+// committed, ok is false if the commit point hasn't moved.
+func (t *offsetTracker) markDone(partition int, offset int64) (commit int64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, found := t.partitions[partition]
+	if !found {
+		return 0, false
+	}
+
+	if _, inflight := p.done[offset]; !inflight {
+		return 0, false
+	}
+	p.done[offset] = true
+
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		commit, ok = p.pending[0], true
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+	}
+
+	return commit, ok
+}
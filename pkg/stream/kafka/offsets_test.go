@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetTracker(t *testing.T) {
+
+	t.Run("commits in order", func(t *testing.T) {
+		tracker := newOffsetTracker()
+
+		for offset := int64(10); offset < 15; offset++ {
+			tracker.track(1, offset)
+		}
+
+		_, ok := tracker.markDone(1, 12)
+		require.False(t, ok)
+
+		_, ok = tracker.markDone(1, 11)
+		require.False(t, ok)
+
+		commit, ok := tracker.markDone(1, 10)
+		require.True(t, ok)
+		require.Equal(t, int64(12), commit)
+
+		commit, ok = tracker.markDone(1, 13)
+		require.True(t, ok)
+		require.Equal(t, int64(13), commit)
+	})
+
+	t.Run("partitions are independent", func(t *testing.T) {
+		tracker := newOffsetTracker()
+
+		tracker.track(1, 10)
+		tracker.track(2, 20)
+		tracker.track(1, 11)
+
+		commit, ok := tracker.markDone(2, 20)
+		require.True(t, ok)
+		require.Equal(t, int64(20), commit)
+
+		_, ok = tracker.markDone(1, 11)
+		require.False(t, ok)
+	})
+
+	t.Run("unknown offsets are ignored", func(t *testing.T) {
+		tracker := newOffsetTracker()
+
+		_, ok := tracker.markDone(1, 10)
+		require.False(t, ok)
+
+		tracker.track(1, 10)
+
+		_, ok = tracker.markDone(1, 9)
+		require.False(t, ok)
+	})
+
+	t.Run("rewound partition forgets in-flight offsets", func(t *testing.T) {
+		tracker := newOffsetTracker()
+
+		tracker.track(1, 10)
+		tracker.track(1, 11)
+		tracker.track(1, 10)
+
+		_, ok := tracker.markDone(1, 11)
+		require.False(t, ok)
+
+		commit, ok := tracker.markDone(1, 10)
+		require.True(t, ok)
+		require.Equal(t, int64(10), commit)
+	})
+}
@@ -0,0 +1,50 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// Producer publishes RSVPs to the topic the stream reads from, keyed by their
+// event IDs.
+type Producer struct {
+	w *kafka.Writer
+}
+
+func NewProducer(cfg Config) *Producer {
+	return &Producer{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			WriteTimeout: cfg.WriteTimeout.Duration,
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+// Produce publishes the payload the RSVP was decoded from as is, so that nothing
+// the decoder doesn't know about is lost; the RSVP is marshalled only if there is
+// no payload.
+func (p *Producer) Produce(ctx context.Context, rsvp rsvps.RSVP, raw []byte) error {
+	b := raw
+	if len(b) == 0 {
+		var err error
+		if b, err = rsvps.Encode(rsvp); err != nil {
+			return fmt.Errorf("could not marshal rsvp %v: %w", rsvp.ID, err)
+		}
+	}
+
+	if err := p.w.WriteMessages(ctx, kafka.Message{Key: []byte(rsvp.Event.ID), Value: b}); err != nil {
+		return fmt.Errorf("could not produce rsvp %v: %w", rsvp.ID, err)
+	}
+	return nil
+}
+
+func (p *Producer) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+)
+
+// Tag sets the source of every RSVP received from the stream.
+func Tag(s Stream, source string) Stream {
+	return newForwarder([]Stream{s}, func(msg Message) Message {
+		msg.RSVP.Source = source
+		return msg
+	})
+}
+
+// Merge combines messages of several streams into a single stream, closing it
+// closes all of them.
+func Merge(streams ...Stream) Stream {
+	if len(streams) == 1 {
+		return streams[0]
+	}
+	return newForwarder(streams, func(msg Message) Message { return msg })
+}
+
+// forwarder forwards messages of streams till they are closed. Messages which
+// are not yet received when the forwarder is closed are neither acked nor nacked,
+// so they are redelivered by their streams later.
+type forwarder struct {
+	streams []Stream
+
+	ch   chan Message
+	done chan struct{}
+	once sync.Once
+}
+
+func newForwarder(streams []Stream, fn func(Message) Message) *forwarder {
+	f := &forwarder{
+		streams: streams,
+		ch:      make(chan Message),
+		done:    make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s Stream) {
+			defer wg.Done()
+
+			for msg := range s.RSVPS() {
+				select {
+				case f.ch <- fn(msg):
+				case <-f.done:
+					return
+				}
+			}
+		}(s)
+	}
+
+	go func() {
+		wg.Wait()
+		close(f.ch)
+	}()
+
+	return f
+}
+
+func (f *forwarder) RSVPS() <-chan Message {
+	return f.ch
+}
+
+func (f *forwarder) Pause() {
+	for _, s := range f.streams {
+		Pause(s)
+	}
+}
+
+func (f *forwarder) Resume() {
+	for _, s := range f.streams {
+		Resume(s)
+	}
+}
+
+func (f *forwarder) Close() error {
+	f.once.Do(func() { close(f.done) })
+
+	var errs []error
+	for _, s := range f.streams {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package stream_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+	"github.com/oizgagin/ing/pkg/stream"
+)
+
+type fakeStream struct {
+	ch     chan stream.Message
+	closed bool
+	paused bool
+}
+
+func newFakeStream(ids ...int64) *fakeStream {
+	s := &fakeStream{ch: make(chan stream.Message, len(ids))}
+	for _, id := range ids {
+		s.ch <- stream.NewMessage(rsvps.RSVP{ID: id}, nil, rsvps.Origin{}, nil, nil)
+	}
+	close(s.ch)
+	return s
+}
+
+func (s *fakeStream) RSVPS() <-chan stream.Message { return s.ch }
+
+func (s *fakeStream) Pause()  { s.paused = true }
+func (s *fakeStream) Resume() { s.paused = false }
+
+func (s *fakeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestMerge(t *testing.T) {
+	eu, us := newFakeStream(1, 2), newFakeStream(1, 3)
+
+	merged := stream.Merge(stream.Tag(eu, "eu"), stream.Tag(us, "us"))
+
+	var got []string
+	for msg := range merged.RSVPS() {
+		got = append(got, fmt.Sprintf("%v/%v", msg.RSVP.Source, msg.RSVP.ID))
+	}
+	sort.Strings(got)
+
+	require.Equal(t, []string{"eu/1", "eu/2", "us/1", "us/3"}, got)
+
+	stream.Pause(merged)
+	require.True(t, eu.paused)
+	require.True(t, us.paused)
+	stream.Resume(merged)
+	require.False(t, eu.paused)
+	require.False(t, us.paused)
+
+	require.NoError(t, merged.Close())
+	require.True(t, eu.closed)
+	require.True(t, us.closed)
+}
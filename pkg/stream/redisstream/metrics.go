@@ -0,0 +1,18 @@
+package redisstream
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	redisStreamReadMessages    = metrics.NewCounter("redis_stream_read_messages_total")
+	redisStreamClaimedMessages = metrics.NewCounter("redis_stream_claimed_messages_total")
+	redisStreamParkedMessages  = metrics.NewCounter("redis_stream_parked_messages_total")
+	redisStreamErrors          = metrics.NewCounter("redis_stream_errors_total")
+)
+
+func redisStreamRejectedMessages(field, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`redis_stream_rejected_messages_total{field=%q,reason=%q}`, field, reason))
+}
@@ -0,0 +1,437 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/rsvps"
+	streampkg "github.com/oizgagin/ing/pkg/stream"
+)
+
+type Config struct {
+	Addr string `toml:"addr"`
+	User string `toml:"user"`
+	Pass string `toml:"pass"`
+	DB   int    `toml:"db"`
+
+	DialTimeout  configtypes.Duration `toml:"dial_timeout"`
+	ReadTimeout  configtypes.Duration `toml:"read_timeout"`
+	WriteTimeout configtypes.Duration `toml:"write_timeout"`
+
+	Stream   string `toml:"stream"`
+	Field    string `toml:"field"`
+	Group    string `toml:"group"`
+	Consumer string `toml:"consumer"` // hostname if empty
+
+	Count int64                `toml:"count"`
+	Block configtypes.Duration `toml:"block"`
+
+	// Pending entries idle for longer than ClaimMinIdle (i.e. nacked ones or ones
+	// read by dead consumers) are reclaimed every ClaimInterval, and parked to the
+	// dead letter sink once they have been delivered more than MaxDeliveries times.
+	ClaimMinIdle  configtypes.Duration `toml:"claim_min_idle"`
+	ClaimInterval configtypes.Duration `toml:"claim_interval"`
+	MaxDeliveries int64                `toml:"max_deliveries"`
+}
+
+type Stream struct {
+	client *redis.Client
+
+	l *zap.Logger
+
+	dlq dlq.Sink
+
+	stream        string
+	field         string
+	group         string
+	consumer      string
+	count         int64
+	block         time.Duration
+	claimMinIdle  time.Duration
+	claimInterval time.Duration
+	maxDeliveries int64
+
+	ch     chan streampkg.Message
+	chOnce sync.Once
+
+	// inFlight are the ids of entries delivered but not acked or nacked yet, they
+	// aren't reclaimed however long they are processed
+	inFlight   map[string]struct{}
+	inFlightMu sync.Mutex
+
+	// entries aren't reclaimed while paused, as they would only be counted as
+	// delivered once again and parked after max deliveries
+	paused int32 // atomic
+
+	ctxCancel func()
+	wg        sync.WaitGroup
+
+	stats struct {
+		readMsgs    uint64 // atomic
+		claimedMsgs uint64 // atomic
+		parkedMsgs  uint64 // atomic
+		errors      uint64 // atomic
+	}
+}
+
+// NewStream creates a stream reading from the configured Redis stream. Entries
+// which can't be decoded or saved are parked to the dead letter sink, if it is nil
+// they are only acked.
+func NewStream(cfg Config, logger *zap.Logger, deadLetters dlq.Sink) (*Stream, error) {
+	consumer := cfg.Consumer
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get hostname for consumer name: %w", err)
+		}
+		consumer = hostname
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.User,
+		Password: cfg.Pass,
+		DB:       cfg.DB,
+
+		DialTimeout:  cfg.DialTimeout.Duration,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+	})
+
+	initCtx, initCancel := context.WithTimeout(context.Background(), time.Second)
+	defer initCancel()
+
+	err := client.XGroupCreateMkStream(initCtx, cfg.Stream, cfg.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		client.Close()
+		return nil, fmt.Errorf("could not create consumer group %v for %v: %w", cfg.Group, cfg.Stream, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := &Stream{
+		client:        client,
+		l:             logger.With(zap.String("logger", "redis_stream")),
+		dlq:           deadLetters,
+		stream:        cfg.Stream,
+		field:         cfg.Field,
+		group:         cfg.Group,
+		consumer:      consumer,
+		count:         cfg.Count,
+		block:         cfg.Block.Duration,
+		claimMinIdle:  cfg.ClaimMinIdle.Duration,
+		claimInterval: cfg.ClaimInterval.Duration,
+		maxDeliveries: cfg.MaxDeliveries,
+		ch:            make(chan streampkg.Message),
+		inFlight:      make(map[string]struct{}),
+		ctxCancel:     cancel,
+	}
+
+	stream.wg.Add(2)
+	go stream.loop(ctx)
+	go stream.claimLoop(ctx)
+	go stream.metrics(ctx)
+
+	return stream, nil
+}
+
+func (stream *Stream) RSVPS() <-chan streampkg.Message {
+	return stream.ch
+}
+
+func (stream *Stream) Close() error {
+	stream.ctxCancel()
+	stream.wg.Wait()
+	stream.chOnce.Do(func() { close(stream.ch) })
+	return stream.client.Close()
+}
+
+func (stream *Stream) loop(ctx context.Context) {
+	defer stream.wg.Done()
+
+	for {
+		res, err := stream.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    stream.group,
+			Consumer: stream.consumer,
+			Streams:  []string{stream.stream, ">"},
+			Count:    stream.count,
+			Block:    stream.block,
+		}).Result()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			if err != redis.Nil {
+				atomic.AddUint64(&stream.stats.errors, 1)
+				stream.l.Error("could not read stream", zap.Error(err))
+				stream.sleep(ctx, time.Second)
+			}
+			continue
+		}
+
+		for _, xstream := range res {
+			atomic.AddUint64(&stream.stats.readMsgs, uint64(len(xstream.Messages)))
+
+			for _, msg := range xstream.Messages {
+				if !stream.send(ctx, msg, 1) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// claimLoop takes over entries which stayed pending for too long, either because
+// they were nacked or because their consumer died. Entries still in flight of this
+// consumer aren't claimed, as it would count them as delivered once again, nor
+// any entries while the stream is paused.
+func (stream *Stream) claimLoop(ctx context.Context) {
+	defer stream.wg.Done()
+
+	start := "-"
+
+	for {
+		if !stream.sleep(ctx, stream.claimInterval) {
+			return
+		}
+
+		if atomic.LoadInt32(&stream.paused) == 1 {
+			continue
+		}
+
+		pending, err := stream.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream.stream,
+			Group:  stream.group,
+			Idle:   stream.claimMinIdle,
+			Start:  start,
+			End:    "+",
+			Count:  stream.count,
+		}).Result()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			atomic.AddUint64(&stream.stats.errors, 1)
+			stream.l.Error("could not get pending entries", zap.Error(err))
+			continue
+		}
+
+		// the next scan continues after the last entry, or from the start once all
+		// of them were scanned
+		start = "-"
+		if int64(len(pending)) == stream.count {
+			start = "(" + pending[len(pending)-1].ID
+		}
+
+		var (
+			ids        []string
+			deliveries = make(map[string]int64, len(pending))
+		)
+		for _, p := range pending {
+			if stream.isInFlight(p.ID) {
+				continue
+			}
+			ids = append(ids, p.ID)
+			// claiming delivers the entry once more
+			deliveries[p.ID] = p.RetryCount + 1
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		// entries which were claimed by another consumer meanwhile aren't idle
+		// anymore, so they aren't claimed
+		msgs, err := stream.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream.stream,
+			Group:    stream.group,
+			Consumer: stream.consumer,
+			MinIdle:  stream.claimMinIdle,
+			Messages: ids,
+		}).Result()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			atomic.AddUint64(&stream.stats.errors, 1)
+			stream.l.Error("could not claim pending entries", zap.Error(err))
+			continue
+		}
+
+		atomic.AddUint64(&stream.stats.claimedMsgs, uint64(len(msgs)))
+
+		for _, msg := range msgs {
+			if deliveries[msg.ID] > stream.maxDeliveries {
+				stream.park(ctx, msg, dlq.StageSave, deliveries[msg.ID], errors.New("deliveries exhausted"))
+				continue
+			}
+
+			if !stream.send(ctx, msg, deliveries[msg.ID]) {
+				return
+			}
+		}
+	}
+}
+
+// Pause stops reclaiming pending entries until the stream is resumed.
+func (stream *Stream) Pause() {
+	atomic.StoreInt32(&stream.paused, 1)
+}
+
+func (stream *Stream) Resume() {
+	atomic.StoreInt32(&stream.paused, 0)
+}
+
+func (stream *Stream) isInFlight(id string) bool {
+	stream.inFlightMu.Lock()
+	defer stream.inFlightMu.Unlock()
+
+	_, ok := stream.inFlight[id]
+	return ok
+}
+
+func (stream *Stream) setInFlight(id string, inFlight bool) {
+	stream.inFlightMu.Lock()
+	defer stream.inFlightMu.Unlock()
+
+	if inFlight {
+		stream.inFlight[id] = struct{}{}
+	} else {
+		delete(stream.inFlight, id)
+	}
+}
+
+func (stream *Stream) send(ctx context.Context, msg redis.XMessage, deliveries int64) bool {
+	l := stream.l.With(zap.String("id", msg.ID))
+
+	l.Debug("received redis stream entry")
+
+	raw, _ := msg.Values[stream.field].(string)
+
+	rsvp, err := rsvps.Decode([]byte(raw))
+	if err != nil {
+		redisStreamRejectedMessages(rsvps.RejectReason(err)).Inc()
+		l.Error("invalid redis stream entry", zap.Error(err))
+		stream.park(ctx, msg, dlq.StageDecode, deliveries, err)
+		return true
+	}
+
+	var once sync.Once
+
+	ack := func() {
+		defer once.Do(func() { stream.setInFlight(msg.ID, false) })
+
+		ackCtx, ackCancel := context.WithTimeout(context.Background(), time.Second)
+		defer ackCancel()
+
+		if err := stream.client.XAck(ackCtx, stream.stream, stream.group, msg.ID).Err(); err != nil {
+			atomic.AddUint64(&stream.stats.errors, 1)
+			l.Error("could not ack redis stream entry", zap.Error(err))
+		}
+	}
+
+	// nacked entries stay pending and get reclaimed after claim_min_idle, unless
+	// they have to be parked
+	nack := func(err error) {
+		defer once.Do(func() { stream.setInFlight(msg.ID, false) })
+
+		if errors.Is(err, streampkg.ErrPark) {
+			parkCtx, parkCancel := context.WithTimeout(context.Background(), time.Second)
+			defer parkCancel()
+
+			stream.park(parkCtx, msg, dlq.StageSave, deliveries, err)
+			return
+		}
+		l.Debug("redis stream entry nacked", zap.Int64("deliveries", deliveries), zap.Error(err))
+	}
+
+	stream.setInFlight(msg.ID, true)
+
+	select {
+	case stream.ch <- streampkg.NewMessage(rsvp, []byte(raw), rsvps.Origin{Topic: stream.stream, ReceivedAt: time.Now()}, ack, nack):
+		return true
+	case <-ctx.Done():
+		stream.setInFlight(msg.ID, false)
+		return false
+	}
+}
+
+// park hands the entry over to the dead letter sink and acks it, if there is no
+// dead letter sink the entry is only acked. Entries which couldn't be parked stay
+// pending and are reclaimed again.
+func (stream *Stream) park(ctx context.Context, msg redis.XMessage, stage string, deliveries int64, err error) {
+	l := stream.l.With(zap.String("id", msg.ID), zap.String("stage", stage))
+
+	atomic.AddUint64(&stream.stats.parkedMsgs, 1)
+
+	if stream.dlq == nil {
+		l.Error("dropping redis stream entry, no dead letter sink", zap.Error(err))
+	} else {
+		raw, _ := msg.Values[stream.field].(string)
+
+		// entries aren't read from a topic, so they can't be replayed
+		letter := dlq.Letter{
+			Key:      []byte(msg.ID),
+			Value:    []byte(raw),
+			Err:      err.Error(),
+			Stage:    stage,
+			Attempts: int(deliveries),
+			Source:   stream.stream,
+		}
+
+		if parkErr := stream.dlq.Park(ctx, letter); parkErr != nil {
+			atomic.AddUint64(&stream.stats.errors, 1)
+			l.Error("could not park redis stream entry", zap.Error(parkErr))
+			return
+		}
+	}
+
+	if ackErr := stream.client.XAck(ctx, stream.stream, stream.group, msg.ID).Err(); ackErr != nil {
+		atomic.AddUint64(&stream.stats.errors, 1)
+		l.Error("could not ack parked redis stream entry", zap.Error(ackErr))
+		return
+	}
+
+	l.Info("parked redis stream entry", zap.Error(err))
+}
+
+func (stream *Stream) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (stream *Stream) metrics(ctx context.Context) {
+	for {
+		redisStreamReadMessages.Add(int(atomic.SwapUint64(&stream.stats.readMsgs, 0)))
+		redisStreamClaimedMessages.Add(int(atomic.SwapUint64(&stream.stats.claimedMsgs, 0)))
+		redisStreamParkedMessages.Add(int(atomic.SwapUint64(&stream.stats.parkedMsgs, 0)))
+		redisStreamErrors.Add(int(atomic.SwapUint64(&stream.stats.errors, 0)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
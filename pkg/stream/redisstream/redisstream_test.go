@@ -0,0 +1,177 @@
+//go:build e2e
+
+package redisstream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	configtypes "github.com/oizgagin/ing/pkg/config/types"
+	"github.com/oizgagin/ing/pkg/dlq"
+	"github.com/oizgagin/ing/pkg/stream/redisstream"
+)
+
+func TestStream(t *testing.T) {
+	const (
+		stream = "ing_e2e_redisstream_test_stream"
+	)
+
+	var (
+		maxTestDuration = time.Minute
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxTestDuration)
+	defer cancel()
+
+	cfg, client := setUp(t, ctx)
+	defer client.Close()
+
+	cfg.Stream = stream
+
+	deadLetters := &sink{}
+
+	rsvp := func(id int) string {
+		return fmt.Sprintf(
+			`{"rsvp_id":%d,"mtime":1678017600000,"response":"yes","visibility":"public","member":{"member_id":1},"event":{"event_id":"event_id1"},"group":{"group_id":1,"group_country":"us"}}`,
+			id,
+		)
+	}
+
+	for _, value := range []string{rsvp(1), `{"rsvp_id":`, rsvp(2)} {
+		require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"rsvp": value}}).Err())
+	}
+
+	// first consumer dies without acking anything
+	cfg.Consumer = "dead"
+	dead, err := redisstream.NewStream(cfg, zaptest.NewLogger(t), deadLetters)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		<-dead.RSVPS()
+	}
+	require.NoError(t, dead.Close())
+
+	// second consumer reclaims, nacks the first rsvp until it is parked and acks the second one
+	cfg.Consumer = "alive"
+	alive, err := redisstream.NewStream(cfg, zaptest.NewLogger(t), deadLetters)
+	require.NoError(t, err)
+	defer alive.Close()
+
+	acked := false
+	for !acked {
+		select {
+		case msg := <-alive.RSVPS():
+			if msg.RSVP.ID == 2 {
+				msg.Ack()
+				acked = true
+			} else {
+				msg.Nack(errors.New("could not save rsvp"))
+			}
+		case <-ctx.Done():
+			t.Fatal("rsvp was not reclaimed")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, stream, cfg.Group).Result()
+		return err == nil && pending.Count == 0
+	}, maxTestDuration/2, 100*time.Millisecond)
+
+	// entries being processed for longer than claim_min_idle aren't reclaimed
+	require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"rsvp": rsvp(3)}}).Err())
+
+	msg := <-alive.RSVPS()
+	require.EqualValues(t, 3, msg.RSVP.ID)
+
+	select {
+	case msg := <-alive.RSVPS():
+		t.Fatalf("rsvp %v was reclaimed while in flight", msg.RSVP.ID)
+	case <-time.After(10 * cfg.ClaimMinIdle.Duration):
+	}
+
+	pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: stream, Group: cfg.Group, Start: "-", End: "+", Count: 10}).Result()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.EqualValues(t, 1, pending[0].RetryCount)
+	msg.Ack()
+
+	parked := deadLetters.parked()
+	require.Len(t, parked, 2)
+
+	stages := []string{parked[0].Stage, parked[1].Stage}
+	require.ElementsMatch(t, []string{dlq.StageDecode, dlq.StageSave}, stages)
+	for _, letter := range parked {
+		require.Equal(t, stream, letter.Source)
+		require.Empty(t, letter.Topic)
+	}
+}
+
+type sink struct {
+	mu      sync.Mutex
+	letters []dlq.Letter
+}
+
+func (s *sink) Park(ctx context.Context, letter dlq.Letter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *sink) Close() error {
+	return nil
+}
+
+func (s *sink) parked() []dlq.Letter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dlq.Letter(nil), s.letters...)
+}
+
+func setUp(t *testing.T, ctx context.Context) (redisstream.Config, *redis.Client) {
+	t.Helper()
+
+	redisAddrs := strings.Split(os.Getenv("ING_E2E_REDIS_ADDRS"), ",")
+	require.NotEmpty(t, redisAddrs[0])
+
+	redisUser := os.Getenv("ING_E2E_REDIS_USER")
+	require.NotEmpty(t, redisUser)
+
+	redisPass := os.Getenv("ING_E2E_REDIS_PASS")
+	require.NotEmpty(t, redisPass)
+
+	cfg := redisstream.Config{
+		Addr: redisAddrs[0],
+		User: redisUser,
+		Pass: redisPass,
+		DB:   0,
+
+		DialTimeout:  configtypes.Duration{Duration: time.Second},
+		ReadTimeout:  configtypes.Duration{Duration: time.Second},
+		WriteTimeout: configtypes.Duration{Duration: time.Second},
+
+		Field: "rsvp",
+		Group: fmt.Sprintf("ing_e2e_redisstream_test_group_%d", time.Now().UnixNano()),
+		Count: 10,
+		Block: configtypes.Duration{Duration: 100 * time.Millisecond},
+
+		ClaimMinIdle:  configtypes.Duration{Duration: 100 * time.Millisecond},
+		ClaimInterval: configtypes.Duration{Duration: 100 * time.Millisecond},
+		MaxDeliveries: 3,
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: cfg.Addr, Username: cfg.User, Password: cfg.Pass})
+	require.NoError(t, client.FlushAll(ctx).Err())
+
+	return cfg, client
+}
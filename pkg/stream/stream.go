@@ -1,8 +1,67 @@
 package stream
 
-import "github.com/oizgagin/ing/pkg/rsvps"
+import (
+	"errors"
+
+	"github.com/oizgagin/ing/pkg/rsvps"
+)
+
+// ErrPark is wrapped by nack errors of messages which must not be redelivered (their
+// processing failed permanently or was already retried), streams park them to
+// their dead letter sinks right away.
+var ErrPark = errors.New("parked by handler")
 
 type Stream interface {
-	RSVPS() <-chan rsvps.RSVP
+	RSVPS() <-chan Message
 	Close() error
 }
+
+// Pauser is implemented by streams which keep redelivering messages on their own
+// (i.e. reclaim pending entries after a timeout), so that they hold off while the
+// stream isn't read.
+type Pauser interface {
+	Pause()
+	Resume()
+}
+
+// Pause pauses the stream if it is a Pauser.
+func Pause(s Stream) {
+	if p, ok := s.(Pauser); ok {
+		p.Pause()
+	}
+}
+
+// Resume resumes the stream if it is a Pauser.
+func Resume(s Stream) {
+	if p, ok := s.(Pauser); ok {
+		p.Resume()
+	}
+}
+
+// Message is an RSVP received from a stream. Every message has to be either acked
+// after it has been processed, or nacked if its processing failed.
+type Message struct {
+	RSVP   rsvps.RSVP
+	Raw    []byte // the payload RSVP was decoded from
+	Codec  string // the codec of the payload, JSON if it's empty
+	Origin rsvps.Origin
+
+	ack  func()
+	nack func(err error)
+}
+
+func NewMessage(rsvp rsvps.RSVP, raw []byte, origin rsvps.Origin, ack func(), nack func(err error)) Message {
+	return Message{RSVP: rsvp, Raw: raw, Origin: origin, ack: ack, nack: nack}
+}
+
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+func (m Message) Nack(err error) {
+	if m.nack != nil {
+		m.nack(err)
+	}
+}